@@ -1,7 +1,51 @@
 package types
 
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
 type Money int64
 
+// Currency is the ISO 4217 code of the currency money is held in.
+type Currency string
+
+const (
+	CurrencyTJS Currency = "TJS"
+	CurrencyUSD Currency = "USD"
+)
+
+// DefaultCurrency is the currency of accounts registered without one, and
+// of the records stored before accounts had a currency.
+const DefaultCurrency = CurrencyTJS
+
+var ErrCurrencyMismatch = errors.New("currencies don't match")
+
+// Amount is money in a currency. Its arithmetic refuses to mix currencies.
+type Amount struct {
+	Value    Money    `json:"value"`
+	Currency Currency `json:"currency"`
+}
+
+// Add returns the sum of the amounts, which must be in the same currency.
+func (a Amount) Add(b Amount) (Amount, error) {
+	if a.Currency != b.Currency {
+		return Amount{}, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, a.Currency, b.Currency)
+	}
+
+	return Amount{Value: a.Value + b.Value, Currency: a.Currency}, nil
+}
+
+// Sub returns a less b, which must be in the same currency.
+func (a Amount) Sub(b Amount) (Amount, error) {
+	if a.Currency != b.Currency {
+		return Amount{}, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, a.Currency, b.Currency)
+	}
+
+	return Amount{Value: a.Value - b.Value, Currency: a.Currency}, nil
+}
+
 type PaymentCategory string
 
 type PaymentStatus string
@@ -10,32 +54,137 @@ const (
 	PaymentStatusOK         PaymentStatus = "OK"
 	PaymentStatusFail       PaymentStatus = "FAIL"
 	PaymentStatusInProgress PaymentStatus = "INPROGRESS"
+	PaymentStatusExpired    PaymentStatus = "EXPIRED"
+)
+
+// PaymentDirection tells if a payment takes money out of its account or
+// brings it in. Only transfers bring money in.
+type PaymentDirection string
+
+const (
+	PaymentDirectionOut PaymentDirection = "OUT"
+	PaymentDirectionIn  PaymentDirection = "IN"
 )
 
-// Payment payment information
+// Payment payment information. Refunded is the part of Amount returned to
+// the account so far; both are in the Currency of the account. CreatedAt and
+// UpdatedAt are set when the payment is made and last changed, SettledAt
+// once its status is final; zero times are unknown, as for payments imported
+// from dumps without them. The two payments of a transfer are linked to each
+// other by LinkedID.
 type Payment struct {
-	ID        string
-	AccountID int64
-	Amount    Money
-	Category  PaymentCategory
-	Status    PaymentStatus
+	ID        string           `json:"id"`
+	AccountID int64            `json:"accountId"`
+	Amount    Money            `json:"amount"`
+	Refunded  Money            `json:"refunded"`
+	Currency  Currency         `json:"currency"`
+	Category  PaymentCategory  `json:"category"`
+	Status    PaymentStatus    `json:"status"`
+	Direction PaymentDirection `json:"direction"`
+	LinkedID  string           `json:"linkedId"`
+	CreatedAt time.Time        `json:"createdAt"`
+	UpdatedAt time.Time        `json:"updatedAt"`
+	SettledAt time.Time        `json:"settledAt"`
 }
+
+// PaymentTransition records a change of the status of a payment. From is
+// empty for the payment being made.
+type PaymentTransition struct {
+	PaymentID string        `json:"paymentId"`
+	From      PaymentStatus `json:"from"`
+	To        PaymentStatus `json:"to"`
+	At        time.Time     `json:"at"`
+}
+
+// Refund returns part of a payment to its account.
+type Refund struct {
+	ID        string    `json:"id"`
+	PaymentID string    `json:"paymentId"`
+	AccountID int64     `json:"accountId"`
+	Amount    Money     `json:"amount"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// LedgerKind is the operation a ledger transaction records.
+type LedgerKind string
+
+const (
+	LedgerKindDeposit    LedgerKind = "DEPOSIT"
+	LedgerKindPayment    LedgerKind = "PAYMENT"
+	LedgerKindTransfer   LedgerKind = "TRANSFER"
+	LedgerKindRefund     LedgerKind = "REFUND"
+	LedgerKindReversal   LedgerKind = "REVERSAL"
+	LedgerKindAdjustment LedgerKind = "ADJUSTMENT"
+)
+
+// LedgerTransaction posts balanced entries in one currency to ledger
+// accounts. Reference is the ID of the payment it belongs to, if any.
+type LedgerTransaction struct {
+	ID        int64         `json:"id"`
+	Kind      LedgerKind    `json:"kind"`
+	Currency  Currency      `json:"currency"`
+	Reference string        `json:"reference,omitempty"`
+	At        time.Time     `json:"at"`
+	Entries   []LedgerEntry `json:"entries"`
+}
+
+// LedgerEntry debits or credits one ledger account.
+type LedgerEntry struct {
+	Account string `json:"account"`
+	Debit   Money  `json:"debit,omitempty"`
+	Credit  Money  `json:"credit,omitempty"`
+}
+
+type HoldStatus string
+
+const (
+	HoldStatusActive   HoldStatus = "ACTIVE"
+	HoldStatusCaptured HoldStatus = "CAPTURED"
+	HoldStatusVoided   HoldStatus = "VOIDED"
+	HoldStatusExpired  HoldStatus = "EXPIRED"
+)
+
+// Hold reserves Amount of the balance of an account until it is captured,
+// voided or expires at ExpiresAt. A capture of Captured made the payment
+// PaymentID.
+type Hold struct {
+	ID        string          `json:"id"`
+	AccountID int64           `json:"accountId"`
+	Amount    Money           `json:"amount"`
+	Captured  Money           `json:"captured"`
+	Category  PaymentCategory `json:"category"`
+	Status    HoldStatus      `json:"status"`
+	PaymentID string          `json:"paymentId,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+	ExpiresAt time.Time       `json:"expiresAt"`
+	SettledAt time.Time       `json:"settledAt"`
+}
+
 type Favorite struct {
-	ID        	string
-	AccountID 	int64
-	Name 			string	
-	Amount    	Money
-	Category  	PaymentCategory
+	ID        string          `json:"id"`
+	AccountID int64           `json:"accountId"`
+	Name      string          `json:"name"`
+	Amount    Money           `json:"amount"`
+	Currency  Currency        `json:"currency"`
+	Category  PaymentCategory `json:"category"`
 }
 
 type Phone string
 
+// Account holds the current Balance of a wallet in its Currency; a phone
+// has one account per currency. Available is what is left of the balance
+// to spend once the active holds are taken out; the service fills it in
+// when it returns an account, and it is never stored.
 type Account struct {
-	ID      int64
-	Phone   Phone
-	Balance Money
+	ID        int64    `json:"id"`
+	Phone     Phone    `json:"phone"`
+	Currency  Currency `json:"currency"`
+	Balance   Money    `json:"balance"`
+	Available Money    `json:"-"`
 }
 type Progress struct {
 	Part 		int
 	Result	Money
+	Currency	Currency
 }
\ No newline at end of file
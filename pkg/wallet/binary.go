@@ -0,0 +1,427 @@
+package wallet
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/darkside1809/wallet/pkg/types"
+)
+
+var ErrInvalidSnapshot = errors.New("invalid binary snapshot")
+
+// binaryMagic starts every binary snapshot, followed by binaryVersion as a
+// little endian uint32.
+const binaryMagic = "WLTB"
+
+// binaryVersion 2 added the times of payments, version 3 their refunded
+// amount, version 4 their direction and link, and version 5 the currency of
+// every record; older snapshots are still read, leaving times unknown,
+// nothing refunded, payments going out and everything in DefaultCurrency.
+const binaryVersion = 5
+
+// binaryMaxRecordSize bounds the payload length read from a record, so a
+// garbage length can't make decoding allocate gigabytes.
+const binaryMaxRecordSize = 1 << 20
+
+// Record kinds of the binary snapshot.
+const (
+	binaryNextAccountID byte = iota + 1
+	binaryAccount
+	binaryPayment
+	binaryFavorite
+	// binaryEnd closes the snapshot with the number of records before it, so
+	// a snapshot cut at a record boundary is still detected.
+	binaryEnd
+)
+
+// ExportBinary writes the whole state as a binary snapshot, which is several
+// times smaller and faster to read than the text dumps.
+//
+// After the header come records of a kind byte, the payload length as an
+// uvarint, the payload, and the CRC-32C of the kind and payload as a little
+// endian uint32. Integers in payloads are varints and strings are prefixed
+// with their length; times are the Unix seconds as a varint followed by the
+// nanoseconds as an uvarint. The first record holds the next account ID,
+// then come the accounts, payments and favorites, and an end record with the
+// count of all the records before it. Records are encoded one at a time as
+// they are written.
+func (s *Service) ExportBinary(w io.Writer) error {
+	state, err := s.snapshot()
+	if err != nil {
+		return err
+	}
+
+	encoder := &binaryEncoder{w: bufio.NewWriter(w)}
+	encoder.header()
+
+	encoder.start()
+	encoder.varint(state.LastAccountID + 1)
+	encoder.finish(binaryNextAccountID)
+
+	for _, account := range state.Accounts {
+		encoder.start()
+		encoder.varint(account.ID)
+		encoder.string(string(account.Phone))
+		encoder.varint(int64(account.Balance))
+		encoder.string(string(account.Currency))
+		encoder.finish(binaryAccount)
+	}
+	for _, payment := range state.Payments {
+		encoder.start()
+		encoder.string(payment.ID)
+		encoder.varint(payment.AccountID)
+		encoder.varint(int64(payment.Amount))
+		encoder.string(string(payment.Category))
+		encoder.string(string(payment.Status))
+		encoder.time(payment.CreatedAt)
+		encoder.time(payment.UpdatedAt)
+		encoder.time(payment.SettledAt)
+		encoder.varint(int64(payment.Refunded))
+		encoder.string(string(payment.Direction))
+		encoder.string(payment.LinkedID)
+		encoder.string(string(payment.Currency))
+		encoder.finish(binaryPayment)
+	}
+	for _, favorite := range state.Favorites {
+		encoder.start()
+		encoder.string(favorite.ID)
+		encoder.varint(favorite.AccountID)
+		encoder.string(favorite.Name)
+		encoder.varint(int64(favorite.Amount))
+		encoder.string(string(favorite.Category))
+		encoder.string(string(favorite.Currency))
+		encoder.finish(binaryFavorite)
+	}
+
+	encoder.start()
+	encoder.uvarint(encoder.records)
+	encoder.finish(binaryEnd)
+
+	if encoder.err != nil {
+		return encoder.err
+	}
+	return encoder.w.Flush()
+}
+
+// binaryEncoder writes records of a binary snapshot, keeping the first error.
+type binaryEncoder struct {
+	w       *bufio.Writer
+	err     error
+	payload []byte
+	scratch [binary.MaxVarintLen64]byte
+	records uint64
+}
+
+func (e *binaryEncoder) header() {
+	header := make([]byte, len(binaryMagic)+4)
+	copy(header, binaryMagic)
+	binary.LittleEndian.PutUint32(header[len(binaryMagic):], binaryVersion)
+	e.write(header)
+}
+
+func (e *binaryEncoder) write(p []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(p)
+	}
+}
+
+// start begins the payload of a new record.
+func (e *binaryEncoder) start() {
+	e.payload = e.payload[:0]
+}
+
+func (e *binaryEncoder) uvarint(v uint64) {
+	n := binary.PutUvarint(e.scratch[:], v)
+	e.payload = append(e.payload, e.scratch[:n]...)
+}
+
+func (e *binaryEncoder) varint(v int64) {
+	n := binary.PutVarint(e.scratch[:], v)
+	e.payload = append(e.payload, e.scratch[:n]...)
+}
+
+func (e *binaryEncoder) time(t time.Time) {
+	e.varint(t.Unix())
+	e.uvarint(uint64(t.Nanosecond()))
+}
+
+func (e *binaryEncoder) string(s string) {
+	e.uvarint(uint64(len(s)))
+	e.payload = append(e.payload, s...)
+}
+
+// finish writes the record with the payload built since start.
+func (e *binaryEncoder) finish(kind byte) {
+	if len(e.payload) > binaryMaxRecordSize && e.err == nil {
+		e.err = fmt.Errorf("binary snapshot: record of %d bytes", len(e.payload))
+	}
+
+	e.scratch[0] = kind
+	sum := crc32.Update(crc32.Checksum(e.scratch[:1], walTable), walTable, e.payload)
+	e.write(e.scratch[:1])
+	n := binary.PutUvarint(e.scratch[:], uint64(len(e.payload)))
+	e.write(e.scratch[:n])
+	e.write(e.payload)
+
+	binary.LittleEndian.PutUint32(e.scratch[:4], sum)
+	e.write(e.scratch[:4])
+	e.records++
+}
+
+// ImportBinary replaces the accounts, payments and favorites with the
+// snapshot written by ExportBinary, like ImportJSON. Records are decoded
+// and stored one at a time in a single transaction, which keeps the storage
+// locked while r is read. Nothing is stored unless the snapshot is complete
+// and valid, with the checks of ImportJSON.
+func (s *Service) ImportBinary(r io.Reader) error {
+	decoder := &binaryDecoder{r: bufio.NewReader(r)}
+
+	return s.store().Update(func(tx Tx) error {
+		err := tx.Clear()
+		if err != nil {
+			return err
+		}
+
+		return decoder.run(stateLoader{tx: tx, now: s.now()})
+	})
+}
+
+// binaryDecoder reads records of a binary snapshot. Field readers keep the
+// first error, which the record reports once decoded.
+type binaryDecoder struct {
+	r       *bufio.Reader
+	version uint32
+	payload []byte
+	// pos is the read position in payload.
+	pos     int
+	err     error
+	records uint64
+}
+
+func (d *binaryDecoder) run(loader stateLoader) error {
+	header := make([]byte, len(binaryMagic)+4)
+	_, err := io.ReadFull(d.r, header)
+	if err != nil || string(header[:len(binaryMagic)]) != binaryMagic {
+		return fmt.Errorf("%w: not a binary snapshot", ErrInvalidSnapshot)
+	}
+	d.version = binary.LittleEndian.Uint32(header[len(binaryMagic):])
+	if d.version < 1 || d.version > binaryVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidSnapshot, d.version)
+	}
+
+	for {
+		kind, err := d.next()
+		if err != nil {
+			return err
+		}
+
+		switch kind {
+		case binaryNextAccountID:
+			next := d.varint()
+			err = d.fields()
+			if err == nil {
+				err = loader.reserve(next)
+			}
+		case binaryAccount:
+			account := &types.Account{
+				ID:      d.varint(),
+				Phone:   types.Phone(d.string()),
+				Balance: types.Money(d.varint()),
+			}
+			if d.version >= 5 {
+				account.Currency = types.Currency(d.string())
+			}
+			err = d.fields()
+			if err == nil {
+				err = loader.account(account)
+			}
+		case binaryPayment:
+			payment := &types.Payment{
+				ID:        d.string(),
+				AccountID: d.varint(),
+				Amount:    types.Money(d.varint()),
+				Category:  types.PaymentCategory(d.string()),
+				Status:    types.PaymentStatus(d.string()),
+			}
+			if d.version >= 2 {
+				payment.CreatedAt = d.time()
+				payment.UpdatedAt = d.time()
+				payment.SettledAt = d.time()
+			}
+			if d.version >= 3 {
+				payment.Refunded = types.Money(d.varint())
+			}
+			payment.Direction = types.PaymentDirectionOut
+			if d.version >= 4 {
+				payment.Direction = types.PaymentDirection(d.string())
+				payment.LinkedID = d.string()
+			}
+			if d.version >= 5 {
+				payment.Currency = types.Currency(d.string())
+			}
+			err = d.fields()
+			if err == nil {
+				err = loader.payment(payment)
+			}
+		case binaryFavorite:
+			favorite := &types.Favorite{
+				ID:        d.string(),
+				AccountID: d.varint(),
+				Name:      d.string(),
+				Amount:    types.Money(d.varint()),
+				Category:  types.PaymentCategory(d.string()),
+			}
+			if d.version >= 5 {
+				favorite.Currency = types.Currency(d.string())
+			}
+			err = d.fields()
+			if err == nil {
+				err = loader.favorite(favorite)
+			}
+		case binaryEnd:
+			return d.end(loader)
+		default:
+			err = fmt.Errorf("%w: unknown record kind %d", ErrInvalidSnapshot, kind)
+		}
+		if err != nil {
+			return fmt.Errorf("record %d: %w", d.records, err)
+		}
+		d.records++
+	}
+}
+
+// end checks the end record and that nothing follows it.
+func (d *binaryDecoder) end(loader stateLoader) error {
+	records := d.uvarint()
+	err := d.fields()
+	if err != nil {
+		return err
+	}
+	if records != d.records {
+		return fmt.Errorf("%w: %d records, end record counts %d", ErrInvalidSnapshot, d.records, records)
+	}
+
+	_, err = d.r.ReadByte()
+	if err != io.EOF {
+		return fmt.Errorf("%w: data after the end record", ErrInvalidSnapshot)
+	}
+
+	return loader.checkAccounts()
+}
+
+// next reads the next record, checks it, and returns its kind.
+func (d *binaryDecoder) next() (byte, error) {
+	kind, err := d.r.ReadByte()
+	if err == io.EOF {
+		return 0, fmt.Errorf("%w: missing end record", ErrInvalidSnapshot)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	length, err := binary.ReadUvarint(d.r)
+	if err == nil && length > binaryMaxRecordSize {
+		err = fmt.Errorf("record of %d bytes", length)
+	}
+	if err == nil {
+		if uint64(cap(d.payload)) < length {
+			d.payload = make([]byte, length)
+		}
+		d.payload = d.payload[:length]
+		_, err = io.ReadFull(d.r, d.payload)
+	}
+	var sum [4]byte
+	if err == nil {
+		_, err = io.ReadFull(d.r, sum[:])
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%w: record %d: %v", ErrInvalidSnapshot, d.records, err)
+	}
+
+	kindByte := [1]byte{kind}
+	want := crc32.Update(crc32.Checksum(kindByte[:], walTable), walTable, d.payload)
+	if binary.LittleEndian.Uint32(sum[:]) != want {
+		return 0, fmt.Errorf("%w: record %d: checksum mismatch", ErrInvalidSnapshot, d.records)
+	}
+
+	d.pos = 0
+	d.err = nil
+	return kind, nil
+}
+
+func (d *binaryDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(d.payload[d.pos:])
+	if n <= 0 {
+		d.err = errors.New("bad uvarint")
+		return 0
+	}
+	d.pos += n
+	return v
+}
+
+func (d *binaryDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Varint(d.payload[d.pos:])
+	if n <= 0 {
+		d.err = errors.New("bad varint")
+		return 0
+	}
+	d.pos += n
+	return v
+}
+
+func (d *binaryDecoder) time() time.Time {
+	sec := d.varint()
+	nsec := d.uvarint()
+	if d.err == nil && nsec >= uint64(time.Second) {
+		d.err = errors.New("bad nanoseconds")
+	}
+	if d.err != nil {
+		return time.Time{}
+	}
+
+	return time.Unix(sec, int64(nsec)).UTC()
+}
+
+func (d *binaryDecoder) string() string {
+	length := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if length > uint64(len(d.payload)-d.pos) {
+		d.err = errors.New("string past the end of the record")
+		return ""
+	}
+
+	s := string(d.payload[d.pos : d.pos+int(length)])
+	d.pos += int(length)
+	return s
+}
+
+// fields reports a problem with the fields of the current record, including
+// bytes left over after them.
+func (d *binaryDecoder) fields() error {
+	if d.err == nil && d.pos != len(d.payload) {
+		d.err = errors.New("trailing bytes")
+	}
+	if d.err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSnapshot, d.err)
+	}
+
+	return nil
+}
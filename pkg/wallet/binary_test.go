@@ -0,0 +1,209 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/darkside1809/wallet/pkg/types"
+)
+
+func TestService_ExportBinary_roundTrip(t *testing.T) {
+	s := newExportedService(t)
+	_, err := s.FavoritePayment(s.allPayments()[0].ID, "osh; plov|manti\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	err = s.ExportBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported := newTestService()
+	_, err = imported.RegisterAccount("+992000000099")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = imported.ImportBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, _ := s.snapshot()
+	got, _ := imported.snapshot()
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("ImportBinary(): state doesn't match the exported one:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestService_ImportBinary_damaged(t *testing.T) {
+	s := newExportedService(t)
+	buf := &bytes.Buffer{}
+	err := s.ExportBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := buf.Bytes()
+
+	damaged := map[string][]byte{}
+	for i := 0; i < len(snapshot); i++ {
+		damaged[fmt.Sprintf("cut at %d", i)] = snapshot[:i]
+
+		flipped := append([]byte(nil), snapshot...)
+		flipped[i] ^= 0x40
+		damaged[fmt.Sprintf("flipped at %d", i)] = flipped
+	}
+	damaged["trailing data"] = append(append([]byte(nil), snapshot...), 0)
+	newer := append([]byte(nil), snapshot...)
+	binary.LittleEndian.PutUint32(newer[len(binaryMagic):], binaryVersion+1)
+	damaged["newer version"] = newer
+
+	for name, content := range damaged {
+		imported := newTestService()
+		_, err := imported.RegisterAccount("+992000000099")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = imported.ImportBinary(bytes.NewReader(content))
+		if !errors.Is(err, ErrInvalidSnapshot) {
+			t.Errorf("ImportBinary(%s): must return ErrInvalidSnapshot, returned %v", name, err)
+		}
+
+		account, err := imported.FindAccountByID(1)
+		if err != nil || account.Phone != "+992000000099" {
+			t.Errorf("ImportBinary(%s): must not change the state, got %v, %v", name, account, err)
+		}
+	}
+}
+
+// newPaymentsService returns a service with the given number of payments
+// spread over a thousand accounts.
+func newPaymentsService(b *testing.B, payments int) *Service {
+	b.Helper()
+	storage := NewMemoryStorage()
+
+	for i := 1; i <= 1000; i++ {
+		storage.state.putAccount(&types.Account{
+			ID:      int64(i),
+			Phone:   types.Phone(fmt.Sprintf("+992%09d", i)),
+			Balance: 1_000_000_00,
+		})
+	}
+	for i := 0; i < payments; i++ {
+		storage.state.putPayment(&types.Payment{
+			ID:        fmt.Sprintf("payment-%d", i),
+			AccountID: int64(i%1000 + 1),
+			Amount:    types.Money(i),
+			Category:  "auto",
+			Status:    types.PaymentStatusOK,
+		})
+	}
+
+	return NewService(storage)
+}
+
+var benchmarkDumpSizes = []int{1_000_000, 10_000_000}
+
+// largeDumps enables the largest dump benchmarks, which need several
+// gigabytes of memory.
+var largeDumps = flag.Bool("large-dumps", false, "run the dump benchmarks with 10M payments")
+
+func benchmarkDumpSizesRun(b *testing.B, run func(b *testing.B, svc *Service)) {
+	for _, payments := range benchmarkDumpSizes {
+		b.Run(fmt.Sprintf("payments=%d", payments), func(b *testing.B) {
+			if payments > 1_000_000 && (testing.Short() || !*largeDumps) {
+				b.Skip("skipping the largest dump without -large-dumps")
+			}
+
+			svc := newPaymentsService(b, payments)
+			b.ReportAllocs()
+			b.ResetTimer()
+			run(b, svc)
+		})
+	}
+}
+
+func BenchmarkService_ExportBinary(b *testing.B) {
+	benchmarkDumpSizesRun(b, func(b *testing.B, svc *Service) {
+		for i := 0; i < b.N; i++ {
+			err := svc.ExportBinary(io.Discard)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkService_ExportText(b *testing.B) {
+	benchmarkDumpSizesRun(b, func(b *testing.B, svc *Service) {
+		for i := 0; i < b.N; i++ {
+			state, err := svc.snapshot()
+			if err != nil {
+				b.Fatal(err)
+			}
+			_, err = writeAccounts(io.Discard, state.Accounts)
+			if err == nil {
+				_, err = writePayments(io.Discard, state.Payments)
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkService_ImportBinary(b *testing.B) {
+	benchmarkDumpSizesRun(b, func(b *testing.B, svc *Service) {
+		path := filepath.Join(b.TempDir(), "wallet.bin")
+		file, err := os.Create(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = svc.ExportBinary(file)
+		file.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			file, err := os.Open(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = NewService(NewMemoryStorage()).ImportBinary(file)
+			file.Close()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkService_ImportText(b *testing.B) {
+	benchmarkDumpSizesRun(b, func(b *testing.B, svc *Service) {
+		dir := b.TempDir()
+		err := svc.Export(dir)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			err := NewService(NewMemoryStorage()).Import(dir)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
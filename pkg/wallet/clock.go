@@ -0,0 +1,33 @@
+package wallet
+
+import "time"
+
+// Clock tells the service the time of payments.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// WithClock makes the service take payment times from clock instead of the
+// system clock.
+func WithClock(clock Clock) Option {
+	return func(s *Service) {
+		s.clock = clock
+	}
+}
+
+// now returns the current time in UTC, without a monotonic reading, so it
+// compares equal to itself once written out and read back.
+func (s *Service) now() time.Time {
+	clock := s.clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+
+	return clock.Now().UTC()
+}
@@ -0,0 +1,423 @@
+package wallet
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+var ErrNoKeys = errors.New("file is encrypted, but no keys were given")
+var ErrUnknownKey = errors.New("unknown key")
+var ErrDecrypt = errors.New("can't decrypt file")
+var ErrNotEncrypted = errors.New("file is not encrypted")
+
+// KeyProvider supplies the keys of encrypted files. Keys are 16, 24 or 32
+// bytes long, selecting AES-128, AES-192 or AES-256, and are known by IDs
+// written in the header of every file, so that the current key can be
+// rotated while files encrypted with older ones stay readable.
+type KeyProvider interface {
+	// CurrentKey returns the key new files are encrypted with and its ID.
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the given ID, or an error wrapping
+	// ErrUnknownKey.
+	Key(id string) ([]byte, error)
+}
+
+// KeyRing is a KeyProvider holding its keys in memory.
+type KeyRing struct {
+	// Current is the ID of the key new files are encrypted with.
+	Current string
+	Keys    map[string][]byte
+}
+
+func (k *KeyRing) CurrentKey() (string, []byte, error) {
+	key, err := k.Key(k.Current)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return k.Current, key, nil
+}
+
+func (k *KeyRing) Key(id string) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+
+	return key, nil
+}
+
+// WithEncryption makes the service encrypt every dump and history file it
+// writes with the current key of keys, and read back only files encrypted
+// with any key keys knows. Files that aren't encrypted fail with
+// ErrNotEncrypted unless AllowPlaintext is given too.
+//
+// The state file and operation log of a FileStorage are not encrypted:
+// keep their directory private.
+func WithEncryption(keys KeyProvider) Option {
+	return func(s *Service) {
+		s.keys = keys
+	}
+}
+
+// AllowPlaintext lets a service WithEncryption read files that aren't
+// encrypted, such as dumps written before encryption was turned on.
+func AllowPlaintext() Option {
+	return func(s *Service) {
+		s.plaintext = true
+	}
+}
+
+// An encrypted file starts with a header:
+//
+//	magic "WLTE", version byte, key ID length byte, key ID,
+//	12 byte nonce, data key sealed by the key with that ID
+//
+// followed by the data sealed with AES-GCM in chunks of encryptedChunkSize
+// bytes, each of which takes encryptedOverhead more. Every file has its own
+// random data key, so chunk nonces can simply count chunks; the first nonce
+// byte is set on the last chunk, so a file cut at a chunk boundary doesn't
+// decrypt. The header is authenticated along with every chunk.
+const (
+	encryptedMagic     = "WLTE"
+	encryptedVersion   = 1
+	encryptedChunkSize = 64 << 10
+	encryptedOverhead  = 16
+	encryptedKeySize   = 32
+)
+
+// newGCM returns AES-GCM keyed with key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of the chunk with the given number.
+func chunkNonce(nonce []byte, chunk uint64, last bool) []byte {
+	for i := range nonce {
+		nonce[i] = 0
+	}
+	if last {
+		nonce[0] = 1
+	}
+	binary.BigEndian.PutUint64(nonce[4:], chunk)
+	return nonce
+}
+
+// EncryptWriter returns a writer encrypting what is written to it into w with
+// the current key of keys. The file is only complete once the writer is
+// closed; closing doesn't close w.
+func EncryptWriter(w io.Writer, keys KeyProvider) (io.WriteCloser, error) {
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	if len(id) > 255 {
+		return nil, fmt.Errorf("key id %q is longer than 255 bytes", id)
+	}
+	keyAEAD, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey := make([]byte, encryptedKeySize)
+	nonce := make([]byte, keyAEAD.NonceSize())
+	_, err = io.ReadFull(rand.Reader, dataKey)
+	if err == nil {
+		_, err = io.ReadFull(rand.Reader, nonce)
+	}
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append([]byte(encryptedMagic), encryptedVersion, byte(len(id)))
+	header = append(header, id...)
+	sealed := keyAEAD.Seal(nil, nonce, dataKey, header)
+	header = append(header, nonce...)
+	header = append(header, sealed...)
+
+	_, err = w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		nonce:  make([]byte, aead.NonceSize()),
+		buf:    make([]byte, 0, encryptedChunkSize+encryptedOverhead),
+	}, nil
+}
+
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+	// buf holds the plaintext of the chunk being filled.
+	buf   []byte
+	chunk uint64
+	err   error
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for e.err == nil && len(p) > 0 {
+		// A full chunk is only sealed once more data follows it, as the last
+		// chunk is sealed differently.
+		if len(e.buf) == encryptedChunkSize {
+			e.seal(false)
+			continue
+		}
+
+		n := copy(e.buf[len(e.buf):encryptedChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, e.err
+}
+
+func (e *encryptWriter) seal(last bool) {
+	sealed := e.aead.Seal(e.buf[:0], chunkNonce(e.nonce, e.chunk, last), e.buf, e.header)
+	_, e.err = e.w.Write(sealed)
+	e.buf = e.buf[:0]
+	e.chunk++
+}
+
+// Close seals the last chunk.
+func (e *encryptWriter) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+
+	e.seal(true)
+	if e.err != nil {
+		return e.err
+	}
+
+	e.err = errors.New("encrypted file already closed")
+	return nil
+}
+
+// DecryptReader returns a reader of the data encrypted into r by
+// EncryptWriter, with a key from keys. It returns an error wrapping
+// ErrDecrypt once it meets data that is not authentic, or a file cut short.
+func DecryptReader(r io.Reader, keys KeyProvider) (io.Reader, error) {
+	reader := bufio.NewReaderSize(r, encryptedChunkSize+encryptedOverhead)
+
+	prefix := make([]byte, len(encryptedMagic)+2)
+	_, err := io.ReadFull(reader, prefix)
+	if err != nil || string(prefix[:len(encryptedMagic)]) != encryptedMagic {
+		return nil, fmt.Errorf("%w: not an encrypted file", ErrDecrypt)
+	}
+	if prefix[len(encryptedMagic)] != encryptedVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrDecrypt, prefix[len(encryptedMagic)])
+	}
+
+	id := make([]byte, prefix[len(encryptedMagic)+1])
+	_, err = io.ReadFull(reader, id)
+	if err != nil {
+		return nil, fmt.Errorf("%w: header cut short", ErrDecrypt)
+	}
+	if keys == nil {
+		return nil, ErrNoKeys
+	}
+	key, err := keys.Key(string(id))
+	if err != nil {
+		return nil, err
+	}
+	keyAEAD, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, keyAEAD.NonceSize())
+	sealed := make([]byte, encryptedKeySize+keyAEAD.Overhead())
+	_, err = io.ReadFull(reader, nonce)
+	if err == nil {
+		_, err = io.ReadFull(reader, sealed)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: header cut short", ErrDecrypt)
+	}
+
+	aad := append(append([]byte(nil), prefix...), id...)
+	dataKey, err := keyAEAD.Open(nil, nonce, sealed, aad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %q doesn't open the data key", ErrDecrypt, id)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		r:      reader,
+		aead:   aead,
+		header: append(append(aad, nonce...), sealed...),
+		nonce:  make([]byte, aead.NonceSize()),
+		buf:    make([]byte, encryptedChunkSize+encryptedOverhead),
+	}, nil
+}
+
+type decryptReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+	buf    []byte
+	// plain is the decrypted part of the current chunk not read yet.
+	plain []byte
+	chunk uint64
+	done  bool
+	err   error
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+		d.open()
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk.
+func (d *decryptReader) open() {
+	n, err := io.ReadFull(d.r, d.buf)
+	last := err == io.ErrUnexpectedEOF || err == io.EOF
+	if err == nil {
+		_, peekErr := d.r.Peek(1)
+		last = peekErr == io.EOF
+	} else if !last {
+		d.err = err
+		return
+	}
+
+	plain, err := d.aead.Open(d.buf[:0], chunkNonce(d.nonce, d.chunk, last), d.buf[:n], d.header)
+	if err != nil {
+		d.err = fmt.Errorf("%w: chunk %d is damaged or the file is cut short", ErrDecrypt, d.chunk)
+		return
+	}
+
+	d.plain = plain
+	d.chunk++
+	d.done = last
+}
+
+// create creates a file for writing, which encrypts what is written to it if
+// the service has keys.
+func (s *Service) create(path string) (io.WriteCloser, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if s.keys == nil {
+		return file, nil
+	}
+
+	encrypted, err := EncryptWriter(file, s.keys)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &encryptedFile{WriteCloser: encrypted, file: file}, nil
+}
+
+// encryptedFile closes the encrypting writer, then the file under it.
+type encryptedFile struct {
+	io.WriteCloser
+	file *os.File
+}
+
+func (f *encryptedFile) Close() error {
+	err := f.WriteCloser.Close()
+	closeErr := f.file.Close()
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
+
+// openFile opens a file for reading, decrypting it with keys if it is
+// encrypted. With keys, a file that isn't encrypted is only read if
+// plaintext is set.
+func openFile(path string, keys KeyProvider, plaintext bool) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(file)
+	magic, err := reader.Peek(len(encryptedMagic))
+	if (err != nil || string(magic) != encryptedMagic) && keys != nil && !plaintext {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, ErrNotEncrypted)
+	}
+	if err != nil || string(magic) != encryptedMagic {
+		return &readFile{Reader: reader, file: file}, nil
+	}
+
+	decrypted, err := DecryptReader(reader, keys)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return &readFile{Reader: decrypted, file: file}, nil
+}
+
+// readFile closes the file under a reader.
+type readFile struct {
+	io.Reader
+	file *os.File
+}
+
+func (f *readFile) Close() error {
+	return f.file.Close()
+}
+
+// readFileContent reads a whole file like openFile.
+func readFileContent(path string, keys KeyProvider, plaintext bool) ([]byte, error) {
+	file, err := openFile(path, keys, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		err := file.Close()
+		if err != nil {
+			log.Print(err)
+		}
+	}()
+
+	return io.ReadAll(file)
+}
@@ -0,0 +1,298 @@
+package wallet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestKeyRing() *KeyRing {
+	return &KeyRing{
+		Current: "2021-01",
+		Keys: map[string][]byte{
+			"2021-01": bytes.Repeat([]byte{1}, 32),
+		},
+	}
+}
+
+// encryptedFiles returns the contents of the files under dir.
+func encryptedFiles(t *testing.T, dir string) map[string][]byte {
+	t.Helper()
+
+	files := map[string][]byte{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || info.Name() == manifestName {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		files[path] = content
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return files
+}
+
+func TestService_Export_encrypted(t *testing.T) {
+	keys := newTestKeyRing()
+	s := newExportedService(t)
+	WithEncryption(keys)(s.Service)
+	want, _ := s.snapshot()
+
+	dumpDir, csvDir := t.TempDir(), t.TempDir()
+	err := s.Export(dumpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.ExportCSV(csvDir, CSVOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []string{dumpDir, csvDir} {
+		for path, content := range encryptedFiles(t, dir) {
+			if !bytes.HasPrefix(content, []byte(encryptedMagic)) || bytes.Contains(content, []byte(defaultTestAccount.phone)) {
+				t.Errorf("Export(): %s is not encrypted", path)
+			}
+		}
+	}
+
+	imported := newTestService()
+	WithEncryption(keys)(imported.Service)
+	err = imported.Import(dumpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := imported.snapshot()
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("Import(): state doesn't match the exported one")
+	}
+
+	imported = newTestService()
+	WithEncryption(keys)(imported.Service)
+	_, err = imported.ImportCSV(csvDir, CSVOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = imported.snapshot()
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("ImportCSV(): state doesn't match the exported one")
+	}
+
+	err = newTestService().Import(dumpDir)
+	if !errors.Is(err, ErrNoKeys) {
+		t.Errorf("Import(): must return ErrNoKeys without keys, returned %v", err)
+	}
+}
+
+func TestService_Import_plaintext(t *testing.T) {
+	dir := t.TempDir()
+	s := newExportedService(t)
+	err := s.Export(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported := newTestService()
+	WithEncryption(newTestKeyRing())(imported.Service)
+	err = imported.Import(dir)
+	if !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("Import(): must return ErrNotEncrypted with keys, returned %v", err)
+	}
+
+	AllowPlaintext()(imported.Service)
+	err = imported.Import(dir)
+	if err != nil {
+		t.Errorf("Import(): must read plaintext files once allowed, error = %v", err)
+	}
+}
+
+func TestService_ExportToFile_rotatedKeys(t *testing.T) {
+	dir := t.TempDir()
+	keys := newTestKeyRing()
+	s := newExportedService(t)
+	WithEncryption(keys)(s.Service)
+	want, _ := s.snapshot()
+
+	oldPath := filepath.Join(dir, "old.txt")
+	err := s.ExportToFile(oldPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys.Keys["2021-02"] = bytes.Repeat([]byte{2}, 16)
+	keys.Current = "2021-02"
+	newPath := filepath.Join(dir, "new.txt")
+	err = s.ExportToFile(newPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{oldPath, newPath} {
+		imported := newTestService()
+		WithEncryption(keys)(imported.Service)
+		err = imported.ImportFromFile(path)
+		if err != nil {
+			t.Fatalf("ImportFromFile(%s): error = %v", filepath.Base(path), err)
+		}
+
+		got, _ := imported.snapshot()
+		if !reflect.DeepEqual(want.Accounts, got.Accounts) {
+			t.Errorf("ImportFromFile(%s): accounts don't match the exported ones", filepath.Base(path))
+		}
+	}
+
+	delete(keys.Keys, "2021-01")
+	err = newTestService().ImportFromFile(oldPath)
+	if !errors.Is(err, ErrNoKeys) {
+		t.Errorf("ImportFromFile(): must return ErrNoKeys without keys, returned %v", err)
+	}
+	imported := newTestService()
+	WithEncryption(keys)(imported.Service)
+	err = imported.ImportFromFile(oldPath)
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("ImportFromFile(): must return ErrUnknownKey for a retired key, returned %v", err)
+	}
+}
+
+func TestEncryptWriter_roundTrip(t *testing.T) {
+	keys := newTestKeyRing()
+	sizes := []int{0, 1, encryptedChunkSize - 1, encryptedChunkSize, encryptedChunkSize + 1, 3*encryptedChunkSize + 100}
+
+	for _, size := range sizes {
+		plain := bytes.Repeat([]byte("wallet"), size/6+1)[:size]
+		buf := &bytes.Buffer{}
+		writer, err := EncryptWriter(buf, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Odd write sizes cross chunk boundaries at every offset.
+		for rest := plain; len(rest) > 0; {
+			n := 1000
+			if n > len(rest) {
+				n = len(rest)
+			}
+			_, err = writer.Write(rest[:n])
+			if err != nil {
+				t.Fatal(err)
+			}
+			rest = rest[n:]
+		}
+		err = writer.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reader, err := DecryptReader(bytes.NewReader(buf.Bytes()), keys)
+		if err != nil {
+			t.Fatalf("DecryptReader(%d bytes): error = %v", size, err)
+		}
+		got, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("DecryptReader(%d bytes): error = %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("DecryptReader(%d bytes): got %d other bytes", size, len(got))
+		}
+	}
+}
+
+func TestDecryptReader_damaged(t *testing.T) {
+	keys := newTestKeyRing()
+	buf := &bytes.Buffer{}
+	writer, err := EncryptWriter(buf, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = writer.Write(bytes.Repeat([]byte{'w'}, 2*encryptedChunkSize))
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := buf.Bytes()
+	header := len(encrypted) - 2*encryptedChunkSize - 2*encryptedOverhead - encryptedOverhead
+
+	damaged := map[string][]byte{
+		"cut in the header":       encrypted[:header-1],
+		"cut after the header":    encrypted[:header],
+		"cut at a chunk boundary": encrypted[:header+encryptedChunkSize+encryptedOverhead],
+		"cut in the last chunk":   encrypted[:len(encrypted)-1],
+		"trailing data":           append(append([]byte(nil), encrypted...), 0),
+	}
+	for _, i := range []int{len(encryptedMagic) + 2 + len(keys.Current), header - 1, header, header + encryptedChunkSize + encryptedOverhead, len(encrypted) - 1} {
+		flipped := append([]byte(nil), encrypted...)
+		flipped[i] ^= 0x40
+		damaged[fmt.Sprintf("flipped at %d", i)] = flipped
+	}
+
+	for name, content := range damaged {
+		reader, err := DecryptReader(bytes.NewReader(content), keys)
+		if err == nil {
+			_, err = io.ReadAll(reader)
+		}
+		if !errors.Is(err, ErrDecrypt) {
+			t.Errorf("DecryptReader(%s): must return ErrDecrypt, returned %v", name, err)
+		}
+	}
+}
+
+func TestService_Import_encryptedTampered(t *testing.T) {
+	keys := newTestKeyRing()
+	s := newExportedService(t)
+	WithEncryption(keys)(s.Service)
+	exported := t.TempDir()
+	err := s.ExportCSV(exported, CSVOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "export.txt")
+	err = s.ExportToFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Files without a manifest are only checked by decryption.
+	dir := t.TempDir()
+	for name, content := range encryptedFiles(t, exported) {
+		if strings.HasSuffix(name, accountsCSVName) {
+			content[len(content)-1] ^= 1
+		}
+		err := os.WriteFile(filepath.Join(dir, filepath.Base(name)), content, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, content[:len(content)-1], 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported := newTestService()
+	WithEncryption(keys)(imported.Service)
+	_, err = imported.ImportCSV(dir, CSVOptions{})
+	if !errors.Is(err, ErrDecrypt) {
+		t.Errorf("ImportCSV(): must return ErrDecrypt, returned %v", err)
+	}
+	err = imported.ImportFromFile(path)
+	if !errors.Is(err, ErrDecrypt) {
+		t.Errorf("ImportFromFile(): must return ErrDecrypt, returned %v", err)
+	}
+	_, err = imported.FindAccountByID(1)
+	if err != ErrAccountNotFound {
+		t.Errorf("ImportFromFile(): must not store anything from a damaged file")
+	}
+}
@@ -0,0 +1,241 @@
+package wallet
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrMissingColumn = errors.New("missing column")
+
+const (
+	accountsCSVName  = "accounts.csv"
+	paymentsCSVName  = "payments.csv"
+	favoritesCSVName = "favorites.csv"
+)
+
+// optionalCSVColumns may be left out of files written by other systems.
+var optionalCSVColumns = map[string]bool{
+	"created_at": true,
+	"updated_at": true,
+	"settled_at": true,
+	"refunded":   true,
+	"direction":  true,
+	"linked_id":  true,
+	"currency":   true,
+}
+
+// CSVOptions controls the files of ExportCSV and ImportCSV.
+type CSVOptions struct {
+	ImportOptions
+	// Comma is the field delimiter; zero means ','.
+	Comma rune
+	// Columns maps standard column names to the header names used in the
+	// files, for files written by other systems. A name qualified with the
+	// file kind, as in "payments.id", takes precedence over a plain "id".
+	// Unmapped columns keep their standard names.
+	Columns map[string]string
+}
+
+func (o CSVOptions) comma() rune {
+	if o.Comma == 0 {
+		return ','
+	}
+	return o.Comma
+}
+
+// column returns the header name of a standard column in files of the kind
+// accounts, payments or favorites.
+func (o CSVOptions) column(kind string, column string) string {
+	if name, ok := o.Columns[kind+"."+column]; ok {
+		return name
+	}
+	if name, ok := o.Columns[column]; ok {
+		return name
+	}
+	return column
+}
+
+// ExportCSV writes accounts.csv, payments.csv and favorites.csv of one
+// snapshot as a new generation in dir, published the way Export publishes
+// dumps. The files follow RFC 4180: a header row, CRLF line endings, and
+// fields holding the delimiter, quotes or line breaks quoted. As readers
+// treat CRLF and LF alike, a CRLF inside a field is read back as LF.
+func (s *Service) ExportCSV(dir string, options CSVOptions) error {
+	state, err := s.snapshot()
+	if err != nil {
+		return err
+	}
+
+	return exportGeneration(dir, 0, s.keys, []generationFile{
+		{accountsCSVName, func(w io.Writer) (int, error) {
+			return writeCSV(w, options, "accounts", accountColumns, len(state.Accounts), func(i int) []string {
+				return accountFields(state.Accounts[i])
+			})
+		}},
+		{paymentsCSVName, func(w io.Writer) (int, error) {
+			return writeCSV(w, options, "payments", paymentColumns, len(state.Payments), func(i int) []string {
+				return paymentFields(state.Payments[i])
+			})
+		}},
+		{favoritesCSVName, func(w io.Writer) (int, error) {
+			return writeCSV(w, options, "favorites", favoriteColumns, len(state.Favorites), func(i int) []string {
+				return favoriteFields(state.Favorites[i])
+			})
+		}},
+	})
+}
+
+// writeCSV writes the header and the given number of records.
+func writeCSV(w io.Writer, options CSVOptions, kind string, columns []string, records int, record func(i int) []string) (int, error) {
+	writer := csv.NewWriter(w)
+	writer.Comma = options.comma()
+	writer.UseCRLF = true
+
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = options.column(kind, column)
+	}
+	err := writer.Write(header)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < records; i++ {
+		err := writer.Write(record(i))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	writer.Flush()
+	return records, writer.Error()
+}
+
+// ImportCSV loads the CSV files published in dir by ExportCSV, or written
+// there by another system. Columns are found by their header names, in any
+// order, and columns the import doesn't know are ignored; favorites.csv, the
+// payment time columns and the currency columns are optional, records
+// without a currency being in DefaultCurrency. Rows are checked and
+// reconciled with the existing records as in ImportWithOptions, following
+// options.ImportOptions.
+func (s *Service) ImportCSV(dir string, options CSVOptions) (*ImportReport, error) {
+	base, _, err := dumpDir(dir, accountsCSVName, paymentsCSVName, favoritesCSVName)
+	if err != nil {
+		return nil, err
+	}
+
+	dump := &parsedDump{keys: s.keys, plaintext: s.plaintext}
+	err = dump.parseCSVFile(filepath.Join(base, accountsCSVName), true, options, "accounts", accountColumns, dump.parseAccount)
+	if err != nil {
+		return nil, err
+	}
+	err = dump.parseCSVFile(filepath.Join(base, paymentsCSVName), true, options, "payments", paymentColumns, dump.parsePayment)
+	if err != nil {
+		return nil, err
+	}
+	err = dump.parseCSVFile(filepath.Join(base, favoritesCSVName), false, options, "favorites", favoriteColumns, dump.parseFavorite)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.importDump(dump, options.ImportOptions)
+}
+
+// parseCSVFile reads the records of a CSV file, picks the standard columns
+// out of them in order and passes the rows to parse. A missing file is only
+// an error if it is required.
+func (d *parsedDump) parseCSVFile(path string, required bool, options CSVOptions, kind string, columns []string, parse func(row *dumpRow) []*ImportError) error {
+	file, err := openFile(path, d.keys, d.plaintext)
+	if os.IsNotExist(err) && !required {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		err := file.Close()
+		if err != nil {
+			log.Print(err)
+		}
+	}()
+
+	name := filepath.Base(path)
+	reader := csv.NewReader(file)
+	reader.Comma = options.comma()
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil && !isCSVParseError(err) {
+		return err
+	}
+	if err != nil {
+		d.errs = append(d.errs, &ImportError{File: name, Line: 1, Column: 1, Err: fmt.Errorf("%w: %v", ErrInvalidRow, err)})
+		return nil
+	}
+
+	// Spreadsheets often start the file with a byte order mark.
+	header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	wanted := make([]string, len(columns))
+	for i, column := range columns {
+		wanted[i] = options.column(kind, column)
+	}
+	positions, _ := columnPositions(header, wanted)
+	missing := false
+	for i, position := range positions {
+		if position < 0 && !optionalCSVColumns[columns[i]] {
+			d.errs = append(d.errs, &ImportError{File: name, Line: 1, Column: 1, Err: fmt.Errorf("%w: %s", ErrMissingColumn, wanted[i])})
+			missing = true
+		}
+	}
+	if missing {
+		return nil
+	}
+
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil && !isCSVParseError(err) {
+			return err
+		}
+		if err != nil {
+			// A broken quote leaves the rest of the file unreadable.
+			d.errs = append(d.errs, &ImportError{File: name, Line: line, Column: 1, Err: fmt.Errorf("%w: %v", ErrInvalidRow, err)})
+			return nil
+		}
+		if len(record) != len(header) {
+			d.errs = append(d.errs, &ImportError{File: name, Line: line, Column: 1, Err: fmt.Errorf("%w: %d fields, header has %d", ErrInvalidRow, len(record), len(header))})
+			continue
+		}
+
+		row := &dumpRow{file: name, line: line}
+		for _, position := range positions {
+			if position < 0 {
+				row.fields = append(row.fields, "")
+				row.columns = append(row.columns, 1)
+				continue
+			}
+			row.fields = append(row.fields, record[position])
+			row.columns = append(row.columns, position+1)
+		}
+		d.errs = append(d.errs, parse(row)...)
+	}
+}
+
+// isCSVParseError tells malformed CSV from a failure to read the file, such
+// as a damaged encrypted one.
+func isCSVParseError(err error) bool {
+	var parseErr *csv.ParseError
+	return errors.As(err, &parseErr)
+}
@@ -0,0 +1,153 @@
+package wallet
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/darkside1809/wallet/pkg/types"
+)
+
+func TestService_ExportCSV_roundTrip(t *testing.T) {
+	s := newExportedService(t)
+	_, err := s.FavoritePayment(s.allPayments()[0].ID, "osh; \"plov\",\nmanti")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := s.snapshot()
+
+	for _, comma := range []rune{0, ';', '\t'} {
+		dir := t.TempDir()
+		options := CSVOptions{Comma: comma}
+
+		err := s.ExportCSV(dir, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		imported := newTestService()
+		report, err := imported.ImportCSV(dir, options)
+		if err != nil {
+			t.Fatalf("ImportCSV(%q): error = %v", comma, err)
+		}
+		if report.Accounts != 1 || report.Payments != 1 || report.Favorites != 2 {
+			t.Errorf("ImportCSV(%q): wrong counts in report %+v", comma, report)
+		}
+
+		got, _ := imported.snapshot()
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("ImportCSV(%q): state doesn't match the exported one:\n got %+v\nwant %+v", comma, got, want)
+		}
+	}
+}
+
+func TestService_ExportCSV_header(t *testing.T) {
+	dir := t.TempDir()
+	s := newExportedService(t)
+
+	err := s.ExportCSV(dir, CSVOptions{Columns: map[string]string{"payments.id": "payment", "account_id": "account"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, manifest.Directory, paymentsCSVName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(string(content), "\r\n")
+	if lines[0] != "payment,account,amount,category,status,created_at,updated_at,settled_at,refunded,direction,linked_id,currency" {
+		t.Errorf("ExportCSV(): wrong header %q", lines[0])
+	}
+	if len(lines) != 3 || lines[2] != "" {
+		t.Errorf("ExportCSV(): must write one CRLF terminated row per payment, got %q", content)
+	}
+}
+
+func TestService_ImportCSV_columns(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		accountsCSVName: "\ufeffPhone;Customer;Note;Balance\r\n" +
+			"+992000000001;7;\"vip; since 2019\";100\r\n",
+		paymentsCSVName: "Reference;Customer;Sum;Category;State\r\n" +
+			"p1;7;10;auto;OK\r\n",
+	}
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := newTestService()
+	_, err := s.ImportCSV(dir, CSVOptions{
+		Comma: ';',
+		Columns: map[string]string{
+			"accounts.id": "Customer",
+			"payments.id": "Reference",
+			"account_id":  "Customer",
+			"amount":      "Sum",
+			"status":      "State",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, err := s.FindAccountByID(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *account != (types.Account{ID: 7, Phone: "+992000000001", Currency: types.DefaultCurrency, Balance: 100, Available: 100}) {
+		t.Errorf("ImportCSV(): wrong account %+v", account)
+	}
+	payment, err := s.FindPaymentByID("p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *payment != (types.Payment{ID: "p1", AccountID: 7, Amount: 10, Currency: types.DefaultCurrency, Category: "auto", Status: types.PaymentStatusOK, Direction: types.PaymentDirectionOut}) {
+		t.Errorf("ImportCSV(): wrong payment %+v", payment)
+	}
+}
+
+func TestService_ImportCSV_fail(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		accountsCSVName: "id,phone\r\n" +
+			"1,+992000000001\r\n",
+		paymentsCSVName: "id,account_id,amount,category,status\r\n" +
+			"p1,1,10,auto\r\n" +
+			"p2,1,x,auto,OK\r\n" +
+			"p3,1,10,\"auto,OK\r\n",
+	}
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := newTestService()
+	_, err := s.ImportCSV(dir, CSVOptions{})
+
+	var errs ImportErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("ImportCSV(): must return ImportErrors, returned %v", err)
+	}
+	want := []importProblem{
+		{accountsCSVName, 1, 1, ErrMissingColumn},
+		{paymentsCSVName, 2, 1, ErrInvalidRow},
+		{paymentsCSVName, 3, 3, ErrInvalidField},
+		{paymentsCSVName, 4, 1, ErrInvalidRow},
+	}
+	if got := problems(errs); !reflect.DeepEqual(got, want) {
+		t.Errorf("ImportCSV(): wrong problems reported:\n got %v\nwant %v", got, want)
+	}
+}
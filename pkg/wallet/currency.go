@@ -0,0 +1,86 @@
+package wallet
+
+import (
+	"fmt"
+
+	"github.com/darkside1809/wallet/pkg/types"
+)
+
+// ErrCurrencyMismatch is returned when money in one currency would be added
+// to or taken from money in another.
+var ErrCurrencyMismatch = types.ErrCurrencyMismatch
+
+// validateCurrency checks that a currency looks like an ISO 4217 code: three
+// upper case letters.
+func validateCurrency(currency types.Currency) error {
+	valid := len(currency) == 3
+	for _, c := range currency {
+		valid = valid && c >= 'A' && c <= 'Z'
+	}
+	if !valid {
+		return fmt.Errorf("%w: currency %q is not an ISO 4217 code", ErrInvalidField, currency)
+	}
+
+	return nil
+}
+
+// currencyOrDefault returns the currency, or DefaultCurrency for records
+// written before accounts had one.
+func currencyOrDefault(currency types.Currency) types.Currency {
+	if currency == "" {
+		return types.DefaultCurrency
+	}
+	return currency
+}
+
+// balanceAmount returns the balance of an account in its currency.
+func balanceAmount(account *types.Account) types.Amount {
+	return types.Amount{Value: account.Balance, Currency: account.Currency}
+}
+
+// credit adds the amount to the balance of an account. It fails with
+// ErrCurrencyMismatch, changing nothing, if the amount is in another
+// currency than the account.
+func credit(account *types.Account, amount types.Amount) error {
+	balance, err := balanceAmount(account).Add(amount)
+	if err != nil {
+		return fmt.Errorf("account %d: %w", account.ID, err)
+	}
+
+	account.Balance = balance.Value
+	return nil
+}
+
+// debit takes the amount out of the balance of an account, with the checks
+// of credit. Whether the account can cover it is up to the caller.
+func debit(account *types.Account, amount types.Amount) error {
+	balance, err := balanceAmount(account).Sub(amount)
+	if err != nil {
+		return fmt.Errorf("account %d: %w", account.ID, err)
+	}
+
+	account.Balance = balance.Value
+	return nil
+}
+
+// FindAccountByPhone returns the account registered with the phone in the
+// currency.
+func (s *Service) FindAccountByPhone(phone types.Phone, currency types.Currency) (*types.Account, error) {
+	var account *types.Account
+
+	err := s.store().View(func(tx Tx) error {
+		var err error
+		account, err = tx.Accounts().ByPhone(phone, currency)
+		if err != nil {
+			return err
+		}
+
+		account.Available = available(tx, account, s.now())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return account, nil
+}
@@ -0,0 +1,302 @@
+package wallet
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/darkside1809/wallet/pkg/types"
+)
+
+func TestAmount_mixedCurrencies(t *testing.T) {
+	tjs := types.Amount{Value: 10, Currency: types.CurrencyTJS}
+	usd := types.Amount{Value: 10, Currency: types.CurrencyUSD}
+
+	sum, err := tjs.Add(tjs)
+	if err != nil || sum != (types.Amount{Value: 20, Currency: types.CurrencyTJS}) {
+		t.Errorf("Add(): got %v, error = %v", sum, err)
+	}
+	_, err = tjs.Add(usd)
+	if !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("Add(): must return ErrCurrencyMismatch, returned %v", err)
+	}
+	_, err = usd.Sub(tjs)
+	if !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("Sub(): must return ErrCurrencyMismatch, returned %v", err)
+	}
+
+	account := &types.Account{ID: 1, Currency: types.CurrencyTJS, Balance: 100}
+	err = debit(account, usd)
+	if !errors.Is(err, ErrCurrencyMismatch) || account.Balance != 100 {
+		t.Errorf("debit(): must refuse USD from a TJS account, balance %d, error = %v", account.Balance, err)
+	}
+}
+
+func TestService_RegisterAccountIn(t *testing.T) {
+	s := newTestService()
+	tjs := s.mustAddAccount(t, testAccount{phone: "+992000000001", balance: 100})
+	usd := s.mustAddAccount(t, testAccount{phone: "+992000000001", currency: types.CurrencyUSD, balance: 50})
+
+	if tjs.Currency != types.DefaultCurrency || usd.Currency != types.CurrencyUSD || usd.ID == tjs.ID {
+		t.Errorf("RegisterAccountIn(): wrong accounts %+v and %+v", tjs, usd)
+	}
+	_, err := s.RegisterAccountIn("+992000000001", types.CurrencyUSD)
+	if err != ErrPhoneRegistered {
+		t.Errorf("RegisterAccountIn(): must return ErrPhoneRegistered, returned %v", err)
+	}
+	_, err = s.RegisterAccountIn("+992000000002", "usd")
+	if !errors.Is(err, ErrInvalidField) {
+		t.Errorf("RegisterAccountIn(): must return ErrInvalidField for a bad code, returned %v", err)
+	}
+
+	account, err := s.FindAccountByPhone("+992000000001", types.CurrencyUSD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.ID != usd.ID || account.Balance != 50 || account.Available != 50 {
+		t.Errorf("FindAccountByPhone(): wrong account %+v", account)
+	}
+	_, err = s.FindAccountByPhone("+992000000001", "EUR")
+	if err != ErrAccountNotFound {
+		t.Errorf("FindAccountByPhone(): must return ErrAccountNotFound, returned %v", err)
+	}
+}
+
+func TestService_Pay_currency(t *testing.T) {
+	s := newTestService()
+	tjs := s.mustAddAccount(t, testAccount{phone: "+992000000001", balance: 100})
+	usd := s.mustAddAccount(t, testAccount{phone: "+992000000001", currency: types.CurrencyUSD, balance: 50})
+
+	payment, err := s.Pay(usd.ID, 20, "travel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.Currency != types.CurrencyUSD {
+		t.Errorf("Pay(): payment must be in USD, got %q", payment.Currency)
+	}
+	favorite, err := s.FavoritePayment(payment.ID, "visa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if favorite.Currency != types.CurrencyUSD {
+		t.Errorf("FavoritePayment(): favorite must be in USD, got %q", favorite.Currency)
+	}
+	_, err = s.PayFromFavorite(favorite.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Reject(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBalances(t, s.Service, "Pay()", map[int64]testBalance{tjs.ID: {100, 100}, usd.ID: {30, 30}})
+
+	err = s.store().View(func(tx Tx) error {
+		if paid := tx.Ledger().Balance(CurrencyLedger(LedgerPayments, types.CurrencyUSD)); paid != 20 {
+			t.Errorf("Pay(): %s must hold 20, got %d", CurrencyLedger(LedgerPayments, types.CurrencyUSD), paid)
+		}
+		if paid := tx.Ledger().Balance(LedgerPayments); paid != 0 {
+			t.Errorf("Pay(): %s must hold 0, got %d", LedgerPayments, paid)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestService_SumPayments_currency(t *testing.T) {
+	s := newTestService()
+	tjs := s.mustAddAccount(t, testAccount{phone: "+992000000001", balance: 100})
+	usd := s.mustAddAccount(t, testAccount{phone: "+992000000001", currency: types.CurrencyUSD, balance: 50})
+	for _, account := range []*types.Account{tjs, usd, tjs} {
+		_, err := s.Pay(account.ID, 15, "auto")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[types.Currency]types.Money{types.CurrencyTJS: 30, types.CurrencyUSD: 15}
+	for _, goroutines := range []int{1, 2, 5} {
+		if got := s.SumPayments(goroutines); !reflect.DeepEqual(got, want) {
+			t.Errorf("SumPayments(%d): got %v, want %v", goroutines, got, want)
+		}
+	}
+	got := map[types.Currency]types.Money{}
+	for progress := range s.SumPaymentsWithProgress() {
+		got[progress.Currency] += progress.Result
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SumPaymentsWithProgress(): got %v, want %v", got, want)
+	}
+}
+
+func TestService_FilterPayments_currency(t *testing.T) {
+	s := newTestService()
+	s.mustAddAccount(t, testAccount{phone: "+992000000001", balance: 100})
+	usd := s.mustAddAccount(t, testAccount{phone: "+992000000001", currency: types.CurrencyUSD, balance: 50})
+	payment, err := s.Pay(usd.ID, 15, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filtered, err := s.FilterPayments(usd.ID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filtered) != 1 || !reflect.DeepEqual(filtered[0], *payment) {
+		t.Errorf("FilterPayments(): must return the whole payment %+v, got %+v", *payment, filtered)
+	}
+	filtered, err = s.FilterPaymentsByFn(func(p types.Payment) bool {
+		return p.Currency == types.CurrencyUSD
+	}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filtered) != 1 || !reflect.DeepEqual(filtered[0], *payment) {
+		t.Errorf("FilterPaymentsByFn(): must return the whole payment %+v, got %+v", *payment, filtered)
+	}
+}
+
+func TestService_Transfer_currency(t *testing.T) {
+	s := newTestService()
+	s.mustAddAccount(t, testAccount{phone: "+992000000001", balance: 100})
+	usd := s.mustAddAccount(t, testAccount{phone: "+992000000001", currency: types.CurrencyUSD, balance: 50})
+	recipient, err := s.RegisterAccount("+992000000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.Transfer(usd.ID, recipient.Phone, 10)
+	if err != ErrAccountNotFound {
+		t.Errorf("Transfer(): must not find a USD account of the recipient, error = %v", err)
+	}
+
+	recipientUSD, err := s.RegisterAccountIn(recipient.Phone, types.CurrencyUSD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := s.Transfer(usd.ID, recipient.Phone, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Currency != types.CurrencyUSD {
+		t.Errorf("Transfer(): payment must be in USD, got %q", out.Currency)
+	}
+	checkBalances(t, s.Service, "Transfer()", map[int64]testBalance{usd.ID: {40, 40}, recipient.ID: {0, 0}, recipientUSD.ID: {10, 10}})
+}
+
+func TestService_CheckLedger_currency(t *testing.T) {
+	s := newTestService()
+	tjs := s.mustAddAccount(t, testAccount{phone: "+992000000001", balance: 100})
+	s.mustAddAccount(t, testAccount{phone: "+992000000001", currency: types.CurrencyUSD, balance: 50})
+
+	err := s.store().Update(func(tx Tx) error {
+		return postTransfer(tx, types.LedgerKindDeposit, "", s.now(), CurrencyLedger(LedgerCash, types.CurrencyUSD), AccountLedger(tjs.ID), types.Amount{Value: 5, Currency: types.CurrencyUSD})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.CheckLedger()
+	if !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("CheckLedger(): must return ErrCurrencyMismatch, returned %v", err)
+	}
+}
+
+func TestService_ImportJSON_currencyMismatch(t *testing.T) {
+	s := NewService(nil)
+
+	err := s.ImportJSON(strings.NewReader(`{"accounts":[{"id":1,"phone":"+992000000001","currency":"TJS","balance":10}],
+"payments":[{"id":"p1","accountId":1,"amount":5,"currency":"USD","category":"auto","status":"OK"}]}`))
+	if !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("ImportJSON(): must return ErrCurrencyMismatch, returned %v", err)
+	}
+
+	err = s.ImportJSON(strings.NewReader(`{"accounts":[{"id":1,"phone":"+992000000001","balance":10}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := s.FindAccountByID(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Currency != types.DefaultCurrency {
+		t.Errorf("ImportJSON(): account without a currency must be in %s, got %q", types.DefaultCurrency, account.Currency)
+	}
+}
+
+func TestService_ImportFromFile_currency(t *testing.T) {
+	s := newTestService()
+	tjs := s.mustAddAccount(t, testAccount{phone: "+992000000001", balance: 100})
+	usd := s.mustAddAccount(t, testAccount{phone: "+992000000001", currency: types.CurrencyUSD, balance: 50})
+	path := filepath.Join(t.TempDir(), "export.txt")
+	err := s.ExportToFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported := NewService(nil)
+	err = imported.ImportFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := imported.FindAccountByPhone("+992000000001", types.CurrencyUSD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.ID != usd.ID || account.Balance != 50 {
+		t.Errorf("ImportFromFile(): wrong account %+v", account)
+	}
+	checkBalances(t, imported, "ImportFromFile()", map[int64]testBalance{tjs.ID: {100, 100}, usd.ID: {50, 50}})
+
+	err = os.WriteFile(path, []byte("2;+992000000001;70;EUR|"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = imported.ImportFromFile(path)
+	if !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("ImportFromFile(): must not change the currency of an account, error = %v", err)
+	}
+
+	err = os.WriteFile(path, []byte("3;+992000000003;70|"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = imported.ImportFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err = imported.FindAccountByID(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Currency != types.DefaultCurrency {
+		t.Errorf("ImportFromFile(): records without a currency must be in %s, got %q", types.DefaultCurrency, account.Currency)
+	}
+}
+
+func TestService_Import_currencyMismatch(t *testing.T) {
+	s := newTestService()
+	s.mustAddAccount(t, testAccount{phone: "+992000000001", balance: 100})
+	s.mustAddAccount(t, testAccount{phone: "+992000000001", currency: types.CurrencyUSD, balance: 50})
+	dir := t.TempDir()
+	err := s.Export(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := NewService(nil)
+	_, err = target.RegisterAccountIn("+992000000009", "EUR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = target.ImportWithOptions(dir, ImportOptions{Mode: ImportMergeOverwrite})
+	var errs ImportErrors
+	if !errors.As(err, &errs) || !errors.Is(errs[0], ErrCurrencyMismatch) {
+		t.Errorf("ImportWithOptions(): must refuse to match an account in another currency, error = %v", err)
+	}
+}
@@ -0,0 +1,471 @@
+package wallet
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/darkside1809/wallet/pkg/types"
+)
+
+var ErrIncompleteDump = errors.New("dump generation incomplete")
+var ErrDumpMismatch = errors.New("dump file doesn't match manifest")
+var ErrUnsupportedFormat = errors.New("unsupported dump format")
+
+const (
+	accountsDumpName  = "accounts.dump"
+	paymentsDumpName  = "payments.dump"
+	favoritesDumpName = "favorites.dump"
+	manifestName      = "manifest.json"
+)
+
+// The standard columns of dump and CSV files, in the order they are written.
+var (
+	accountColumns  = []string{"id", "phone", "balance", "currency"}
+	paymentColumns  = []string{"id", "account_id", "amount", "category", "status", "created_at", "updated_at", "settled_at", "refunded", "direction", "linked_id", "currency"}
+	favoriteColumns = []string{"id", "account_id", "name", "amount", "category", "currency"}
+)
+
+// dumpFormat is the version of the dump files Export writes.
+//
+// Version 1 files hold positional fields; since version 2 every file starts
+// with a header row naming its columns, since version 3 payments carry
+// their times, and since version 6 every record its currency. Dumps from
+// older versions are upgraded on import by dumpMigrations.
+const dumpFormat = 6
+
+// dumpManifest describes the published generation of an export. Export
+// replaces it atomically after the generation is on disk, so it always points
+// at a complete set of files from the same moment. Format is the dump format
+// version; manifests without one describe version 1 dumps.
+type dumpManifest struct {
+	Generation int64
+	Format     int `json:",omitempty"`
+	Directory  string
+	Files      []dumpFile
+}
+
+type dumpFile struct {
+	Name    string
+	Size    int64
+	SHA256  string
+	Records int
+}
+
+func generationName(generation int64) string {
+	return fmt.Sprintf("generation-%06d", generation)
+}
+
+// readManifest returns nil if dir has no manifest.
+func readManifest(dir string) (*dumpManifest, error) {
+	content, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &dumpManifest{}
+	err = json.Unmarshal(content, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDumpMismatch, err)
+	}
+
+	return manifest, nil
+}
+
+// exportLocks serializes the exports to each directory, so that they publish
+// their generations one after the other.
+var exportLocks = struct {
+	sync.Mutex
+	dirs map[string]*sync.Mutex
+}{dirs: make(map[string]*sync.Mutex)}
+
+// lockExportDir locks dir for an export and returns the function that
+// unlocks it.
+func lockExportDir(dir string) (func(), error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	exportLocks.Lock()
+	mu, ok := exportLocks.dirs[abs]
+	if !ok {
+		mu = &sync.Mutex{}
+		exportLocks.dirs[abs] = mu
+	}
+	exportLocks.Unlock()
+
+	mu.Lock()
+	return mu.Unlock, nil
+}
+
+// generationFile is one file of an export; write returns the number of
+// records it wrote.
+type generationFile struct {
+	name  string
+	write func(w io.Writer) (int, error)
+}
+
+// exportGeneration writes the files as a new generation of the given format
+// in dir. They are staged and synced first, and the generation is published
+// by atomically replacing the manifest, so a crash or an error leaves the
+// previous export intact. Exports to the same directory run one at a time.
+func exportGeneration(dir string, format int, keys KeyProvider, files []generationFile) error {
+	unlock, err := lockExportDir(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	previous, err := readManifest(dir)
+	if err != nil {
+		return err
+	}
+	manifest := &dumpManifest{Generation: 1, Format: format}
+	if previous != nil {
+		manifest.Generation = previous.Generation + 1
+	}
+	manifest.Directory = generationName(manifest.Generation)
+
+	staging, err := os.MkdirTemp(dir, ".staging-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	for _, file := range files {
+		written, err := writeDumpFile(filepath.Join(staging, file.name), keys, file.write)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, written)
+	}
+
+	return publishGeneration(dir, staging, manifest)
+}
+
+// writeDumpFile writes and syncs a dump file, encrypted if keys are given,
+// describing it for the manifest.
+func writeDumpFile(path string, keys KeyProvider, write func(w io.Writer) (int, error)) (dumpFile, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return dumpFile{}, err
+	}
+
+	hash := sha256.New()
+	counter := &countingWriter{}
+	records := 0
+
+	err = writeAndSync(file, func(w io.Writer) error {
+		var err error
+		counter.w = io.MultiWriter(w, hash)
+		if keys == nil {
+			records, err = write(counter)
+			return err
+		}
+
+		encrypted, err := EncryptWriter(counter, keys)
+		if err != nil {
+			return err
+		}
+		records, err = write(encrypted)
+		if err != nil {
+			return err
+		}
+		return encrypted.Close()
+	})
+	if err != nil {
+		return dumpFile{}, err
+	}
+
+	return dumpFile{
+		Name:    filepath.Base(path),
+		Size:    counter.n,
+		SHA256:  hex.EncodeToString(hash.Sum(nil)),
+		Records: records,
+	}, nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// publishGeneration moves a staged generation into dir and points the
+// manifest at it, then removes the generations older than it. Staging
+// directories of other exports are left alone.
+func publishGeneration(dir string, staging string, manifest *dumpManifest) error {
+	err := syncDir(staging)
+	if err != nil {
+		return err
+	}
+
+	target := filepath.Join(dir, manifest.Directory)
+	err = os.RemoveAll(target)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(staging, target)
+	if err != nil {
+		return err
+	}
+	err = syncDir(dir)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(filepath.Join(dir, manifestName), func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(manifest)
+	})
+	if err != nil {
+		return err
+	}
+
+	stale, err := filepath.Glob(filepath.Join(dir, "generation-*"))
+	if err != nil {
+		return err
+	}
+	for _, path := range stale {
+		var generation int64
+		_, err := fmt.Sscanf(filepath.Base(path), "generation-%d", &generation)
+		if err != nil || generation >= manifest.Generation {
+			continue
+		}
+		err = os.RemoveAll(path)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+
+	return nil
+}
+
+// dumpDir returns the directory holding the files published in dir and
+// their format, after checking every file against the manifest and that it
+// lists the given names. A directory without a manifest holds version 1
+// dumps written before generations existed, which are read as they are.
+func dumpDir(dir string, names ...string) (string, int, error) {
+	manifest, err := readManifest(dir)
+	if err != nil {
+		return "", 0, err
+	}
+	if manifest == nil {
+		return dir, 1, nil
+	}
+
+	base := filepath.Join(dir, manifest.Directory)
+	listed := map[string]bool{}
+	for _, expected := range manifest.Files {
+		listed[expected.Name] = true
+
+		err := verifyDumpFile(filepath.Join(base, expected.Name), expected)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+
+	for _, name := range names {
+		if !listed[name] {
+			return "", 0, fmt.Errorf("%w: manifest doesn't list %s", ErrIncompleteDump, name)
+		}
+	}
+
+	if manifest.Format == 0 {
+		return base, 1, nil
+	}
+	return base, manifest.Format, nil
+}
+
+func verifyDumpFile(path string, expected dumpFile) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s is missing", ErrIncompleteDump, path)
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+
+	if size != expected.Size || hex.EncodeToString(hash.Sum(nil)) != expected.SHA256 {
+		return fmt.Errorf("%w: %s", ErrDumpMismatch, path)
+	}
+
+	return nil
+}
+
+// writeDumpHeader writes the header row naming the columns of a dump file.
+func writeDumpHeader(w io.Writer, columns []string) error {
+	_, err := io.WriteString(w, strings.Join(columns, ";")+"\r\n")
+	return err
+}
+
+func writeAccounts(w io.Writer, accounts []*types.Account) (int, error) {
+	err := writeDumpHeader(w, accountColumns)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, account := range accounts {
+		_, err := io.WriteString(w, formatAccount(account))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(accounts), nil
+}
+
+func writePayments(w io.Writer, payments []*types.Payment) (int, error) {
+	err := writeDumpHeader(w, paymentColumns)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, payment := range payments {
+		_, err := io.WriteString(w, formatPayment(payment))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(payments), nil
+}
+
+func writeFavorites(w io.Writer, favorites []*types.Favorite) (int, error) {
+	err := writeDumpHeader(w, favoriteColumns)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, favorite := range favorites {
+		_, err := io.WriteString(w, formatFavorite(favorite))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(favorites), nil
+}
+
+// checkDumpFields makes sure no field of the records holds a separator of
+// the dump format, which would split the row where Import reads it back.
+func checkDumpFields(accounts []*types.Account, payments []*types.Payment, favorites []*types.Favorite) error {
+	for _, account := range accounts {
+		err := checkDumpRow("account", strconv.FormatInt(account.ID, 10), accountFields(account))
+		if err != nil {
+			return err
+		}
+	}
+	for _, payment := range payments {
+		err := checkDumpRow("payment", payment.ID, paymentFields(payment))
+		if err != nil {
+			return err
+		}
+	}
+	for _, favorite := range favorites {
+		err := checkDumpRow("favorite", favorite.ID, favoriteFields(favorite))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func checkDumpRow(kind string, id string, fields []string) error {
+	for _, field := range fields {
+		if strings.ContainsAny(field, ";\r\n") {
+			return fmt.Errorf("%w: %q of %s %s contains a separator", ErrInvalidField, field, kind, id)
+		}
+	}
+
+	return nil
+}
+
+func formatAccount(account *types.Account) string {
+	return strings.Join(accountFields(account), ";") + "\r\n"
+}
+
+func formatPayment(payment *types.Payment) string {
+	return strings.Join(paymentFields(payment), ";") + "\r\n"
+}
+
+func formatFavorite(favorite *types.Favorite) string {
+	return strings.Join(favoriteFields(favorite), ";") + "\r\n"
+}
+
+// accountFields returns the fields of an account in the order of the dump
+// and CSV columns; so do paymentFields and favoriteFields.
+func accountFields(account *types.Account) []string {
+	return []string{
+		strconv.FormatInt(account.ID, 10),
+		string(account.Phone),
+		strconv.FormatInt(int64(account.Balance), 10),
+		string(account.Currency),
+	}
+}
+
+func paymentFields(payment *types.Payment) []string {
+	return []string{
+		payment.ID,
+		strconv.FormatInt(payment.AccountID, 10),
+		strconv.FormatInt(int64(payment.Amount), 10),
+		string(payment.Category),
+		string(payment.Status),
+		formatTime(payment.CreatedAt),
+		formatTime(payment.UpdatedAt),
+		formatTime(payment.SettledAt),
+		strconv.FormatInt(int64(payment.Refunded), 10),
+		string(payment.Direction),
+		payment.LinkedID,
+		string(payment.Currency),
+	}
+}
+
+// formatTime writes a time in RFC 3339 with nanoseconds, or nothing for the
+// zero time.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func favoriteFields(favorite *types.Favorite) []string {
+	return []string{
+		favorite.ID,
+		strconv.FormatInt(favorite.AccountID, 10),
+		favorite.Name,
+		strconv.FormatInt(int64(favorite.Amount), 10),
+		string(favorite.Category),
+		string(favorite.Currency),
+	}
+}
@@ -0,0 +1,244 @@
+package wallet
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/darkside1809/wallet/pkg/types"
+)
+
+func newExportedService(t *testing.T) *testService {
+	t.Helper()
+
+	s := newTestService()
+	_, payments, err := s.addAccount(defaultTestAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.FavoritePayment(payments[0].ID, "osh")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestService_Export_roundTrip(t *testing.T) {
+	dir := t.TempDir()
+	s := newExportedService(t)
+
+	err := s.Export(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported := newTestService()
+	err = imported.Import(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, _ := s.snapshot()
+	got, _ := imported.snapshot()
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("Import(): state doesn't match the exported one")
+	}
+}
+
+func TestService_Export_separator(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"osh;plov", "osh\nplov", "osh\r"} {
+		s := newExportedService(t)
+		_, err := s.FavoritePayment(s.allPayments()[0].ID, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = s.Export(dir)
+		if !errors.Is(err, ErrInvalidField) {
+			t.Errorf("Export(): must refuse favorite %q, error = %v", name, err)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 0 {
+			t.Errorf("Export(): must not stage anything, got %d entries", len(entries))
+		}
+	}
+
+	err := newTestService().HistoryToFiles([]types.Payment{{ID: "p1", AccountID: 1, Amount: 1, Category: "a;b", Status: types.PaymentStatusOK}}, dir, 10)
+	if !errors.Is(err, ErrInvalidField) {
+		t.Errorf("HistoryToFiles(): must refuse a category with a separator, error = %v", err)
+	}
+}
+
+func TestService_Export_replacesGeneration(t *testing.T) {
+	dir := t.TempDir()
+	s := newExportedService(t)
+
+	for i := 0; i < 3; i++ {
+		err := s.Export(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manifest, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Generation != 3 {
+		t.Errorf("Export(): generation must be 3, got %v", manifest.Generation)
+	}
+
+	generations, err := filepath.Glob(filepath.Join(dir, "generation-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(generations, []string{filepath.Join(dir, manifest.Directory)}) {
+		t.Errorf("Export(): only the published generation must remain, got %v", generations)
+	}
+}
+
+func TestService_Export_concurrent(t *testing.T) {
+	dir := t.TempDir()
+	s := newExportedService(t)
+
+	// The staging directory of an export from another process.
+	other := filepath.Join(dir, ".staging-other")
+	err := os.Mkdir(other, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for round := 0; round < 10; round++ {
+		wg := sync.WaitGroup{}
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := s.Export(dir)
+				if err != nil {
+					t.Errorf("Export(): error = %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		imported := newTestService()
+		err = imported.Import(dir)
+		if err != nil {
+			t.Fatalf("Import(): round %d: error = %v", round, err)
+		}
+	}
+
+	manifest, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Generation != 40 {
+		t.Errorf("Export(): generation must be 40, got %v", manifest.Generation)
+	}
+	_, err = os.Stat(other)
+	if err != nil {
+		t.Errorf("Export(): must leave the staging directories of other exports, error = %v", err)
+	}
+}
+
+func TestService_Import_tamperedDump(t *testing.T) {
+	dir := t.TempDir()
+	s := newExportedService(t)
+
+	err := s.Export(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, manifest.Directory, paymentsDumpName)
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.WriteString("half-written;1;")
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported := newTestService()
+	err = imported.Import(dir)
+	if !errors.Is(err, ErrDumpMismatch) {
+		t.Errorf("Import(): must return ErrDumpMismatch, returned %v", err)
+	}
+	if state, _ := imported.snapshot(); len(state.Accounts) != 0 {
+		t.Errorf("Import(): must not load anything from a mismatched dump, got %v", state.Accounts)
+	}
+}
+
+func TestService_Import_incompleteDump(t *testing.T) {
+	dir := t.TempDir()
+	s := newExportedService(t)
+
+	err := s.Export(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(filepath.Join(dir, manifest.Directory, favoritesDumpName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = newTestService().Import(dir)
+	if !errors.Is(err, ErrIncompleteDump) {
+		t.Errorf("Import(): must return ErrIncompleteDump, returned %v", err)
+	}
+}
+
+func TestService_Import_unpublishedGeneration(t *testing.T) {
+	dir := t.TempDir()
+	s := newExportedService(t)
+
+	err := s.Export(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash between staging a generation and publishing the manifest
+	// leaves files that must not be read.
+	err = os.Mkdir(filepath.Join(dir, generationName(2)), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, generationName(2), accountsDumpName), []byte("7;+992000000007;1\r\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported := newTestService()
+	err = imported.Import(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = imported.FindAccountByID(7)
+	if err != ErrAccountNotFound {
+		t.Errorf("Import(): must not read an unpublished generation, error = %v", err)
+	}
+	_, err = imported.FindAccountByID(1)
+	if err != nil {
+		t.Errorf("Import(): must read the published generation, error = %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+package wallet
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const fileStorageName = "wallet.json"
+
+// defaultSnapshotEvery is the number of log records after which FileStorage
+// takes a snapshot by default.
+const defaultSnapshotEvery = 10_000
+
+// FileStorage is a Storage that serves reads from memory and survives
+// restarts. Every committed Update is appended to an operation log and synced
+// before the lock is released, so no one observes a change that isn't on disk
+// yet, and an acknowledged Update is never lost.
+//
+// The storage periodically writes a snapshot of the whole state to its state
+// file and drops the log behind it, so opening it only loads the snapshot and
+// replays the short tail of the log written since.
+//
+// The state file and the log are not encrypted, even under a service
+// WithEncryption, which only covers the files the service exports.
+type FileStorage struct {
+	memory *MemoryStorage
+	dir    string
+	log    *wal
+	closed bool
+
+	snapshotEvery int
+	// snapshotMu serializes snapshots; snapshotSeq is the sequence number of
+	// the last one and is guarded by memory.mu.
+	snapshotMu   sync.Mutex
+	snapshotSeq  uint64
+	snapshots    sync.WaitGroup
+	snapshotting bool
+}
+
+// FileStorageOption configures a FileStorage.
+type FileStorageOption func(s *FileStorage)
+
+// SnapshotEvery makes the storage snapshot after the given number of log
+// records; zero or less disables automatic snapshots.
+func SnapshotEvery(records int) FileStorageOption {
+	return func(s *FileStorage) {
+		s.snapshotEvery = records
+	}
+}
+
+// OpenFileStorage loads the state kept in dir, or starts empty if there is
+// none yet. The directory must exist.
+func OpenFileStorage(dir string, opts ...FileStorageOption) (*FileStorage, error) {
+	storage := &FileStorage{
+		memory:        NewMemoryStorage(),
+		dir:           dir,
+		snapshotEvery: defaultSnapshotEvery,
+	}
+	for _, opt := range opts {
+		opt(storage)
+	}
+
+	err := storage.loadState()
+	if err != nil {
+		return nil, err
+	}
+
+	storage.log, err = openWAL(dir, storage.snapshotSeq, storage.memory.state.apply)
+	if err != nil {
+		return nil, err
+	}
+
+	return storage, nil
+}
+
+func (s *FileStorage) loadState() error {
+	file, err := os.Open(filepath.Join(s.dir, fileStorageName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		err := file.Close()
+		if err != nil {
+			log.Print(err)
+		}
+	}()
+
+	state := &storageState{}
+	err = json.NewDecoder(bufio.NewReader(file)).Decode(state)
+	if err != nil {
+		return err
+	}
+
+	s.snapshotSeq = state.Seq
+	return s.memory.load(state)
+}
+
+func (s *FileStorage) View(fn func(tx Tx) error) error {
+	return s.memory.View(fn)
+}
+
+func (s *FileStorage) Update(fn func(tx Tx) error) error {
+	return s.memory.update(fn, func(tx *memoryTx) error {
+		if s.closed {
+			return ErrStorageClosed
+		}
+		if len(tx.changes) == 0 {
+			return nil
+		}
+
+		err := s.log.append(walOps(tx.changes))
+		if err != nil {
+			return err
+		}
+
+		s.maybeSnapshot()
+		return nil
+	})
+}
+
+// maybeSnapshot starts a snapshot in the background once the log has grown
+// enough since the last one. It must be called with memory.mu held.
+func (s *FileStorage) maybeSnapshot() {
+	if s.snapshotEvery <= 0 || s.snapshotting || s.log.seq-s.snapshotSeq < uint64(s.snapshotEvery) {
+		return
+	}
+
+	s.snapshotting = true
+	s.snapshots.Add(1)
+	go func() {
+		defer s.snapshots.Done()
+
+		err := s.Snapshot()
+		if err != nil {
+			log.Print(err)
+		}
+
+		s.memory.mu.Lock()
+		s.snapshotting = false
+		s.memory.mu.Unlock()
+	}()
+}
+
+// Snapshot writes the current state to the state file and removes the log
+// records it covers. Writers are only blocked while the state is copied and
+// the log is moved to a new segment, not while the snapshot is written.
+func (s *FileStorage) Snapshot() error {
+	s.snapshotMu.Lock()
+	defer s.snapshotMu.Unlock()
+
+	s.memory.mu.Lock()
+	if s.closed {
+		s.memory.mu.Unlock()
+		return ErrStorageClosed
+	}
+	state := s.memory.snapshot()
+	state.Seq = s.log.seq
+	err := s.log.rotate()
+	s.memory.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(filepath.Join(s.dir, fileStorageName), func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(state)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.memory.mu.Lock()
+	defer s.memory.mu.Unlock()
+
+	s.snapshotSeq = state.Seq
+	if s.closed {
+		return nil
+	}
+	return s.log.removeBefore(state.Seq)
+}
+
+// Close waits for a running snapshot and closes the log.
+func (s *FileStorage) Close() error {
+	s.snapshots.Wait()
+
+	s.memory.mu.Lock()
+	defer s.memory.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	s.closed = true
+	return s.log.close()
+}
@@ -0,0 +1,301 @@
+package wallet
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/darkside1809/wallet/pkg/types"
+)
+
+func TestFileStorage_reopen(t *testing.T) {
+	dir := t.TempDir()
+
+	storage, err := OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc := NewService(storage)
+	account, err := svc.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Deposit(account.ID, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment, err := svc.Pay(account.ID, 30, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	favorite, err := svc.FavoritePayment(payment.ID, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err = OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	svc = NewService(storage)
+	got, err := svc.FindAccountByID(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Balance != 70 {
+		t.Errorf("OpenFileStorage(): balance must be 70, got %v", got.Balance)
+	}
+	_, err = svc.FindPaymentByID(payment.ID)
+	if err != nil {
+		t.Errorf("OpenFileStorage(): payment must be restored, error = %v", err)
+	}
+	_, err = svc.PayFromFavorite(favorite.ID)
+	if err != nil {
+		t.Errorf("OpenFileStorage(): favorite must be restored, error = %v", err)
+	}
+
+	next, err := svc.RegisterAccount("+992000000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.ID != account.ID+1 {
+		t.Errorf("OpenFileStorage(): next account id must be %v, got %v", account.ID+1, next.ID)
+	}
+}
+
+func TestFileStorage_Update_rollback(t *testing.T) {
+	dir := t.TempDir()
+
+	storage, err := OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc := NewService(storage)
+	_, err = svc.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errFailed := errors.New("failed")
+	err = storage.Update(func(tx Tx) error {
+		_, err := svc.registerAccount(tx, "+992000000002", types.DefaultCurrency)
+		if err != nil {
+			return err
+		}
+		return errFailed
+	})
+	if err != errFailed {
+		t.Fatalf("Update(): must return fn error, returned %v", err)
+	}
+	storage.Close()
+
+	storage, err = OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	err = storage.View(func(tx Tx) error {
+		if len(tx.Accounts().All()) != 1 {
+			t.Errorf("Update(): failed update must not be stored, got %v", tx.Accounts().All())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readSnapshotSeq(t *testing.T, dir string) uint64 {
+	t.Helper()
+
+	content, err := os.ReadFile(filepath.Join(dir, fileStorageName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := &storageState{}
+	err = json.Unmarshal(content, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state.Seq
+}
+
+func TestFileStorage_Snapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	storage, err := OpenFileStorage(dir, SnapshotEvery(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc := NewService(storage)
+	account, err := svc.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		err = svc.Deposit(account.ID, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = storage.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq := readSnapshotSeq(t, dir); seq != 5 {
+		t.Errorf("Snapshot(): sequence must be 5, got %v", seq)
+	}
+	segments, err := walSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(segments, []uint64{6}) {
+		t.Errorf("Snapshot(): log must be compacted to segment 6, got %v", segments)
+	}
+
+	err = svc.Deposit(account.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	checkStoredBalances(t, dir, "OpenFileStorage()", map[int64]testBalance{account.ID: {50, 50}})
+}
+
+func TestFileStorage_SnapshotEvery(t *testing.T) {
+	dir := t.TempDir()
+
+	storage, err := OpenFileStorage(dir, SnapshotEvery(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc := NewService(storage)
+	account, err := svc.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 35; i++ {
+		err = svc.Deposit(account.ID, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	storage.Close()
+
+	if seq := readSnapshotSeq(t, dir); seq < 10 {
+		t.Errorf("SnapshotEvery(): a snapshot must be taken, got sequence %v", seq)
+	}
+	segments, err := walSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) > 2 {
+		t.Errorf("SnapshotEvery(): log must be compacted, got segments %v", segments)
+	}
+	checkStoredBalances(t, dir, "OpenFileStorage()", map[int64]testBalance{account.ID: {35, 35}})
+}
+
+func TestFileStorage_Snapshot_concurrentWriters(t *testing.T) {
+	dir := t.TempDir()
+
+	storage, err := OpenFileStorage(dir, SnapshotEvery(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc := NewService(storage)
+	account, err := svc.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			err := svc.Deposit(account.ID, 1)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		err = storage.Snapshot()
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	wg.Wait()
+	storage.Close()
+
+	checkStoredBalances(t, dir, "OpenFileStorage()", map[int64]testBalance{account.ID: {200, 200}})
+}
+
+func TestFileStorage_Clear_reserve(t *testing.T) {
+	dir := t.TempDir()
+
+	storage, err := OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc := NewService(storage)
+	_, err = svc.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.Update(func(tx Tx) error {
+		err := tx.Clear()
+		if err != nil {
+			return err
+		}
+		err = tx.Accounts().Save(&types.Account{ID: 3, Phone: "+992000000003"})
+		if err != nil {
+			return err
+		}
+		return tx.Accounts().Reserve(10)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	storage, err = OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	err = storage.View(func(tx Tx) error {
+		accounts := tx.Accounts().All()
+		if len(accounts) != 1 || accounts[0].ID != 3 {
+			t.Errorf("OpenFileStorage(): must replay the clear, got %v", accounts)
+		}
+		if tx.Accounts().LastID() != 10 {
+			t.Errorf("OpenFileStorage(): must replay the reserved id, got %v", tx.Accounts().LastID())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,67 @@
+package wallet
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic writes a file through a temporary file in the same
+// directory, syncs it and renames it over path, so readers and a crash
+// leave either the old or the new content, never a partial one.
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+
+	err = writeAndSync(file, write)
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// writeAndSync writes the file through a buffer, syncs and closes it.
+func writeAndSync(file *os.File, write func(w io.Writer) error) error {
+	buf := bufio.NewWriter(file)
+
+	err := write(buf)
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// syncDir makes renames and removals inside dir durable.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	err = file.Sync()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
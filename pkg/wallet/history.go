@@ -0,0 +1,318 @@
+package wallet
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/darkside1809/wallet/pkg/types"
+)
+
+const historyManifestName = "history.json"
+
+// historyManifest lists the shards written by HistoryToFiles in order.
+// Records and the byte ranges of shards count the uncompressed history, in
+// which each shard holds Length bytes from Offset on. Shards hold payment
+// rows of the dump format version Format, without a header row; manifests
+// without one describe version 2 rows. Totals add up the payments of all
+// shards in every currency. Manifests of versions 4 and 5, whose payments
+// are all in DefaultCurrency, hold their totals in Amount, Refunded and
+// Remaining instead, and older ones leave them out.
+type historyManifest struct {
+	Format     int  `json:",omitempty"`
+	Compressed bool `json:",omitempty"`
+	Records    int
+	Amount     types.Money                      `json:",omitempty"`
+	Refunded   types.Money                      `json:",omitempty"`
+	Remaining  types.Money                      `json:",omitempty"`
+	Totals     map[types.Currency]historyTotals `json:",omitempty"`
+	Shards     []historyShard
+}
+
+// historyTotals adds up payments in one currency.
+type historyTotals struct {
+	Amount    types.Money
+	Refunded  types.Money
+	Remaining types.Money
+}
+
+// add returns the totals with the payment added.
+func (t historyTotals) add(payment *types.Payment) historyTotals {
+	t.Amount += payment.Amount
+	t.Refunded += payment.Refunded
+	t.Remaining += payment.Amount - payment.Refunded
+	return t
+}
+
+type historyShard struct {
+	dumpFile
+	Offset int64
+	Length int64
+}
+
+// WithHistoryCompression makes HistoryToFiles compress every shard with
+// gzip, adding .gz to its name.
+func WithHistoryCompression() Option {
+	return func(s *Service) {
+		s.compressHistory = true
+	}
+}
+
+// historyWriter writes the shards of a history into dir and, once they are
+// all on disk, the manifest listing them.
+type historyWriter struct {
+	dir      string
+	keys     KeyProvider
+	manifest historyManifest
+}
+
+func (s *Service) newHistoryWriter(dir string) *historyWriter {
+	return &historyWriter{
+		dir:      dir,
+		keys:     s.keys,
+		manifest: historyManifest{Format: dumpFormat, Compressed: s.compressHistory, Totals: map[types.Currency]historyTotals{}},
+	}
+}
+
+// historyShardName returns the name of the n-th shard, counting from 1.
+func historyShardName(n int) string {
+	return "payments" + strconv.Itoa(n) + ".dump"
+}
+
+// shard writes payments as the next shard, one record at a time.
+func (h *historyWriter) shard(name string, payments []types.Payment) error {
+	if h.manifest.Compressed {
+		name += ".gz"
+	}
+
+	counter := &countingWriter{}
+	file, err := writeDumpFile(filepath.Join(h.dir, name), h.keys, func(w io.Writer) (int, error) {
+		var compressed *gzip.Writer
+		if h.manifest.Compressed {
+			compressed = gzip.NewWriter(w)
+			w = compressed
+		}
+
+		counter.w = w
+		for i := range payments {
+			_, err := io.WriteString(counter, formatPayment(&payments[i]))
+			if err != nil {
+				return 0, err
+			}
+			currency := currencyOrDefault(payments[i].Currency)
+			h.manifest.Totals[currency] = h.manifest.Totals[currency].add(&payments[i])
+		}
+
+		if compressed != nil {
+			return len(payments), compressed.Close()
+		}
+		return len(payments), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	offset := int64(0)
+	if n := len(h.manifest.Shards); n > 0 {
+		offset = h.manifest.Shards[n-1].Offset + h.manifest.Shards[n-1].Length
+	}
+	h.manifest.Records += len(payments)
+	h.manifest.Shards = append(h.manifest.Shards, historyShard{
+		dumpFile: file,
+		Offset:   offset,
+		Length:   counter.n,
+	})
+	return nil
+}
+
+// close writes the manifest.
+func (h *historyWriter) close() error {
+	return writeFileAtomic(filepath.Join(h.dir, historyManifestName), func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(h.manifest)
+	})
+}
+
+// VerifyHistory checks the shards written into dir by HistoryToFiles
+// against their manifest. It returns an error wrapping ErrIncompleteDump if
+// the manifest or a shard is missing, and ErrDumpMismatch if a shard is cut
+// short or changed, or the manifest doesn't add up. Encrypted shards are
+// checked without decrypting them.
+func VerifyHistory(dir string) error {
+	_, err := verifyHistory(dir)
+	return err
+}
+
+// verifyHistory returns the manifest of the history in dir once checked.
+func verifyHistory(dir string) (*historyManifest, error) {
+	content, err := os.ReadFile(filepath.Join(dir, historyManifestName))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s has no history manifest", ErrIncompleteDump, dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &historyManifest{}
+	err = json.Unmarshal(content, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrDumpMismatch, historyManifestName, err)
+	}
+
+	records := 0
+	offset := int64(0)
+	for _, shard := range manifest.Shards {
+		if shard.Offset != offset || shard.Length < 0 || shard.Records < 0 {
+			return nil, fmt.Errorf("%w: %s: bad range of %s", ErrDumpMismatch, historyManifestName, shard.Name)
+		}
+		offset += shard.Length
+		records += shard.Records
+
+		err := verifyDumpFile(filepath.Join(dir, shard.Name), shard.dumpFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if records != manifest.Records {
+		return nil, fmt.Errorf("%w: %s: shards hold %d records, not %d", ErrDumpMismatch, historyManifestName, records, manifest.Records)
+	}
+
+	return manifest, nil
+}
+
+// HistoryFromFiles reads back the payments HistoryToFiles wrote into dir, in
+// the order they were written, after checking the shards with
+// VerifyHistory. Malformed records are returned as ImportErrors.
+func (s *Service) HistoryFromFiles(dir string) ([]types.Payment, error) {
+	manifest, err := verifyHistory(dir)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Format == 0 {
+		manifest.Format = 2
+	}
+	err = checkDumpFormat(manifest.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	dump := &parsedDump{keys: s.keys, plaintext: s.plaintext}
+	for _, shard := range manifest.Shards {
+		err := dump.parseHistoryShard(filepath.Join(dir, shard.Name), manifest, shard)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(dump.errs) > 0 {
+		return nil, dump.errs
+	}
+
+	payments := make([]types.Payment, 0, len(dump.payments))
+	totals := map[types.Currency]historyTotals{}
+	for _, row := range dump.payments {
+		payments = append(payments, *row.payment)
+		totals[row.payment.Currency] = totals[row.payment.Currency].add(row.payment)
+	}
+	if !manifest.matches(totals) {
+		return nil, fmt.Errorf("%w: %s: shards total %v, manifest lists %v", ErrDumpMismatch, historyManifestName, totals, manifest.totals())
+	}
+	return payments, nil
+}
+
+// totals returns the totals the manifest lists by currency, or nil if its
+// version lists none.
+func (m *historyManifest) totals() map[types.Currency]historyTotals {
+	switch {
+	case m.Format >= 6:
+		return m.Totals
+	case m.Format >= 4:
+		listed := historyTotals{Amount: m.Amount, Refunded: m.Refunded, Remaining: m.Remaining}
+		if listed == (historyTotals{}) {
+			return map[types.Currency]historyTotals{}
+		}
+		return map[types.Currency]historyTotals{types.DefaultCurrency: listed}
+	}
+
+	return nil
+}
+
+// matches tells if the totals of the payments read back are those the
+// manifest lists, if any.
+func (m *historyManifest) matches(totals map[types.Currency]historyTotals) bool {
+	listed := m.totals()
+	if listed == nil {
+		return true
+	}
+	if len(listed) != len(totals) {
+		return false
+	}
+	for currency, total := range totals {
+		if listed[currency] != total {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseHistoryShard reads the records of a shard one line at a time.
+func (d *parsedDump) parseHistoryShard(path string, manifest *historyManifest, shard historyShard) error {
+	file, err := openFile(path, d.keys, d.plaintext)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		err := file.Close()
+		if err != nil {
+			log.Print(err)
+		}
+	}()
+
+	var reader io.Reader = file
+	if manifest.Compressed {
+		decompressed, err := gzip.NewReader(file)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		reader = decompressed
+	}
+
+	lines := bufio.NewReader(reader)
+	records := 0
+	length := int64(0)
+	for line := 1; ; line++ {
+		text, err := lines.ReadString('\n')
+		length += int64(len(text))
+		if text != "" {
+			row := splitDumpRow(shard.Name, line, strings.TrimSuffix(strings.TrimSuffix(text, "\n"), "\r"))
+			for version := manifest.Format; version < dumpFormat; version++ {
+				if upgrade := dumpMigrations[version].row; upgrade != nil {
+					upgrade(paymentsDumpName, row)
+				}
+			}
+			d.errs = append(d.errs, d.parsePayment(row)...)
+			records++
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	if records != shard.Records || length != shard.Length {
+		return fmt.Errorf("%w: %s holds %d records in %d bytes, manifest lists %d in %d", ErrDumpMismatch, path, records, length, shard.Records, shard.Length)
+	}
+	return nil
+}
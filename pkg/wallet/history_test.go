@@ -0,0 +1,275 @@
+package wallet
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/darkside1809/wallet/pkg/types"
+)
+
+// newHistoryService returns a service with one account and the given number
+// of payments from it.
+func newHistoryService(t *testing.T, payments int, opts ...Option) (*Service, []types.Payment) {
+	t.Helper()
+
+	s := NewService(nil, opts...)
+	account, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Deposit(account.ID, 100_00)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < payments; i++ {
+		_, err := s.Pay(account.ID, 1, "car")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if payments == 0 {
+		return s, nil
+	}
+	history, err := s.ExportAccountHistory(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, history
+}
+
+func TestService_HistoryToFiles_compressed(t *testing.T) {
+	dir := t.TempDir()
+	s, payments := newHistoryService(t, 1, WithHistoryCompression())
+
+	err := s.HistoryToFiles(payments, dir, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = VerifyHistory(dir)
+	if err != nil {
+		t.Errorf("VerifyHistory(): error = %v", err)
+	}
+
+	file, err := os.Open(filepath.Join(dir, "payments.dump.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(content), payments[0].ID+";") {
+		t.Errorf("HistoryToFiles(): wrong shard content %q", content)
+	}
+}
+
+func TestService_HistoryFromFiles_roundTrip(t *testing.T) {
+	tests := []struct {
+		payments int
+		records  int
+		shards   []string
+	}{
+		{0, 3, nil},
+		{1, 3, []string{"payments.dump"}},
+		{3, 3, []string{"payments.dump"}},
+		{4, 3, []string{"payments1.dump", "payments2.dump"}},
+		{7, 2, []string{"payments1.dump", "payments2.dump", "payments3.dump", "payments4.dump"}},
+	}
+
+	for _, options := range [][]Option{nil, {WithHistoryCompression(), WithEncryption(newTestKeyRing())}} {
+		for _, test := range tests {
+			dir := t.TempDir()
+			s, payments := newHistoryService(t, test.payments, options...)
+			// The history of another account must stay out of the shards.
+			other, err := s.RegisterAccount("+992000000002")
+			if err == nil {
+				err = s.Deposit(other.ID, 10)
+			}
+			if err == nil {
+				_, err = s.Pay(other.ID, 1, "food")
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = s.HistoryToFiles(payments, dir, test.records)
+			if err != nil {
+				t.Fatalf("HistoryToFiles(%d by %d): error = %v", test.payments, test.records, err)
+			}
+
+			manifest, err := verifyHistory(dir)
+			if err != nil {
+				t.Fatalf("VerifyHistory(%d by %d): error = %v", test.payments, test.records, err)
+			}
+			var shards []string
+			for _, shard := range manifest.Shards {
+				shards = append(shards, strings.TrimSuffix(shard.Name, ".gz"))
+			}
+			if !reflect.DeepEqual(shards, test.shards) {
+				t.Errorf("HistoryToFiles(%d by %d): wrote shards %v, want %v", test.payments, test.records, shards, test.shards)
+			}
+
+			got, err := s.HistoryFromFiles(dir)
+			if err != nil {
+				t.Fatalf("HistoryFromFiles(%d by %d): error = %v", test.payments, test.records, err)
+			}
+			if len(got) != len(payments) || (len(got) > 0 && !reflect.DeepEqual(got, payments)) {
+				t.Errorf("HistoryFromFiles(%d by %d): got %v, want %v", test.payments, test.records, got, payments)
+			}
+		}
+	}
+}
+
+func TestService_HistoryToFiles_fail(t *testing.T) {
+	s, payments := newHistoryService(t, 2)
+
+	err := s.HistoryToFiles(payments, t.TempDir(), 0)
+	if err != ErrMinRecords {
+		t.Errorf("HistoryToFiles(): must return ErrMinRecords, returned %v", err)
+	}
+
+	err = s.HistoryToFiles(payments, filepath.Join(t.TempDir(), "missing"), 1)
+	if !os.IsNotExist(err) {
+		t.Errorf("HistoryToFiles(): must return the error of creating a shard, returned %v", err)
+	}
+}
+
+func TestVerifyHistory_damaged(t *testing.T) {
+	damage := map[string]func(dir string) error{
+		"missing manifest": func(dir string) error {
+			return os.Remove(filepath.Join(dir, historyManifestName))
+		},
+		"missing shard": func(dir string) error {
+			return os.Remove(filepath.Join(dir, "payments2.dump.gz"))
+		},
+		"truncated shard": func(dir string) error {
+			return os.Truncate(filepath.Join(dir, "payments1.dump.gz"), 10)
+		},
+		"tampered shard": func(dir string) error {
+			path := filepath.Join(dir, "payments3.dump.gz")
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			content[len(content)-1] ^= 1
+			return os.WriteFile(path, content, 0o644)
+		},
+		"tampered range": func(dir string) error {
+			path := filepath.Join(dir, historyManifestName)
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(path, []byte(strings.Replace(string(content), `"Offset": 0`, `"Offset": 1`, 1)), 0o644)
+		},
+	}
+	want := map[string]error{
+		"missing manifest": ErrIncompleteDump,
+		"missing shard":    ErrIncompleteDump,
+		"truncated shard":  ErrDumpMismatch,
+		"tampered shard":   ErrDumpMismatch,
+		"tampered range":   ErrDumpMismatch,
+	}
+
+	for name, apply := range damage {
+		dir := t.TempDir()
+		s, payments := newHistoryService(t, 5, WithHistoryCompression())
+		err := s.HistoryToFiles(payments, dir, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = VerifyHistory(dir)
+		if err != nil {
+			t.Fatalf("VerifyHistory(): error = %v before damage", err)
+		}
+
+		err = apply(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = VerifyHistory(dir)
+		if !errors.Is(err, want[name]) {
+			t.Errorf("VerifyHistory(%s): must return %v, returned %v", name, want[name], err)
+		}
+	}
+}
+
+func TestVerifyHistory_encrypted(t *testing.T) {
+	dir := t.TempDir()
+	s, payments := newHistoryService(t, 3, WithEncryption(newTestKeyRing()))
+
+	err := s.HistoryToFiles(payments, dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = VerifyHistory(dir)
+	if err != nil {
+		t.Errorf("VerifyHistory(): error = %v", err)
+	}
+}
+
+func TestService_HistoryToFiles_refunds(t *testing.T) {
+	dir := t.TempDir()
+	s, payments := newHistoryService(t, 3)
+	for _, payment := range payments {
+		err := s.Confirm(payment.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := s.Refund(payments[1].ID, 1, "returned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payments, err = s.ExportAccountHistory(payments[0].AccountID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.HistoryToFiles(payments, dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := verifyHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Totals) != 1 || manifest.Totals[types.DefaultCurrency] != (historyTotals{Amount: 3, Refunded: 1, Remaining: 2}) {
+		t.Errorf("HistoryToFiles(): wrong totals %v", manifest.Totals)
+	}
+
+	got, err := s.HistoryFromFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, payments) {
+		t.Errorf("HistoryFromFiles(): got %v, want %v", got, payments)
+	}
+
+	path := filepath.Join(dir, historyManifestName)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, []byte(strings.Replace(string(content), `"Refunded": 1`, `"Refunded": 2`, 1)), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.HistoryFromFiles(dir)
+	if !errors.Is(err, ErrDumpMismatch) {
+		t.Errorf("HistoryFromFiles(): must return ErrDumpMismatch for wrong totals, returned %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/darkside1809/wallet/pkg/types"
+)
+
+var ErrHoldNotFound = errors.New("hold not found")
+var ErrHoldNotActive = errors.New("hold is not active")
+var ErrCaptureTooLarge = errors.New("capture exceeds the hold")
+
+// DefaultHoldTTL is how long holds last unless WithHoldTTL sets otherwise.
+const DefaultHoldTTL = 7 * 24 * time.Hour
+
+// WithHoldTTL makes holds placed by Authorize expire after ttl.
+func WithHoldTTL(ttl time.Duration) Option {
+	return func(s *Service) {
+		s.holdTTL = ttl
+	}
+}
+
+// Authorize places a hold of the amount on an account. The hold takes the
+// amount out of the available balance of the account but leaves its balance
+// and the ledger as they are, until it is captured, voided or expires.
+func (s *Service) Authorize(accountID int64, amount types.Money, category types.PaymentCategory) (*types.Hold, error) {
+	if amount <= 0 {
+		return nil, ErrAmountMustBePositive
+	}
+
+	var hold *types.Hold
+	err := s.update("Authorize", []interface{}{accountID, amount, category}, &hold, func(tx Tx) error {
+		account, err := tx.Accounts().ByID(accountID)
+		if err != nil {
+			return err
+		}
+
+		now := s.now()
+		if available(tx, account, now) < amount {
+			return ErrNotEnoughBalance
+		}
+
+		ttl := s.holdTTL
+		if ttl <= 0 {
+			ttl = DefaultHoldTTL
+		}
+		hold = &types.Hold{
+			ID:        s.newID(),
+			AccountID: accountID,
+			Amount:    amount,
+			Category:  category,
+			Status:    types.HoldStatusActive,
+			CreatedAt: now,
+			ExpiresAt: now.Add(ttl),
+		}
+		return tx.Holds().Save(hold)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hold, nil
+}
+
+// Capture settles the amount of an active hold, all of it or part, as a
+// successful payment and releases the rest of the hold.
+func (s *Service) Capture(holdID string, amount types.Money) (*types.Payment, error) {
+	if amount <= 0 {
+		return nil, ErrAmountMustBePositive
+	}
+
+	var payment *types.Payment
+	err := s.update("Capture", []interface{}{holdID, amount}, &payment, func(tx Tx) error {
+		now := s.now()
+		hold, err := activeHold(tx, holdID, now)
+		if err != nil {
+			return err
+		}
+		if amount > hold.Amount {
+			return fmt.Errorf("%w: hold %s is %d", ErrCaptureTooLarge, holdID, hold.Amount)
+		}
+
+		// The hold is released first, so the payment may spend what it held.
+		hold.Status = types.HoldStatusCaptured
+		hold.Captured = amount
+		hold.SettledAt = now
+		err = tx.Holds().Save(hold)
+		if err != nil {
+			return err
+		}
+
+		payment, err = s.pay(tx, hold.AccountID, amount, "", hold.Category, now)
+		if err != nil {
+			return err
+		}
+		payment, err = s.transition(tx, payment.ID, types.PaymentStatusOK, now)
+		if err != nil {
+			return err
+		}
+
+		hold.PaymentID = payment.ID
+		return tx.Holds().Save(hold)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return payment, nil
+}
+
+// Void releases an active hold without paying anything.
+func (s *Service) Void(holdID string) error {
+	return s.update("Void", []interface{}{holdID}, nil, func(tx Tx) error {
+		now := s.now()
+		hold, err := activeHold(tx, holdID, now)
+		if err != nil {
+			return err
+		}
+
+		hold.Status = types.HoldStatusVoided
+		hold.SettledAt = now
+		return tx.Holds().Save(hold)
+	})
+}
+
+// FindHoldByID returns a hold, expired if its TTL has run out even if
+// ExpireHolds has not recorded it yet.
+func (s *Service) FindHoldByID(holdID string) (*types.Hold, error) {
+	var hold *types.Hold
+
+	err := s.store().View(func(tx Tx) error {
+		var err error
+		hold, err = tx.Holds().ByID(holdID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hold.Status = holdStatus(hold, s.now())
+	if hold.Status == types.HoldStatusExpired && hold.SettledAt.IsZero() {
+		hold.SettledAt = hold.ExpiresAt
+	}
+	return hold, nil
+}
+
+// ExpireHolds records the expiry of every active hold whose TTL has run out
+// and returns how many there were. Expired holds stop counting against the
+// available balance as soon as their TTL runs out, so this only brings the
+// stored holds up to date.
+func (s *Service) ExpireHolds() (int, error) {
+	expired := 0
+
+	err := s.store().Update(func(tx Tx) error {
+		now := s.now()
+		for _, stored := range tx.Holds().All() {
+			if stored.Status != types.HoldStatusActive || holdStatus(stored, now) != types.HoldStatusExpired {
+				continue
+			}
+
+			hold := *stored
+			hold.Status = types.HoldStatusExpired
+			hold.SettledAt = hold.ExpiresAt
+			err := tx.Holds().Save(&hold)
+			if err != nil {
+				return err
+			}
+			expired++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return expired, nil
+}
+
+// holdStatus returns the status of a hold at the time: an active hold has
+// expired once the time reaches its expiry.
+func holdStatus(hold *types.Hold, now time.Time) types.HoldStatus {
+	if hold.Status == types.HoldStatusActive && !now.Before(hold.ExpiresAt) {
+		return types.HoldStatusExpired
+	}
+
+	return hold.Status
+}
+
+// activeHold returns a hold that is active at the time.
+func activeHold(tx Tx, holdID string, now time.Time) (*types.Hold, error) {
+	hold, err := tx.Holds().ByID(holdID)
+	if err != nil {
+		return nil, err
+	}
+	if status := holdStatus(hold, now); status != types.HoldStatusActive {
+		return nil, fmt.Errorf("%w: hold %s is %s", ErrHoldNotActive, holdID, status)
+	}
+
+	return hold, nil
+}
+
+// available returns the balance of an account less its holds active at the
+// time.
+func available(tx Tx, account *types.Account, now time.Time) types.Money {
+	balance := account.Balance
+	for _, hold := range tx.Holds().ByAccount(account.ID) {
+		if holdStatus(hold, now) == types.HoldStatusActive {
+			balance -= hold.Amount
+		}
+	}
+
+	return balance
+}
@@ -0,0 +1,175 @@
+package wallet
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/darkside1809/wallet/pkg/types"
+	"github.com/darkside1809/wallet/pkg/wallet/wallettest"
+)
+
+func TestService_Authorize(t *testing.T) {
+	s := newTestServiceWith(nil, WithClock(wallettest.NewClock(testStart, 0)), WithHoldTTL(time.Hour))
+	account := s.mustAddAccount(t, testAccount{phone: "+992000000001", balance: 100})
+	hold, err := s.Authorize(account.ID, 60, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hold.Status != types.HoldStatusActive || !hold.ExpiresAt.Equal(testStart.Add(time.Hour)) {
+		t.Errorf("Authorize(): wrong hold %+v", hold)
+	}
+	checkBalances(t, s.Service, "Authorize()", map[int64]testBalance{hold.AccountID: {100, 40}})
+
+	_, err = s.Pay(hold.AccountID, 41, "food")
+	if err != ErrNotEnoughBalance {
+		t.Errorf("Pay(): must not spend held money, returned %v", err)
+	}
+	_, err = s.Authorize(hold.AccountID, 41, "food")
+	if err != ErrNotEnoughBalance {
+		t.Errorf("Authorize(): must not hold held money, returned %v", err)
+	}
+	_, err = s.Authorize(hold.AccountID, 0, "food")
+	if err != ErrAmountMustBePositive {
+		t.Errorf("Authorize(): must return ErrAmountMustBePositive, returned %v", err)
+	}
+	_, err = s.Authorize(100, 1, "food")
+	if err != ErrAccountNotFound {
+		t.Errorf("Authorize(): must return ErrAccountNotFound, returned %v", err)
+	}
+
+	_, err = s.Pay(hold.AccountID, 40, "food")
+	if err != nil {
+		t.Errorf("Pay(): must spend what is available, error = %v", err)
+	}
+	checkBalances(t, s.Service, "Pay()", map[int64]testBalance{hold.AccountID: {60, 0}})
+}
+
+func TestService_Capture(t *testing.T) {
+	s := newTestServiceWith(nil, WithClock(wallettest.NewClock(testStart, 0)), WithHoldTTL(time.Hour))
+	account := s.mustAddAccount(t, testAccount{phone: "+992000000001", balance: 100})
+	hold, err := s.Authorize(account.ID, 60, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.Capture(hold.ID, 61)
+	if !errors.Is(err, ErrCaptureTooLarge) {
+		t.Errorf("Capture(): must return ErrCaptureTooLarge, returned %v", err)
+	}
+
+	payment, err := s.Capture(hold.ID, 45)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.AccountID != hold.AccountID || payment.Amount != 45 || payment.Category != "auto" || payment.Status != types.PaymentStatusOK {
+		t.Errorf("Capture(): wrong payment %+v", payment)
+	}
+	checkBalances(t, s.Service, "Capture()", map[int64]testBalance{hold.AccountID: {55, 55}})
+
+	captured, err := s.FindHoldByID(hold.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if captured.Status != types.HoldStatusCaptured || captured.Captured != 45 || captured.PaymentID != payment.ID {
+		t.Errorf("Capture(): wrong hold %+v", captured)
+	}
+
+	_, err = s.Capture(hold.ID, 1)
+	if !errors.Is(err, ErrHoldNotActive) {
+		t.Errorf("Capture(): must return ErrHoldNotActive once captured, returned %v", err)
+	}
+	_, err = s.Capture("unknown", 1)
+	if err != ErrHoldNotFound {
+		t.Errorf("Capture(): must return ErrHoldNotFound, returned %v", err)
+	}
+}
+
+func TestService_Void(t *testing.T) {
+	s := newTestServiceWith(nil, WithClock(wallettest.NewClock(testStart, 0)), WithHoldTTL(time.Hour))
+	account := s.mustAddAccount(t, testAccount{phone: "+992000000001", balance: 100})
+	hold, err := s.Authorize(account.ID, 60, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Void(hold.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBalances(t, s.Service, "Void()", map[int64]testBalance{hold.AccountID: {100, 100}})
+
+	err = s.Void(hold.ID)
+	if !errors.Is(err, ErrHoldNotActive) {
+		t.Errorf("Void(): must return ErrHoldNotActive once voided, returned %v", err)
+	}
+	err = s.Void("unknown")
+	if err != ErrHoldNotFound {
+		t.Errorf("Void(): must return ErrHoldNotFound, returned %v", err)
+	}
+}
+
+func TestService_ExpireHolds(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		storage.Close()
+	}()
+	clock := wallettest.NewClock(testStart, 0)
+	s := newTestServiceWith(storage, WithClock(clock), WithHoldTTL(time.Hour))
+	account := s.mustAddAccount(t, testAccount{phone: "+992000000001", balance: 100})
+	hold, err := s.Authorize(account.ID, 60, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Hour - time.Nanosecond)
+	checkBalances(t, s.Service, "before expiry", map[int64]testBalance{hold.AccountID: {100, 40}})
+
+	clock.Advance(time.Nanosecond)
+	checkBalances(t, s.Service, "after expiry", map[int64]testBalance{hold.AccountID: {100, 100}})
+	found, err := s.FindHoldByID(hold.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Status != types.HoldStatusExpired || !found.SettledAt.Equal(hold.ExpiresAt) {
+		t.Errorf("FindHoldByID(): hold must have expired, got %+v", found)
+	}
+	_, err = s.Capture(hold.ID, 1)
+	if !errors.Is(err, ErrHoldNotActive) {
+		t.Errorf("Capture(): must return ErrHoldNotActive once expired, returned %v", err)
+	}
+
+	for _, want := range []int{1, 0} {
+		expired, err := s.ExpireHolds()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expired != want {
+			t.Errorf("ExpireHolds(): expired %d holds, want %d", expired, want)
+		}
+	}
+
+	err = storage.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, err = OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored *types.Hold
+	err = storage.View(func(tx Tx) error {
+		stored, err = tx.Holds().ByID(hold.ID)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *stored != *found {
+		t.Errorf("ExpireHolds(): stored %+v, want %+v", stored, found)
+	}
+}
@@ -0,0 +1,167 @@
+package wallet
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrIdempotencyConflict = errors.New("idempotency key reused with other parameters")
+var ErrIdempotencyKeyNotFound = errors.New("idempotency key not found")
+
+// DefaultIdempotencyWindow is how long idempotency keys are kept unless
+// WithIdempotencyWindow sets otherwise.
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+// IdempotencyConflictError reports an idempotency key used again for another
+// operation or with other parameters. It matches ErrIdempotencyConflict with
+// errors.Is.
+type IdempotencyConflictError struct {
+	Key       string
+	Operation string
+}
+
+func (e *IdempotencyConflictError) Error() string {
+	return fmt.Sprintf("idempotency key %q: %s doesn't match the original call", e.Key, e.Operation)
+}
+
+func (e *IdempotencyConflictError) Is(target error) bool {
+	return target == ErrIdempotencyConflict
+}
+
+// IdempotencyRecord remembers the result of an operation made under an
+// idempotency key. Fingerprint identifies the parameters of the operation.
+type IdempotencyRecord struct {
+	Key         string
+	Operation   string
+	Fingerprint string
+	Result      json.RawMessage `json:",omitempty"`
+	CreatedAt   time.Time
+}
+
+// WithIdempotencyWindow keeps idempotency keys for window after the call
+// that used them first.
+func WithIdempotencyWindow(window time.Duration) Option {
+	return func(s *Service) {
+		s.idempotencyWindow = window
+	}
+}
+
+// Idempotent returns a view of the service whose mutating methods run under
+// the idempotency key, sharing the storage and options of s. Calling one of
+// them again with the same key and parameters within the idempotency window
+// returns the result of the first call without repeating it, while calling
+// it with other parameters, or another method, returns an
+// IdempotencyConflictError. Calls that fail don't use up the key. An empty
+// key gives s itself.
+func (s *Service) Idempotent(key string) *Service {
+	if key == "" {
+		return s
+	}
+
+	return &Service{
+		storage:           s.store(),
+		keys:              s.keys,
+		plaintext:         s.plaintext,
+		compressHistory:   s.compressHistory,
+		clock:             s.clock,
+		ids:               s.ids,
+		holdTTL:           s.holdTTL,
+		idempotencyWindow: s.idempotencyWindow,
+		idempotencyKey:    key,
+	}
+}
+
+// ExpireIdempotencyKeys forgets the idempotency keys older than the window
+// and returns how many there were. Expired keys are reused as new even
+// before they are forgotten.
+func (s *Service) ExpireIdempotencyKeys() (int, error) {
+	expired := 0
+
+	err := s.store().Update(func(tx Tx) error {
+		now := s.now()
+		var keys []string
+		for _, record := range tx.Idempotency().All() {
+			if s.idempotencyExpired(record, now) {
+				keys = append(keys, record.Key)
+			}
+		}
+
+		err := tx.Idempotency().Delete(keys...)
+		if err != nil {
+			return err
+		}
+		expired = len(keys)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return expired, nil
+}
+
+// update runs fn in a read-write transaction. Under an idempotency key, fn
+// only runs if the key is new: the operation and its parameters are recorded
+// along with the result fn leaves in result, which a repeated call gets
+// back instead.
+func (s *Service) update(operation string, params interface{}, result interface{}, fn func(tx Tx) error) error {
+	if s.idempotencyKey == "" {
+		return s.store().Update(fn)
+	}
+
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(encoded)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	return s.store().Update(func(tx Tx) error {
+		now := s.now()
+		record, err := tx.Idempotency().ByKey(s.idempotencyKey)
+		if err == nil && !s.idempotencyExpired(record, now) {
+			if record.Operation != operation || record.Fingerprint != fingerprint {
+				return &IdempotencyConflictError{Key: s.idempotencyKey, Operation: operation}
+			}
+			if result == nil {
+				return nil
+			}
+			return json.Unmarshal(record.Result, result)
+		}
+		if err != nil && err != ErrIdempotencyKeyNotFound {
+			return err
+		}
+
+		err = fn(tx)
+		if err != nil {
+			return err
+		}
+
+		record = &IdempotencyRecord{
+			Key:         s.idempotencyKey,
+			Operation:   operation,
+			Fingerprint: fingerprint,
+			CreatedAt:   now,
+		}
+		if result != nil {
+			record.Result, err = json.Marshal(result)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Idempotency().Save(record)
+	})
+}
+
+func (s *Service) idempotencyExpired(record *IdempotencyRecord, now time.Time) bool {
+	window := s.idempotencyWindow
+	if window <= 0 {
+		window = DefaultIdempotencyWindow
+	}
+
+	return !now.Before(record.CreatedAt.Add(window))
+}
@@ -0,0 +1,230 @@
+package wallet
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/darkside1809/wallet/pkg/wallet/wallettest"
+)
+
+func TestService_Idempotent_repeat(t *testing.T) {
+	s := newTestServiceWith(nil, WithClock(wallettest.NewClock(testStart, 0)), WithIdempotencyWindow(time.Hour))
+	account := s.mustAddAccount(t, testAccount{phone: "+992000000001", balance: 100})
+	other := s.mustAddAccount(t, testAccount{phone: "+992000000002", balance: 100})
+
+	first, err := s.Idempotent("pay-1").Pay(account.ID, 30, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := s.Idempotent("pay-1").Pay(account.ID, 30, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again, first) {
+		t.Errorf("Pay(): repeated call must return %+v, got %+v", first, again)
+	}
+
+	for i := 0; i < 2; i++ {
+		err = s.Idempotent("deposit-1").Deposit(account.ID, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.Idempotent("transfer-1").Transfer(account.ID, other.Phone, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkBalances(t, s.Service, "Idempotent()", map[int64]testBalance{account.ID: {65, 65}, other.ID: {110, 110}})
+
+	if s.Idempotent("") != s.Service {
+		t.Errorf("Idempotent(): empty key must give the service itself")
+	}
+}
+
+func TestService_Idempotent_conflict(t *testing.T) {
+	s := newTestServiceWith(nil, WithClock(wallettest.NewClock(testStart, 0)), WithIdempotencyWindow(time.Hour))
+	account := s.mustAddAccount(t, testAccount{phone: "+992000000001", balance: 100})
+	_, err := s.Idempotent("key").Pay(account.ID, 30, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := map[string]func(s *Service) error{
+		"other amount": func(s *Service) error {
+			_, err := s.Pay(account.ID, 31, "auto")
+			return err
+		},
+		"other operation": func(s *Service) error {
+			return s.Deposit(account.ID, 30)
+		},
+	}
+	for name, call := range calls {
+		err := call(s.Idempotent("key"))
+
+		conflict := &IdempotencyConflictError{}
+		if !errors.As(err, &conflict) || !errors.Is(err, ErrIdempotencyConflict) || conflict.Key != "key" {
+			t.Errorf("%s: must return IdempotencyConflictError, returned %v", name, err)
+		}
+	}
+	checkBalances(t, s.Service, "Idempotent() conflicts", map[int64]testBalance{account.ID: {70, 70}})
+}
+
+func TestService_Idempotent_failure(t *testing.T) {
+	s := newTestServiceWith(nil, WithClock(wallettest.NewClock(testStart, 0)), WithIdempotencyWindow(time.Hour))
+	account := s.mustAddAccount(t, testAccount{phone: "+992000000001", balance: 100})
+
+	_, err := s.Idempotent("key").Pay(account.ID, 150, "auto")
+	if err != ErrNotEnoughBalance {
+		t.Fatalf("Pay(): must return ErrNotEnoughBalance, returned %v", err)
+	}
+	err = s.Deposit(account.ID, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.Idempotent("key").Pay(account.ID, 150, "auto")
+	if err != nil {
+		t.Errorf("Pay(): a failed call must not use up the key, error = %v", err)
+	}
+	checkBalances(t, s.Service, "Pay()", map[int64]testBalance{account.ID: {0, 0}})
+}
+
+func TestService_Idempotent_window(t *testing.T) {
+	clock := wallettest.NewClock(testStart, 0)
+	s := newTestServiceWith(nil, WithClock(clock), WithIdempotencyWindow(time.Hour))
+	account := s.mustAddAccount(t, testAccount{phone: "+992000000001", balance: 100})
+	first, err := s.Idempotent("key").Pay(account.ID, 10, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Hour)
+	expired, err := s.ExpireIdempotencyKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired != 1 {
+		t.Errorf("ExpireIdempotencyKeys(): expired %d keys, want 1", expired)
+	}
+
+	again, err := s.Idempotent("key").Pay(account.ID, 10, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID == first.ID {
+		t.Errorf("Pay(): a key past the window must be new, got %+v", again)
+	}
+	checkBalances(t, s.Service, "Pay()", map[int64]testBalance{account.ID: {80, 80}})
+
+	// Keys past the window are new even before they are forgotten.
+	clock.Advance(time.Hour)
+	err = s.Idempotent("key").Deposit(account.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestService_ExpireIdempotencyKeys_many(t *testing.T) {
+	clock := wallettest.NewClock(testStart, 0)
+	s := NewService(nil, WithClock(clock), WithIdempotencyWindow(time.Hour))
+	const keys = 20000
+	err := s.store().Update(func(tx Tx) error {
+		for i := 0; i < keys; i++ {
+			err := tx.Idempotency().Save(&IdempotencyRecord{
+				Key:       strconv.Itoa(i),
+				Operation: "Deposit",
+				CreatedAt: testStart.Add(time.Duration(i%2) * time.Hour),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Hour)
+	expired, err := s.ExpireIdempotencyKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired != keys/2 {
+		t.Errorf("ExpireIdempotencyKeys(): expired %d keys, want %d", expired, keys/2)
+	}
+	err = s.store().View(func(tx Tx) error {
+		records := tx.Idempotency().All()
+		if len(records) != keys/2 || records[0].Key != "1" || records[len(records)-1].Key != strconv.Itoa(keys-1) {
+			t.Errorf("ExpireIdempotencyKeys(): must keep the odd keys in order, got %d keys", len(records))
+		}
+		_, err := tx.Idempotency().ByKey("3")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestService_Idempotent_persisted(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServiceWith(storage, WithClock(wallettest.NewClock(testStart, 0)), WithIdempotencyWindow(time.Hour))
+	account := s.mustAddAccount(t, testAccount{phone: "+992000000001", balance: 100})
+	first, err := s.Idempotent("key").Pay(account.ID, 30, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err = OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		storage.Close()
+	}()
+
+	clock := wallettest.NewClock(testStart, 0)
+	s = newTestServiceWith(storage, WithClock(clock))
+	again, err := s.Idempotent("key").Pay(account.ID, 30, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again, first) {
+		t.Errorf("Pay(): repeated call after reopening must return %+v, got %+v", first, again)
+	}
+	checkBalances(t, s.Service, "Pay()", map[int64]testBalance{account.ID: {70, 70}})
+
+	clock.Advance(DefaultIdempotencyWindow)
+	_, err = s.ExpireIdempotencyKeys()
+	if err == nil {
+		err = storage.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, err = OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.View(func(tx Tx) error {
+		if records := tx.Idempotency().All(); len(records) != 0 {
+			t.Errorf("ExpireIdempotencyKeys(): keys must stay forgotten after reopening, got %v", records)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,32 @@
+package wallet
+
+import "github.com/google/uuid"
+
+// IDGenerator hands out the IDs of new payments and favorites. IDs must be
+// unique for the life of the wallet.
+type IDGenerator interface {
+	NewID() string
+}
+
+type uuidGenerator struct{}
+
+func (uuidGenerator) NewID() string {
+	return uuid.New().String()
+}
+
+// WithIDGenerator makes the service take the IDs of new payments and
+// favorites from ids instead of random UUIDs.
+func WithIDGenerator(ids IDGenerator) Option {
+	return func(s *Service) {
+		s.ids = ids
+	}
+}
+
+func (s *Service) newID() string {
+	ids := s.ids
+	if ids == nil {
+		ids = uuidGenerator{}
+	}
+
+	return ids.NewID()
+}
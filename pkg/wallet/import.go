@@ -0,0 +1,907 @@
+package wallet
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darkside1809/wallet/pkg/types"
+)
+
+var ErrInvalidRow = errors.New("wrong number of fields")
+var ErrInvalidField = errors.New("invalid field")
+var ErrDuplicateID = errors.New("duplicate id")
+var ErrUnknownAccount = errors.New("unknown account")
+
+// ImportError describes a problem with one row of a dump file. Line and
+// Column are 1-based; Column is the byte position of the offending field.
+// In CSV files Line is the number of the record, the header being the first,
+// and Column the number of the field.
+type ImportError struct {
+	File   string
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %v", e.File, e.Line, e.Column, e.Err)
+}
+
+func (e *ImportError) Unwrap() error {
+	return e.Err
+}
+
+// ImportErrors lists every problem found in a dump, in file order.
+type ImportErrors []*ImportError
+
+func (e ImportErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return fmt.Sprintf("%d import errors:\n%s", len(e), strings.Join(lines, "\n"))
+}
+
+// ImportMode tells Import how to reconcile the dump with records already in
+// the service. Accounts are matched by phone and currency, then by ID;
+// payments and favorites by ID. A dump record that matches an existing one
+// with identical fields is never a conflict.
+type ImportMode int
+
+const (
+	// ImportFailOnConflict refuses dump records that differ from the existing
+	// records they match.
+	ImportFailOnConflict ImportMode = iota
+	// ImportMergeSkipExisting keeps existing records as they are and only adds
+	// the new ones.
+	ImportMergeSkipExisting
+	// ImportMergeOverwrite replaces existing records with the dump records
+	// they match.
+	ImportMergeOverwrite
+	// ImportReplace drops the accounts, payments and favorites and loads the
+	// dump instead, keeping the other records only as Tx.Clear describes.
+	ImportReplace
+)
+
+var ErrImportConflict = errors.New("conflicts with existing record")
+
+// ImportOptions controls how Import treats invalid rows and existing records.
+type ImportOptions struct {
+	// Lenient skips invalid rows, and rows depending on them, instead of
+	// refusing the whole import.
+	Lenient bool
+	Mode    ImportMode
+}
+
+// ImportReport tells what an import stored and which rows it skipped.
+// Existing counts dump records that matched an existing record and left it
+// as it was.
+type ImportReport struct {
+	Accounts  int
+	Payments  int
+	Favorites int
+	Existing  int
+	Skipped   ImportErrors
+}
+
+// Import strictly loads the dump published in dir, failing on conflicts with
+// existing records: it changes nothing unless every row of every file is
+// valid, and otherwise returns ImportErrors.
+func (s *Service) Import(dir string) error {
+	_, err := s.ImportWithOptions(dir, ImportOptions{})
+	return err
+}
+
+// ImportWithOptions loads the dump published in dir. The generation is first
+// checked against its manifest, and dumps of older formats are upgraded as
+// they are read. Then all three files are parsed and checked
+// for malformed fields, duplicate IDs and phones, and payments or favorites
+// of accounts that exist neither in the dump nor in the service. Valid rows
+// are reconciled with the existing records according to options.Mode and
+// stored in one transaction.
+//
+// A dump account matching an existing account by phone and currency under
+// another ID is the same account: when merging, it keeps its existing ID and
+// the dump's payments and favorites are moved to it. New accounts keep their
+// dump IDs, and accounts registered later get IDs past the highest one. The
+// currency of an existing account never changes, and payments and favorites
+// must be in the currency of their account.
+//
+// In strict mode any problem makes it return ImportErrors with nothing
+// stored; in lenient mode the bad rows are skipped and listed in the report.
+func (s *Service) ImportWithOptions(dir string, options ImportOptions) (*ImportReport, error) {
+	base, format, err := dumpDir(dir, accountsDumpName, paymentsDumpName, favoritesDumpName)
+	if err != nil {
+		return nil, err
+	}
+	err = checkDumpFormat(format)
+	if err != nil {
+		return nil, err
+	}
+
+	dump := &parsedDump{keys: s.keys, plaintext: s.plaintext}
+	err = dump.parseFile(filepath.Join(base, accountsDumpName), true, format, accountColumns, dump.parseAccount)
+	if err != nil {
+		return nil, err
+	}
+	err = dump.parseFile(filepath.Join(base, paymentsDumpName), true, format, paymentColumns, dump.parsePayment)
+	if err != nil {
+		return nil, err
+	}
+	err = dump.parseFile(filepath.Join(base, favoritesDumpName), false, format, favoriteColumns, dump.parseFavorite)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.importDump(dump, options)
+}
+
+// importDump stores the valid rows of a parsed dump as ImportWithOptions
+// describes.
+func (s *Service) importDump(dump *parsedDump, options ImportOptions) (*ImportReport, error) {
+	if len(dump.errs) > 0 && !options.Lenient {
+		return nil, dump.errs
+	}
+
+	report := &ImportReport{}
+	err := s.store().Update(func(tx Tx) error {
+		*report = ImportReport{Skipped: append(ImportErrors(nil), dump.errs...)}
+
+		if options.Mode == ImportReplace {
+			err := tx.Clear()
+			if err != nil {
+				return err
+			}
+		}
+
+		merge := &importMerge{tx: tx, now: s.now(), mode: options.Mode, dump: dump, report: report, accountIDs: map[int64]int64{}}
+		for _, row := range dump.accounts {
+			err := merge.account(row)
+			if err != nil {
+				return err
+			}
+		}
+		for _, row := range dump.payments {
+			err := merge.payment(row)
+			if err != nil {
+				return err
+			}
+		}
+		for _, row := range dump.favorites {
+			err := merge.favorite(row)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(report.Skipped) > 0 && !options.Lenient {
+			return report.Skipped
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// importMerge stores dump rows in a transaction, reconciling them with the
+// records already there.
+type importMerge struct {
+	tx Tx
+	// now is when the ledger adjusts to the imported balances.
+	now    time.Time
+	mode   ImportMode
+	dump   *parsedDump
+	report *ImportReport
+	// accountIDs maps the ID of every dump account that was stored or matched
+	// to the ID it has in the service.
+	accountIDs map[int64]int64
+}
+
+func (m *importMerge) skip(err *ImportError) {
+	m.report.Skipped = append(m.report.Skipped, err)
+}
+
+func (m *importMerge) account(row *dumpRow) error {
+	imported := *row.account
+
+	existing, err := m.tx.Accounts().ByPhone(imported.Phone, imported.Currency)
+	column := 1
+	if err == ErrAccountNotFound {
+		existing, err = m.tx.Accounts().ByID(imported.ID)
+		column = 0
+	}
+	if err == ErrAccountNotFound {
+		err = m.tx.Accounts().Save(&imported)
+		if err == nil {
+			err = adjustLedger(m.tx, &imported, m.now)
+		}
+		if err != nil {
+			return err
+		}
+		m.accountIDs[imported.ID] = imported.ID
+		m.report.Accounts++
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if *existing == imported {
+		m.accountIDs[imported.ID] = existing.ID
+		m.report.Existing++
+		return nil
+	}
+	if existing.Currency != imported.Currency {
+		m.skip(row.errorAt(3, fmt.Errorf("%w: account %d is in %s", ErrCurrencyMismatch, existing.ID, existing.Currency)))
+		return nil
+	}
+
+	switch m.mode {
+	case ImportMergeSkipExisting:
+		m.accountIDs[imported.ID] = existing.ID
+		m.report.Existing++
+	case ImportMergeOverwrite:
+		imported.ID = existing.ID
+		err = m.tx.Accounts().Save(&imported)
+		if err == nil {
+			err = adjustLedger(m.tx, &imported, m.now)
+		}
+		if err != nil {
+			return err
+		}
+		m.accountIDs[row.account.ID] = existing.ID
+		m.report.Accounts++
+	default:
+		m.skip(row.errorAt(column, fmt.Errorf("%w: account %d", ErrImportConflict, existing.ID)))
+	}
+
+	return nil
+}
+
+// accountID returns the ID in the service of the account a payment or
+// favorite row belongs to.
+func (m *importMerge) accountID(row *dumpRow, id int64) (int64, *ImportError) {
+	if stored, ok := m.accountIDs[id]; ok {
+		return stored, nil
+	}
+	if m.dump.accountIDs[id] {
+		return 0, row.errorAt(1, fmt.Errorf("%w: account %d was skipped", ErrUnknownAccount, id))
+	}
+
+	_, err := m.tx.Accounts().ByID(id)
+	if err != nil {
+		return 0, row.errorAt(1, ErrUnknownAccount)
+	}
+
+	return id, nil
+}
+
+// checkCurrency makes sure a payment or favorite row, whose currency is the
+// given field, is in the currency of the account it belongs to.
+func (m *importMerge) checkCurrency(row *dumpRow, accountID int64, currency types.Currency, field int) *ImportError {
+	account, err := m.tx.Accounts().ByID(accountID)
+	if err != nil {
+		return row.errorAt(1, ErrUnknownAccount)
+	}
+	if account.Currency != currency {
+		return row.errorAt(field, fmt.Errorf("%w: account %d is in %s", ErrCurrencyMismatch, accountID, account.Currency))
+	}
+
+	return nil
+}
+
+func (m *importMerge) payment(row *dumpRow) error {
+	imported := *row.payment
+
+	accountID, importErr := m.accountID(row, imported.AccountID)
+	if importErr == nil {
+		importErr = m.checkCurrency(row, accountID, imported.Currency, 11)
+	}
+	if importErr != nil {
+		m.skip(importErr)
+		return nil
+	}
+	imported.AccountID = accountID
+
+	existing, err := m.tx.Payments().ByID(imported.ID)
+	if err == nil && *existing == imported {
+		m.report.Existing++
+		return nil
+	}
+	if err == nil && m.mode == ImportMergeSkipExisting {
+		m.report.Existing++
+		return nil
+	}
+	if err == nil && m.mode != ImportMergeOverwrite {
+		m.skip(row.errorAt(0, ErrImportConflict))
+		return nil
+	}
+	if err != nil && err != ErrPaymentNotFound {
+		return err
+	}
+
+	err = m.tx.Payments().Save(&imported)
+	if err != nil {
+		return err
+	}
+	m.report.Payments++
+	return nil
+}
+
+func (m *importMerge) favorite(row *dumpRow) error {
+	imported := *row.favorite
+
+	accountID, importErr := m.accountID(row, imported.AccountID)
+	if importErr == nil {
+		importErr = m.checkCurrency(row, accountID, imported.Currency, 5)
+	}
+	if importErr != nil {
+		m.skip(importErr)
+		return nil
+	}
+	imported.AccountID = accountID
+
+	existing, err := m.tx.Favorites().ByID(imported.ID)
+	if err == nil && *existing == imported {
+		m.report.Existing++
+		return nil
+	}
+	if err == nil && m.mode == ImportMergeSkipExisting {
+		m.report.Existing++
+		return nil
+	}
+	if err == nil && m.mode != ImportMergeOverwrite {
+		m.skip(row.errorAt(0, ErrImportConflict))
+		return nil
+	}
+	if err != nil && err != ErrFavoriteNotFound {
+		return err
+	}
+
+	err = m.tx.Favorites().Save(&imported)
+	if err != nil {
+		return err
+	}
+	m.report.Favorites++
+	return nil
+}
+
+// dumpRow is one line of a dump file split into fields.
+type dumpRow struct {
+	file   string
+	line   int
+	fields []string
+	// columns holds the 1-based byte position of every field.
+	columns []int
+
+	account  *types.Account
+	payment  *types.Payment
+	favorite *types.Favorite
+}
+
+func (r *dumpRow) errorAt(field int, err error) *ImportError {
+	return &ImportError{File: r.file, Line: r.line, Column: r.columns[field], Err: err}
+}
+
+func (r *dumpRow) int64(field int, name string) (int64, *ImportError) {
+	value, err := strconv.ParseInt(r.fields[field], 10, 64)
+	if err != nil {
+		return 0, r.errorAt(field, fmt.Errorf("%w: %s %q is not a number", ErrInvalidField, name, r.fields[field]))
+	}
+
+	return value, nil
+}
+
+// time parses a time written by formatTime; an empty field is the zero time.
+func (r *dumpRow) time(field int, name string) (time.Time, *ImportError) {
+	if r.fields[field] == "" {
+		return time.Time{}, nil
+	}
+
+	value, err := time.Parse(time.RFC3339Nano, r.fields[field])
+	if err != nil {
+		return time.Time{}, r.errorAt(field, fmt.Errorf("%w: %s %q is not an RFC 3339 time", ErrInvalidField, name, r.fields[field]))
+	}
+
+	return value.UTC(), nil
+}
+
+// currency parses a currency code; an empty field, as in files without the
+// column, is DefaultCurrency.
+func (r *dumpRow) currency(field int) (types.Currency, *ImportError) {
+	currency := currencyOrDefault(types.Currency(r.fields[field]))
+	err := validateCurrency(currency)
+	if err != nil {
+		return "", r.errorAt(field, err)
+	}
+
+	return currency, nil
+}
+
+func (r *dumpRow) nonEmpty(field int, name string) *ImportError {
+	if r.fields[field] == "" {
+		return r.errorAt(field, fmt.Errorf("%w: empty %s", ErrInvalidField, name))
+	}
+
+	return nil
+}
+
+func (r *dumpRow) positive(field int, name string, value int64) *ImportError {
+	if value <= 0 {
+		return r.errorAt(field, fmt.Errorf("%w: %s must be positive", ErrInvalidField, name))
+	}
+
+	return nil
+}
+
+func (r *dumpRow) nonNegative(field int, name string, value int64) *ImportError {
+	if value < 0 {
+		return r.errorAt(field, fmt.Errorf("%w: %s must not be negative", ErrInvalidField, name))
+	}
+
+	return nil
+}
+
+// parsedDump collects the valid rows of a dump and the problems with the
+// others.
+type parsedDump struct {
+	accounts  []*dumpRow
+	payments  []*dumpRow
+	favorites []*dumpRow
+	errs      ImportErrors
+
+	accountIDs  map[int64]bool
+	phones      map[accountKey]bool
+	paymentIDs  map[string]bool
+	favoriteIDs map[string]bool
+
+	// keys decrypt encrypted dump files; plaintext allows files that aren't
+	// encrypted even with keys.
+	keys      KeyProvider
+	plaintext bool
+}
+
+// parseFile reads a dump file of the given format row by row, without
+// holding it in memory, upgrades the rows to the current format, picks the
+// columns out of them in order and passes the non-empty ones to parse. A
+// missing file is only an error if it is required.
+func (d *parsedDump) parseFile(path string, required bool, format int, columns []string, parse func(row *dumpRow) []*ImportError) error {
+	file, err := openFile(path, d.keys, d.plaintext)
+	if os.IsNotExist(err) && !required {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		err := file.Close()
+		if err != nil {
+			log.Print(err)
+		}
+	}()
+
+	name := filepath.Base(path)
+	var header []string
+	var positions []int
+
+	lines := bufio.NewReader(file)
+	for i := 0; ; i++ {
+		line, err := lines.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if err == io.EOF && line == "" {
+			break
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if line == "" {
+			continue
+		}
+
+		row := splitDumpRow(name, i+1, line)
+
+		if positions == nil {
+			if format >= 2 {
+				header = row.fields
+			}
+			for version := format; version < dumpFormat; version++ {
+				header = dumpMigrations[version].columns(name, header)
+			}
+
+			var missing []string
+			positions, missing = columnPositions(header, columns)
+			if len(missing) > 0 {
+				for _, column := range missing {
+					d.errs = append(d.errs, &ImportError{File: name, Line: i + 1, Column: 1, Err: fmt.Errorf("%w: %s", ErrMissingColumn, column)})
+				}
+				return nil
+			}
+			if format >= 2 {
+				continue
+			}
+		}
+
+		for version := format; version < dumpFormat; version++ {
+			if upgrade := dumpMigrations[version].row; upgrade != nil {
+				upgrade(name, row)
+			}
+		}
+		if len(row.fields) != len(header) {
+			d.errs = append(d.errs, row.errorAt(0, fmt.Errorf("%w: %d fields, header has %d", ErrInvalidRow, len(row.fields), len(header))))
+			continue
+		}
+
+		picked := &dumpRow{file: name, line: row.line}
+		for _, position := range positions {
+			picked.fields = append(picked.fields, row.fields[position])
+			picked.columns = append(picked.columns, row.columns[position])
+		}
+		d.errs = append(d.errs, parse(picked)...)
+	}
+
+	return nil
+}
+
+// splitDumpRow splits a line of a dump file into its fields.
+func splitDumpRow(name string, line int, text string) *dumpRow {
+	row := &dumpRow{file: name, line: line, fields: strings.Split(text, ";")}
+	column := 1
+	for _, field := range row.fields {
+		row.columns = append(row.columns, column)
+		column += len(field) + 1
+	}
+
+	return row
+}
+
+// columnPositions finds the columns in a header row, ignoring case and
+// surrounding spaces, and returns their positions and the missing columns.
+func columnPositions(header []string, columns []string) ([]int, []string) {
+	positions := make([]int, len(columns))
+	var missing []string
+
+	for i, column := range columns {
+		positions[i] = -1
+		for j, name := range header {
+			if strings.EqualFold(strings.TrimSpace(name), column) {
+				positions[i] = j
+				break
+			}
+		}
+		if positions[i] < 0 {
+			missing = append(missing, column)
+		}
+	}
+
+	return positions, missing
+}
+
+// check returns the non-nil errors.
+func check(errs ...*ImportError) []*ImportError {
+	found := []*ImportError{}
+	for _, err := range errs {
+		if err != nil {
+			found = append(found, err)
+		}
+	}
+
+	return found
+}
+
+func (d *parsedDump) parseAccount(row *dumpRow) []*ImportError {
+	if len(row.fields) != len(accountColumns) {
+		return check(row.errorAt(0, fmt.Errorf("%w: account has %d, want %d", ErrInvalidRow, len(row.fields), len(accountColumns))))
+	}
+
+	id, idErr := row.int64(0, "id")
+	if idErr == nil {
+		idErr = row.positive(0, "id", id)
+	}
+	balance, balanceErr := row.int64(2, "balance")
+	currency, currencyErr := row.currency(3)
+	errs := check(idErr, row.nonEmpty(1, "phone"), balanceErr, currencyErr)
+	if len(errs) > 0 {
+		return errs
+	}
+
+	if d.accountIDs == nil {
+		d.accountIDs = map[int64]bool{}
+		d.phones = map[accountKey]bool{}
+	}
+	account := &types.Account{
+		ID:       id,
+		Phone:    types.Phone(row.fields[1]),
+		Currency: currency,
+		Balance:  types.Money(balance),
+	}
+	if d.accountIDs[id] {
+		return check(row.errorAt(0, ErrDuplicateID))
+	}
+	if d.phones[keyOf(account)] {
+		return check(row.errorAt(1, ErrPhoneRegistered))
+	}
+	d.accountIDs[id] = true
+	d.phones[keyOf(account)] = true
+
+	row.account = account
+	d.accounts = append(d.accounts, row)
+	return nil
+}
+
+func (d *parsedDump) parsePayment(row *dumpRow) []*ImportError {
+	if len(row.fields) != len(paymentColumns) {
+		return check(row.errorAt(0, fmt.Errorf("%w: payment has %d, want %d", ErrInvalidRow, len(row.fields), len(paymentColumns))))
+	}
+
+	accountID, accountErr := row.int64(1, "account id")
+	amount, amountErr := row.int64(2, "amount")
+	if amountErr == nil {
+		amountErr = row.nonNegative(2, "amount", amount)
+	}
+	status := types.PaymentStatus(row.fields[4])
+	var statusErr *ImportError
+	if !validPaymentStatus(status) {
+		statusErr = row.errorAt(4, fmt.Errorf("%w: unknown status %q", ErrInvalidField, status))
+	}
+	createdAt, createdErr := row.time(5, "created at")
+	updatedAt, updatedErr := row.time(6, "updated at")
+	settledAt, settledErr := row.time(7, "settled at")
+	// Files without the column have nothing refunded.
+	var refunded int64
+	var refundedErr *ImportError
+	if row.fields[8] != "" {
+		refunded, refundedErr = row.int64(8, "refunded")
+	}
+	if refundedErr == nil && amountErr == nil && (refunded < 0 || refunded > amount) {
+		refundedErr = row.errorAt(8, fmt.Errorf("%w: refunded must be between 0 and the amount", ErrInvalidField))
+	}
+	// Files without the column only have payments out of the account.
+	direction := types.PaymentDirection(row.fields[9])
+	if direction == "" {
+		direction = types.PaymentDirectionOut
+	}
+	var directionErr *ImportError
+	if err := validateDirection(direction, row.fields[10]); err != nil {
+		directionErr = row.errorAt(9, err)
+	}
+	currency, currencyErr := row.currency(11)
+	errs := check(row.nonEmpty(0, "id"), accountErr, amountErr, statusErr, createdErr, updatedErr, settledErr, refundedErr, directionErr, currencyErr)
+	if len(errs) > 0 {
+		return errs
+	}
+
+	if d.paymentIDs == nil {
+		d.paymentIDs = map[string]bool{}
+	}
+	if d.paymentIDs[row.fields[0]] {
+		return check(row.errorAt(0, ErrDuplicateID))
+	}
+	d.paymentIDs[row.fields[0]] = true
+
+	row.payment = &types.Payment{
+		ID:        row.fields[0],
+		AccountID: accountID,
+		Amount:    types.Money(amount),
+		Refunded:  types.Money(refunded),
+		Currency:  currency,
+		Category:  types.PaymentCategory(row.fields[3]),
+		Status:    status,
+		Direction: direction,
+		LinkedID:  row.fields[10],
+		CreatedAt: createdAt,
+		UpdatedAt: updatedAt,
+		SettledAt: settledAt,
+	}
+	d.payments = append(d.payments, row)
+	return nil
+}
+
+func (d *parsedDump) parseFavorite(row *dumpRow) []*ImportError {
+	if len(row.fields) != len(favoriteColumns) {
+		return check(row.errorAt(0, fmt.Errorf("%w: favorite has %d, want %d", ErrInvalidRow, len(row.fields), len(favoriteColumns))))
+	}
+
+	accountID, accountErr := row.int64(1, "account id")
+	amount, amountErr := row.int64(3, "amount")
+	if amountErr == nil {
+		amountErr = row.nonNegative(3, "amount", amount)
+	}
+	currency, currencyErr := row.currency(5)
+	errs := check(row.nonEmpty(0, "id"), accountErr, amountErr, currencyErr)
+	if len(errs) > 0 {
+		return errs
+	}
+
+	if d.favoriteIDs == nil {
+		d.favoriteIDs = map[string]bool{}
+	}
+	if d.favoriteIDs[row.fields[0]] {
+		return check(row.errorAt(0, ErrDuplicateID))
+	}
+	d.favoriteIDs[row.fields[0]] = true
+
+	row.favorite = &types.Favorite{
+		ID:        row.fields[0],
+		AccountID: accountID,
+		Name:      row.fields[2],
+		Amount:    types.Money(amount),
+		Currency:  currency,
+		Category:  types.PaymentCategory(row.fields[4]),
+	}
+	d.favorites = append(d.favorites, row)
+	return nil
+}
+
+// stateLoader stores the records of a whole state, read from a format that
+// replaces the stored state rather than merging into it, after checking each
+// of them. It expects the storage to have been cleared.
+type stateLoader struct {
+	tx Tx
+	// now is when the ledger adjusts to the loaded balances.
+	now time.Time
+}
+
+// reserve makes next the ID of the next registered account.
+func (l stateLoader) reserve(next int64) error {
+	if next < 1 {
+		return fmt.Errorf("%w: next account id must be positive", ErrInvalidField)
+	}
+
+	return l.tx.Accounts().Reserve(next - 1)
+}
+
+func (l stateLoader) account(account *types.Account) error {
+	// States written before accounts had a currency are in the default one,
+	// and so are their payments and favorites.
+	account.Currency = currencyOrDefault(account.Currency)
+
+	err := validateAccount(account)
+	if err != nil {
+		return err
+	}
+
+	_, err = l.tx.Accounts().ByID(account.ID)
+	if err == nil {
+		return fmt.Errorf("%w: account %d", ErrDuplicateID, account.ID)
+	}
+
+	err = l.tx.Accounts().Save(account)
+	if err != nil {
+		return err
+	}
+
+	return adjustLedger(l.tx, account, l.now)
+}
+
+func (l stateLoader) payment(payment *types.Payment) error {
+	// States written before transfers only have payments out of accounts.
+	if payment.Direction == "" {
+		payment.Direction = types.PaymentDirectionOut
+	}
+	payment.Currency = currencyOrDefault(payment.Currency)
+
+	err := validatePayment(payment)
+	if err != nil {
+		return err
+	}
+
+	_, err = l.tx.Payments().ByID(payment.ID)
+	if err == nil {
+		return fmt.Errorf("%w: payment %s", ErrDuplicateID, payment.ID)
+	}
+
+	return l.tx.Payments().Save(payment)
+}
+
+func (l stateLoader) favorite(favorite *types.Favorite) error {
+	favorite.Currency = currencyOrDefault(favorite.Currency)
+
+	err := validateFavorite(favorite)
+	if err != nil {
+		return err
+	}
+
+	_, err = l.tx.Favorites().ByID(favorite.ID)
+	if err == nil {
+		return fmt.Errorf("%w: favorite %s", ErrDuplicateID, favorite.ID)
+	}
+
+	return l.tx.Favorites().Save(favorite)
+}
+
+// checkAccounts makes sure every payment and favorite belongs to a stored
+// account and is in its currency, once the whole state is loaded in
+// whatever order.
+func (l stateLoader) checkAccounts() error {
+	for i, payment := range l.tx.Payments().All() {
+		account, err := l.tx.Accounts().ByID(payment.AccountID)
+		if err != nil {
+			return fmt.Errorf("payments[%d]: %w: %d", i, ErrUnknownAccount, payment.AccountID)
+		}
+		if account.Currency != payment.Currency {
+			return fmt.Errorf("payments[%d]: %w: %s, account %d is in %s", i, ErrCurrencyMismatch, payment.Currency, account.ID, account.Currency)
+		}
+	}
+	for i, favorite := range l.tx.Favorites().All() {
+		account, err := l.tx.Accounts().ByID(favorite.AccountID)
+		if err != nil {
+			return fmt.Errorf("favorites[%d]: %w: %d", i, ErrUnknownAccount, favorite.AccountID)
+		}
+		if account.Currency != favorite.Currency {
+			return fmt.Errorf("favorites[%d]: %w: %s, account %d is in %s", i, ErrCurrencyMismatch, favorite.Currency, account.ID, account.Currency)
+		}
+	}
+
+	return nil
+}
+
+func validateAccount(account *types.Account) error {
+	if account.ID <= 0 {
+		return fmt.Errorf("%w: account id must be positive", ErrInvalidField)
+	}
+	if account.Phone == "" {
+		return fmt.Errorf("%w: empty phone", ErrInvalidField)
+	}
+
+	return validateCurrency(account.Currency)
+}
+
+func validatePayment(payment *types.Payment) error {
+	if payment.ID == "" {
+		return fmt.Errorf("%w: empty payment id", ErrInvalidField)
+	}
+	if payment.Amount < 0 {
+		return fmt.Errorf("%w: amount must not be negative", ErrInvalidField)
+	}
+	if payment.Refunded < 0 || payment.Refunded > payment.Amount {
+		return fmt.Errorf("%w: refunded must be between 0 and the amount", ErrInvalidField)
+	}
+	if !validPaymentStatus(payment.Status) {
+		return fmt.Errorf("%w: unknown status %q", ErrInvalidField, payment.Status)
+	}
+	err := validateCurrency(payment.Currency)
+	if err != nil {
+		return err
+	}
+
+	return validateDirection(payment.Direction, payment.LinkedID)
+}
+
+// validateDirection checks the direction of a payment. Payments into an
+// account are only made by transfers, so they must be linked.
+func validateDirection(direction types.PaymentDirection, linkedID string) error {
+	switch direction {
+	case types.PaymentDirectionOut:
+		return nil
+	case types.PaymentDirectionIn:
+		if linkedID == "" {
+			return fmt.Errorf("%w: incoming payment must be linked to a transfer", ErrInvalidField)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%w: unknown direction %q", ErrInvalidField, direction)
+}
+
+func validateFavorite(favorite *types.Favorite) error {
+	if favorite.ID == "" {
+		return fmt.Errorf("%w: empty favorite id", ErrInvalidField)
+	}
+	if favorite.Amount < 0 {
+		return fmt.Errorf("%w: amount must not be negative", ErrInvalidField)
+	}
+
+	return validateCurrency(favorite.Currency)
+}
@@ -0,0 +1,337 @@
+package wallet
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/darkside1809/wallet/pkg/types"
+)
+
+func writeDump(t *testing.T, accounts, payments, favorites string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	files := map[string]string{
+		accountsDumpName:  accounts,
+		paymentsDumpName:  payments,
+		favoritesDumpName: favorites,
+	}
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+type importProblem struct {
+	file   string
+	line   int
+	column int
+	err    error
+}
+
+func problems(errs ImportErrors) []importProblem {
+	found := []importProblem{}
+	for _, err := range errs {
+		kind := err.Err
+		for _, sentinel := range []error{ErrInvalidRow, ErrInvalidField, ErrDuplicateID, ErrUnknownAccount, ErrPhoneRegistered, ErrMissingColumn} {
+			if errors.Is(err, sentinel) {
+				kind = sentinel
+			}
+		}
+		found = append(found, importProblem{err.File, err.Line, err.Column, kind})
+	}
+	return found
+}
+
+var badDump = []string{
+	"1;+992000000001;100\r\n" +
+		"x;+992000000002;100\r\n" +
+		"3;+992000000003\r\n" +
+		"1;+992000000004;5\r\n" +
+		"5;+992000000001;5\r\n",
+	"p1;1;10;auto;INPROGRESS\r\n" +
+		"p2;9;10;auto;INPROGRESS\r\n" +
+		"p3;1;-1;auto;DONE\r\n" +
+		"p1;1;10;auto;OK\r\n",
+	"f1;1;osh;10;auto\r\n" +
+		"f2;1;osh;ten;auto\r\n",
+}
+
+var badDumpProblems = []importProblem{
+	{accountsDumpName, 2, 1, ErrInvalidField},
+	{accountsDumpName, 3, 1, ErrInvalidRow},
+	{accountsDumpName, 4, 1, ErrDuplicateID},
+	{accountsDumpName, 5, 3, ErrPhoneRegistered},
+	{paymentsDumpName, 3, 6, ErrInvalidField},
+	{paymentsDumpName, 3, 14, ErrInvalidField},
+	{paymentsDumpName, 4, 1, ErrDuplicateID},
+	{favoritesDumpName, 2, 10, ErrInvalidField},
+	{paymentsDumpName, 2, 4, ErrUnknownAccount},
+}
+
+func TestService_Import_strict(t *testing.T) {
+	dir := writeDump(t, badDump[0], badDump[1], badDump[2])
+	s := newTestService()
+
+	err := s.Import(dir)
+
+	var errs ImportErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Import(): must return ImportErrors, returned %v", err)
+	}
+	// Strict mode stops at the parse errors, before rows are checked against
+	// the stored accounts.
+	if got := problems(errs); !reflect.DeepEqual(got, badDumpProblems[:len(badDumpProblems)-1]) {
+		t.Errorf("Import(): wrong problems reported:\n got %v\nwant %v", got, badDumpProblems[:len(badDumpProblems)-1])
+	}
+
+	state, _ := s.snapshot()
+	if len(state.Accounts)+len(state.Payments)+len(state.Favorites) != 0 {
+		t.Errorf("Import(): strict import must not store anything")
+	}
+}
+
+func TestService_Import_lenient(t *testing.T) {
+	dir := writeDump(t, badDump[0], badDump[1], badDump[2])
+	s := newTestService()
+
+	report, err := s.ImportWithOptions(dir, ImportOptions{Lenient: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Accounts != 1 || report.Payments != 1 || report.Favorites != 1 {
+		t.Errorf("ImportWithOptions(): wrong counts in report %+v", report)
+	}
+	if got := problems(report.Skipped); !reflect.DeepEqual(got, badDumpProblems) {
+		t.Errorf("ImportWithOptions(): wrong rows skipped:\n got %v\nwant %v", got, badDumpProblems)
+	}
+
+	account, err := s.FindAccountByID(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance != 100 {
+		t.Errorf("ImportWithOptions(): balance must be 100, got %v", account.Balance)
+	}
+	_, err = s.FindPaymentByID("p1")
+	if err != nil {
+		t.Errorf("ImportWithOptions(): valid payment must be stored, error = %v", err)
+	}
+}
+
+func TestService_Import_existingAccount(t *testing.T) {
+	s := newTestService()
+	account, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := writeDump(t, "", "p1;1;10;auto;INPROGRESS\r\n", "")
+	err = s.Import(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payment, err := s.FindPaymentByID("p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.AccountID != account.ID {
+		t.Errorf("Import(): payment must belong to account %v, got %v", account.ID, payment.AccountID)
+	}
+}
+
+// newMergeTarget returns a service with accounts 1 and 2 and a payment p1 of
+// account 1, and a dump that matches account 1 by phone under ID 7, repeats
+// account 2, changes p1, and adds account 9 and payment p2.
+func newMergeTarget(t *testing.T) (*testService, string) {
+	t.Helper()
+
+	s := newTestService()
+	err := s.store().Update(func(tx Tx) error {
+		err := tx.Accounts().Save(&types.Account{ID: 1, Phone: "+992000000001", Balance: 100})
+		if err != nil {
+			return err
+		}
+		err = tx.Accounts().Save(&types.Account{ID: 2, Phone: "+992000000002", Balance: 50})
+		if err != nil {
+			return err
+		}
+		return tx.Payments().Save(&types.Payment{ID: "p1", AccountID: 1, Amount: 10, Category: "auto", Status: types.PaymentStatusOK})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := writeDump(t,
+		"7;+992000000001;300\r\n"+
+			"2;+992000000002;50\r\n"+
+			"9;+992000000009;5\r\n",
+		"p1;7;20;auto;OK\r\n"+
+			"p2;7;30;auto;OK\r\n",
+		"")
+	return s, dir
+}
+
+func TestService_Import_failOnConflict(t *testing.T) {
+	s, dir := newMergeTarget(t)
+
+	_, err := s.ImportWithOptions(dir, ImportOptions{Mode: ImportFailOnConflict})
+
+	var errs ImportErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("ImportWithOptions(): must return ImportErrors, returned %v", err)
+	}
+	if len(errs) == 0 || !errors.Is(errs[0], ErrImportConflict) || errs[0].Line != 1 || errs[0].Column != 3 {
+		t.Errorf("ImportWithOptions(): must report the phone conflict first, got %v", errs)
+	}
+
+	account, err := s.FindAccountByID(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance != 100 {
+		t.Errorf("ImportWithOptions(): conflict must not change anything, balance %v", account.Balance)
+	}
+	_, err = s.FindAccountByID(9)
+	if err != ErrAccountNotFound {
+		t.Errorf("ImportWithOptions(): conflict must not store new accounts, error = %v", err)
+	}
+}
+
+func TestService_Import_modes(t *testing.T) {
+	tests := []struct {
+		mode        ImportMode
+		report      ImportReport
+		account     types.Account
+		p1          types.Payment
+		p2AccountID int64
+	}{{
+		mode:        ImportMergeSkipExisting,
+		report:      ImportReport{Accounts: 1, Payments: 1, Existing: 3},
+		account:     types.Account{ID: 1, Phone: "+992000000001", Currency: types.DefaultCurrency, Balance: 100},
+		p1:          types.Payment{ID: "p1", AccountID: 1, Amount: 10, Currency: types.DefaultCurrency, Category: "auto", Status: types.PaymentStatusOK},
+		p2AccountID: 1,
+	}, {
+		mode:        ImportMergeOverwrite,
+		report:      ImportReport{Accounts: 2, Payments: 2, Existing: 1},
+		account:     types.Account{ID: 1, Phone: "+992000000001", Currency: types.DefaultCurrency, Balance: 300},
+		p1:          types.Payment{ID: "p1", AccountID: 1, Amount: 20, Currency: types.DefaultCurrency, Category: "auto", Status: types.PaymentStatusOK, Direction: types.PaymentDirectionOut},
+		p2AccountID: 1,
+	}, {
+		mode:        ImportReplace,
+		report:      ImportReport{Accounts: 3, Payments: 2},
+		account:     types.Account{ID: 7, Phone: "+992000000001", Currency: types.DefaultCurrency, Balance: 300},
+		p1:          types.Payment{ID: "p1", AccountID: 7, Amount: 20, Currency: types.DefaultCurrency, Category: "auto", Status: types.PaymentStatusOK, Direction: types.PaymentDirectionOut},
+		p2AccountID: 7,
+	}}
+
+	for _, test := range tests {
+		s, dir := newMergeTarget(t)
+
+		report, err := s.ImportWithOptions(dir, ImportOptions{Mode: test.mode})
+		if err != nil {
+			t.Errorf("ImportWithOptions(%v): error = %v", test.mode, err)
+			continue
+		}
+		if !reflect.DeepEqual(*report, test.report) {
+			t.Errorf("ImportWithOptions(%v): wrong report %+v, want %+v", test.mode, *report, test.report)
+		}
+
+		err = s.store().View(func(tx Tx) error {
+			account, err := tx.Accounts().ByPhone("+992000000001", types.DefaultCurrency)
+			if err != nil {
+				return err
+			}
+			if *account != test.account {
+				t.Errorf("ImportWithOptions(%v): wrong account %+v, want %+v", test.mode, *account, test.account)
+			}
+			if test.mode == ImportReplace && len(tx.Accounts().All()) != 3 {
+				t.Errorf("ImportWithOptions(%v): must drop existing accounts, got %v", test.mode, len(tx.Accounts().All()))
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p1, err := s.FindPaymentByID("p1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *p1 != test.p1 {
+			t.Errorf("ImportWithOptions(%v): wrong payment %+v, want %+v", test.mode, *p1, test.p1)
+		}
+		p2, err := s.FindPaymentByID("p2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p2.AccountID != test.p2AccountID {
+			t.Errorf("ImportWithOptions(%v): p2 must belong to account %v, got %v", test.mode, test.p2AccountID, p2.AccountID)
+		}
+
+		next, err := s.RegisterAccount("+992000000010")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next.ID != 10 {
+			t.Errorf("ImportWithOptions(%v): next account id must be 10, got %v", test.mode, next.ID)
+		}
+	}
+}
+
+func TestService_ImportWithOptions_replaceDropsOrphans(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	s := newTestServiceWith(storage)
+	old := s.mustAddAccount(t, testAccount{phone: "+992000000001", balance: 100})
+	hold, err := s.Authorize(old.ID, 60, "hotel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Idempotent("k").Pay(old.ID, 10, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.ImportWithOptions(writeDump(t, "", "", ""), ImportOptions{Mode: ImportReplace})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account := s.mustAddAccount(t, testAccount{phone: "+992000000002", balance: 100})
+	if account.ID == old.ID {
+		t.Errorf("RegisterAccount(): must not reuse the ID %d of a replaced account", old.ID)
+	}
+	checkBalances(t, s.Service, "ImportWithOptions()", map[int64]testBalance{account.ID: {100, 100}})
+	_, err = s.Capture(hold.ID, 50)
+	if err != ErrHoldNotFound {
+		t.Errorf("Capture(): must return ErrHoldNotFound for a hold of a replaced account, returned %v", err)
+	}
+	payment, err := s.Idempotent("k").Pay(account.ID, 10, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.FindPaymentByID(payment.ID)
+	if err != nil {
+		t.Errorf("Pay(): a key used before the import must make a new payment, error = %v", err)
+	}
+
+	err = storage.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStoredBalances(t, dir, "OpenFileStorage()", map[int64]testBalance{account.ID: {90, 90}})
+}
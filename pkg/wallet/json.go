@@ -0,0 +1,247 @@
+package wallet
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/darkside1809/wallet/pkg/types"
+)
+
+var ErrInvalidJSON = errors.New("invalid wallet JSON")
+
+// ExportJSON writes the whole state as one JSON object:
+//
+//	{"nextAccountId":2,
+//	"accounts":[{"id":1,"phone":"+992000000001","currency":"TJS","balance":100}],
+//	"payments":[...],
+//	"favorites":[...]}
+//
+// Records are encoded one at a time as they are written, so the document is
+// never held in memory as a whole.
+func (s *Service) ExportJSON(w io.Writer) error {
+	state, err := s.snapshot()
+	if err != nil {
+		return err
+	}
+
+	buffered := bufio.NewWriter(w)
+	encoder := &jsonWriter{w: buffered}
+
+	encoder.raw(`{"nextAccountId":`)
+	encoder.value(state.LastAccountID + 1)
+	encoder.raw(`,` + "\n" + `"accounts":[`)
+	for i, account := range state.Accounts {
+		encoder.element(i, account)
+	}
+	encoder.raw(`],` + "\n" + `"payments":[`)
+	for i, payment := range state.Payments {
+		encoder.element(i, payment)
+	}
+	encoder.raw(`],` + "\n" + `"favorites":[`)
+	for i, favorite := range state.Favorites {
+		encoder.element(i, favorite)
+	}
+	encoder.raw("]}\n")
+
+	if encoder.err != nil {
+		return encoder.err
+	}
+	return buffered.Flush()
+}
+
+// jsonWriter writes a JSON document piece by piece, keeping the first error.
+type jsonWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (w *jsonWriter) raw(s string) {
+	if w.err == nil {
+		_, w.err = w.w.WriteString(s)
+	}
+}
+
+func (w *jsonWriter) value(v interface{}) {
+	if w.err != nil {
+		return
+	}
+
+	content, err := json.Marshal(v)
+	if err != nil {
+		w.err = err
+		return
+	}
+	_, w.err = w.w.Write(content)
+}
+
+// element writes the i-th element of an array on a line of its own.
+func (w *jsonWriter) element(i int, v interface{}) {
+	if i > 0 {
+		w.raw(",")
+	}
+	w.raw("\n")
+	w.value(v)
+}
+
+// ImportJSON replaces the accounts, payments and favorites with the document
+// written by ExportJSON and rebuilds the ledger from the balances. Holds,
+// refunds and transitions of the records it carries are kept, as Tx.Clear
+// describes. Records are decoded and stored one at a time in a single
+// transaction, which keeps the storage locked while r is read. Nothing is
+// stored unless the document is valid: well-formed, without unknown fields,
+// duplicate IDs or phones, and with every payment and favorite belonging to
+// an account of the document.
+func (s *Service) ImportJSON(r io.Reader) error {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+
+	return s.store().Update(func(tx Tx) error {
+		err := tx.Clear()
+		if err != nil {
+			return err
+		}
+
+		return (&jsonImporter{loader: stateLoader{tx: tx, now: s.now()}, decoder: decoder}).run()
+	})
+}
+
+// jsonImporter stores the records of a JSON document as they are decoded.
+type jsonImporter struct {
+	loader  stateLoader
+	decoder *json.Decoder
+}
+
+func (d *jsonImporter) run() error {
+	err := d.delim('{')
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for d.decoder.More() {
+		token, err := d.decoder.Token()
+		if err != nil {
+			return d.syntaxError(err)
+		}
+		key, _ := token.(string)
+		if seen[key] {
+			return fmt.Errorf("%w: duplicate key %q", ErrInvalidJSON, key)
+		}
+		seen[key] = true
+
+		switch key {
+		case "nextAccountId":
+			err = d.nextAccountID()
+		case "accounts":
+			err = d.array(key, d.account)
+		case "payments":
+			err = d.array(key, d.payment)
+		case "favorites":
+			err = d.array(key, d.favorite)
+		default:
+			err = fmt.Errorf("%w: unknown key %q", ErrInvalidJSON, key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err = d.delim('}')
+	if err != nil {
+		return err
+	}
+	_, err = d.decoder.Token()
+	if err != io.EOF {
+		return fmt.Errorf("%w: data after the document", ErrInvalidJSON)
+	}
+
+	return d.loader.checkAccounts()
+}
+
+func (d *jsonImporter) syntaxError(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("%w: offset %d: %v", ErrInvalidJSON, d.decoder.InputOffset(), err)
+}
+
+func (d *jsonImporter) delim(want json.Delim) error {
+	token, err := d.decoder.Token()
+	if err != nil {
+		return d.syntaxError(err)
+	}
+	if token != want {
+		return fmt.Errorf("%w: offset %d: want %v, got %v", ErrInvalidJSON, d.decoder.InputOffset(), want, token)
+	}
+
+	return nil
+}
+
+// array decodes the elements of the array under key one by one with decode.
+func (d *jsonImporter) array(key string, decode func() error) error {
+	err := d.delim('[')
+	if err != nil {
+		return err
+	}
+
+	for i := 0; d.decoder.More(); i++ {
+		err := decode()
+		if err != nil {
+			return fmt.Errorf("%s[%d]: %w", key, i, err)
+		}
+	}
+
+	return d.delim(']')
+}
+
+func (d *jsonImporter) decode(v interface{}) error {
+	err := d.decoder.Decode(v)
+	if err != nil {
+		return d.syntaxError(err)
+	}
+
+	return nil
+}
+
+func (d *jsonImporter) nextAccountID() error {
+	var next int64
+	err := d.decode(&next)
+	if err != nil {
+		return err
+	}
+
+	return d.loader.reserve(next)
+}
+
+func (d *jsonImporter) account() error {
+	account := &types.Account{}
+	err := d.decode(account)
+	if err != nil {
+		return err
+	}
+
+	return d.loader.account(account)
+}
+
+func (d *jsonImporter) payment() error {
+	payment := &types.Payment{}
+	err := d.decode(payment)
+	if err != nil {
+		return err
+	}
+
+	return d.loader.payment(payment)
+}
+
+func (d *jsonImporter) favorite() error {
+	favorite := &types.Favorite{}
+	err := d.decode(favorite)
+	if err != nil {
+		return err
+	}
+
+	return d.loader.favorite(favorite)
+}
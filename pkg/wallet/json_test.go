@@ -0,0 +1,142 @@
+package wallet
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestService_ExportJSON_roundTrip(t *testing.T) {
+	s := newExportedService(t)
+	// Favorite names and categories may hold the separators of the text
+	// dumps.
+	_, err := s.FavoritePayment(s.allPayments()[0].ID, "osh; plov|manti\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	err = s.ExportJSON(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported := newTestService()
+	_, err = imported.RegisterAccount("+992000000099")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = imported.ImportJSON(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, _ := s.snapshot()
+	got, _ := imported.snapshot()
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("ImportJSON(): state doesn't match the exported one:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestService_ImportJSON_nextAccountID(t *testing.T) {
+	s := newTestService()
+
+	err := s.ImportJSON(strings.NewReader(`{"nextAccountId":100,"accounts":[{"id":7,"phone":"+992000000007","balance":5}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.ID != 100 {
+		t.Errorf("ImportJSON(): next account id must be 100, got %v", account.ID)
+	}
+}
+
+func TestService_ImportJSON_keepsHolds(t *testing.T) {
+	s := newTestService()
+	account, err := s.RegisterAccount("+992000000001")
+	if err == nil {
+		err = s.Deposit(account.ID, 100)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment, err := s.Pay(account.ID, 10, "auto")
+	if err == nil {
+		err = s.Reject(payment.ID)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	hold, err := s.Authorize(account.ID, 30, "hotel")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	err = s.ExportJSON(buf)
+	if err == nil {
+		err = s.ImportJSON(buf)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.FindAccountByID(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Balance != 100 || got.Available != 70 {
+		t.Errorf("ImportJSON(): hold must survive, got balance %d, available %d", got.Balance, got.Available)
+	}
+	transitions, err := s.Transitions(payment.ID)
+	if err != nil || len(transitions) != 2 {
+		t.Errorf("ImportJSON(): transitions must survive, got %v, error = %v", transitions, err)
+	}
+	_, err = s.Capture(hold.ID, 30)
+	if err != nil {
+		t.Errorf("Capture(): must capture a hold kept by the import, error = %v", err)
+	}
+}
+
+func TestService_ImportJSON_fail(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		err  error
+	}{
+		{"truncated", `{"accounts":[{"id":1,"phone":"+992000000001","balance":5}`, ErrInvalidJSON},
+		{"trailing data", `{"accounts":[]} {}`, ErrInvalidJSON},
+		{"not an object", `[]`, ErrInvalidJSON},
+		{"unknown key", `{"accounts":[],"owners":[]}`, ErrInvalidJSON},
+		{"unknown field", `{"accounts":[{"id":1,"phone":"+992000000001","owner":"me"}]}`, ErrInvalidJSON},
+		{"invalid id", `{"accounts":[{"id":0,"phone":"+992000000001"}]}`, ErrInvalidField},
+		{"duplicate id", `{"accounts":[{"id":1,"phone":"+992000000001"},{"id":1,"phone":"+992000000002"}]}`, ErrDuplicateID},
+		{"duplicate phone", `{"accounts":[{"id":1,"phone":"+992000000001"},{"id":2,"phone":"+992000000001"}]}`, ErrPhoneRegistered},
+		{"unknown status", `{"payments":[{"id":"p1","accountId":1,"amount":1,"status":"DONE"}]}`, ErrInvalidField},
+		{"unknown account", `{"accounts":[{"id":1,"phone":"+992000000001"}],"payments":[{"id":"p1","accountId":2,"amount":1,"status":"OK"}]}`, ErrUnknownAccount},
+	}
+
+	for _, test := range tests {
+		s := newTestService()
+		_, err := s.RegisterAccount("+992000000099")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = s.ImportJSON(strings.NewReader(test.doc))
+		if !errors.Is(err, test.err) {
+			t.Errorf("ImportJSON(%s): must return %v, returned %v", test.name, test.err, err)
+		}
+
+		account, err := s.FindAccountByID(1)
+		if err != nil || account.Phone != "+992000000099" {
+			t.Errorf("ImportJSON(%s): must not change the state, got %v, %v", test.name, account, err)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darkside1809/wallet/pkg/types"
+)
+
+var ErrLedgerImbalance = errors.New("ledger debits don't equal credits")
+var ErrBalanceDrift = errors.New("balance drifted from the ledger")
+
+// System ledger accounts, on the other side of every entry posted to the
+// ledger account of a wallet account. There is one of each per currency,
+// named by CurrencyLedger.
+const (
+	// LedgerCash is debited with the money deposited into the wallet.
+	LedgerCash = "system:cash"
+	// LedgerPayments is credited with the money paid out of the wallet and
+	// debited with what is refunded.
+	LedgerPayments = "system:payments"
+	// LedgerAdjustments balances the entries that bring the ledger in line
+	// with balances imported without their history.
+	LedgerAdjustments = "system:adjustments"
+)
+
+const accountLedgerPrefix = "account:"
+
+// CurrencyLedger returns the system ledger account holding the currency.
+// Those of DefaultCurrency keep their plain names, which they had before
+// there were other currencies.
+func CurrencyLedger(ledger string, currency types.Currency) string {
+	if currency == types.DefaultCurrency {
+		return ledger
+	}
+	return ledger + ":" + string(currency)
+}
+
+// AccountLedger returns the ledger account of a wallet account. Its balance,
+// credits minus debits, is the balance of the wallet account.
+func AccountLedger(accountID int64) string {
+	return accountLedgerPrefix + strconv.FormatInt(accountID, 10)
+}
+
+// LedgerBalance returns the balance of an account derived from the ledger.
+func (s *Service) LedgerBalance(accountID int64) (types.Money, error) {
+	var balance types.Money
+
+	err := s.store().View(func(tx Tx) error {
+		_, err := tx.Accounts().ByID(accountID)
+		if err != nil {
+			return err
+		}
+
+		balance = tx.Ledger().Balance(AccountLedger(accountID))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return balance, nil
+}
+
+// CheckLedger verifies the ledger against its invariants: every transaction
+// debits as much as it credits, so total debits equal total credits in every
+// currency, transactions only post to accounts in their currency, and the
+// balance of every account equals the balance of its ledger account. It
+// returns an error wrapping ErrLedgerImbalance, ErrCurrencyMismatch or
+// ErrBalanceDrift for the first violation found.
+func (s *Service) CheckLedger() error {
+	return s.store().View(func(tx Tx) error {
+		currencies := map[string]types.Currency{}
+		for _, account := range tx.Accounts().All() {
+			currencies[AccountLedger(account.ID)] = account.Currency
+		}
+
+		balances := map[string]types.Money{}
+		debits, credits := map[types.Currency]types.Money{}, map[types.Currency]types.Money{}
+		for _, transaction := range tx.Ledger().All() {
+			debit, credit := types.Money(0), types.Money(0)
+			for _, entry := range transaction.Entries {
+				if entry.Debit < 0 || entry.Credit < 0 {
+					return fmt.Errorf("%w: transaction %d posts a negative amount to %s", ErrLedgerImbalance, transaction.ID, entry.Account)
+				}
+				if currency, ok := currencies[entry.Account]; ok && currency != transaction.Currency {
+					return fmt.Errorf("%w: transaction %d posts %s to %s held in %s", ErrCurrencyMismatch, transaction.ID, transaction.Currency, entry.Account, currency)
+				}
+				debit += entry.Debit
+				credit += entry.Credit
+				balances[entry.Account] += entry.Credit - entry.Debit
+			}
+			if debit != credit {
+				return fmt.Errorf("%w: transaction %d debits %d, credits %d", ErrLedgerImbalance, transaction.ID, debit, credit)
+			}
+			debits[transaction.Currency] += debit
+			credits[transaction.Currency] += credit
+		}
+		for currency := range debits {
+			if debits[currency] != credits[currency] {
+				return fmt.Errorf("%w: total debits %d %s, credits %d %s", ErrLedgerImbalance, debits[currency], currency, credits[currency], currency)
+			}
+		}
+
+		ledgerAccounts := make([]string, 0, len(balances))
+		for account := range balances {
+			ledgerAccounts = append(ledgerAccounts, account)
+		}
+		sort.Strings(ledgerAccounts)
+		for _, account := range ledgerAccounts {
+			if tx.Ledger().Balance(account) != balances[account] {
+				return fmt.Errorf("%w: %s holds %d, its entries add up to %d", ErrBalanceDrift, account, tx.Ledger().Balance(account), balances[account])
+			}
+		}
+
+		accounts := map[string]bool{}
+		for _, account := range tx.Accounts().All() {
+			ledger := AccountLedger(account.ID)
+			accounts[ledger] = true
+			if account.Balance != balances[ledger] {
+				return fmt.Errorf("%w: account %d holds %d, ledger %d", ErrBalanceDrift, account.ID, account.Balance, balances[ledger])
+			}
+		}
+		for _, account := range ledgerAccounts {
+			if strings.HasPrefix(account, accountLedgerPrefix) && !accounts[account] && balances[account] != 0 {
+				return fmt.Errorf("%w: %s holds %d without an account", ErrBalanceDrift, account, balances[account])
+			}
+		}
+
+		return nil
+	})
+}
+
+// postTransfer posts a transaction moving the amount from the debited ledger
+// account to the credited one, both in the currency of the amount.
+func postTransfer(tx Tx, kind types.LedgerKind, reference string, at time.Time, debit string, credit string, amount types.Amount) error {
+	return tx.Ledger().Post(&types.LedgerTransaction{
+		Kind:      kind,
+		Currency:  amount.Currency,
+		Reference: reference,
+		At:        at,
+		Entries: []types.LedgerEntry{
+			{Account: debit, Debit: amount.Value},
+			{Account: credit, Credit: amount.Value},
+		},
+	})
+}
+
+// adjustLedger posts the difference between the balance of an account and
+// that of its ledger account, so balances stored without their history, as
+// by imports, still reconcile.
+func adjustLedger(tx Tx, account *types.Account, at time.Time) error {
+	ledger := AccountLedger(account.ID)
+	adjustments := CurrencyLedger(LedgerAdjustments, account.Currency)
+	difference := account.Balance - tx.Ledger().Balance(ledger)
+	switch {
+	case difference > 0:
+		return postTransfer(tx, types.LedgerKindAdjustment, "", at, adjustments, ledger, types.Amount{Value: difference, Currency: account.Currency})
+	case difference < 0:
+		return postTransfer(tx, types.LedgerKindAdjustment, "", at, ledger, adjustments, types.Amount{Value: -difference, Currency: account.Currency})
+	}
+
+	return nil
+}
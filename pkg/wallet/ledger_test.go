@@ -0,0 +1,224 @@
+package wallet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/darkside1809/wallet/pkg/types"
+)
+
+func TestService_Ledger(t *testing.T) {
+	s := newTestService()
+	account, payments, err := s.addAccount(testAccount{
+		phone:   "+992000000001",
+		balance: 100,
+		payments: []struct {
+			amount   types.Money
+			category types.PaymentCategory
+		}{{amount: 30, category: "auto"}},
+	})
+	if err == nil {
+		err = s.Confirm(payments[0].ID)
+	}
+	if err == nil {
+		_, err = s.Refund(payments[0].ID, 10, "returned")
+	}
+	var rejected *types.Payment
+	if err == nil {
+		rejected, err = s.Pay(account.ID, 20, "food")
+	}
+	if err == nil {
+		err = s.Reject(rejected.ID)
+	}
+	if err == nil {
+		account, err = s.FindAccountByID(account.ID)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.CheckLedger()
+	if err != nil {
+		t.Errorf("CheckLedger(): error = %v", err)
+	}
+
+	balance, err := s.LedgerBalance(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance != 80 || balance != account.Balance {
+		t.Errorf("LedgerBalance(): got %d, account holds %d, want 80", balance, account.Balance)
+	}
+
+	var kinds []types.LedgerKind
+	err = s.store().View(func(tx Tx) error {
+		if cash := tx.Ledger().Balance(LedgerCash); cash != -100 {
+			t.Errorf("Deposit(): %s must hold -100, got %d", LedgerCash, cash)
+		}
+		if paid := tx.Ledger().Balance(LedgerPayments); paid != 20 {
+			t.Errorf("Pay(): %s must hold 20, got %d", LedgerPayments, paid)
+		}
+		for _, transaction := range tx.Ledger().All() {
+			kinds = append(kinds, transaction.Kind)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []types.LedgerKind{
+		types.LedgerKindDeposit,
+		types.LedgerKindPayment,
+		types.LedgerKindRefund,
+		types.LedgerKindPayment,
+		types.LedgerKindReversal,
+	}
+	if len(kinds) != len(want) {
+		t.Fatalf("ledger: got %v, want %v", kinds, want)
+	}
+	for i := range want {
+		if kinds[i] != want[i] {
+			t.Errorf("ledger: got %v, want %v", kinds, want)
+			break
+		}
+	}
+
+	_, err = s.LedgerBalance(100)
+	if err != ErrAccountNotFound {
+		t.Errorf("LedgerBalance(): must return ErrAccountNotFound, returned %v", err)
+	}
+}
+
+func TestService_CheckLedger_violations(t *testing.T) {
+	violations := map[string]func(tx Tx, account *types.Account) error{
+		"unbalanced transaction": func(tx Tx, account *types.Account) error {
+			return tx.Ledger().Post(&types.LedgerTransaction{
+				Kind: types.LedgerKindDeposit,
+				Entries: []types.LedgerEntry{
+					{Account: LedgerCash, Debit: 5},
+					{Account: AccountLedger(account.ID), Credit: 6},
+				},
+			})
+		},
+		"negative entry": func(tx Tx, account *types.Account) error {
+			return tx.Ledger().Post(&types.LedgerTransaction{
+				Kind: types.LedgerKindDeposit,
+				Entries: []types.LedgerEntry{
+					{Account: LedgerCash, Debit: -5},
+					{Account: AccountLedger(account.ID), Credit: -5},
+				},
+			})
+		},
+		"changed balance": func(tx Tx, account *types.Account) error {
+			account.Balance++
+			return tx.Accounts().Save(account)
+		},
+		"ledger without account": func(tx Tx, account *types.Account) error {
+			return postTransfer(tx, types.LedgerKindDeposit, "", time.Time{}, LedgerCash, AccountLedger(account.ID+1), types.Amount{Value: 5, Currency: types.DefaultCurrency})
+		},
+	}
+	want := map[string]error{
+		"unbalanced transaction": ErrLedgerImbalance,
+		"negative entry":         ErrLedgerImbalance,
+		"changed balance":        ErrBalanceDrift,
+		"ledger without account": ErrBalanceDrift,
+	}
+
+	for name, violate := range violations {
+		s := newTestService()
+		account := s.mustAddAccount(t, defaultTestAccount)
+		err := s.store().Update(func(tx Tx) error {
+			return violate(tx, account)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = s.CheckLedger()
+		if !errors.Is(err, want[name]) {
+			t.Errorf("CheckLedger(%s): must return %v, returned %v", name, want[name], err)
+		}
+	}
+}
+
+func TestService_CheckLedger_imports(t *testing.T) {
+	s := newTestService()
+	account := s.mustAddAccount(t, defaultTestAccount)
+	state := &bytes.Buffer{}
+	err := s.ExportJSON(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported := newTestService()
+	err = imported.ImportJSON(bytes.NewReader(readGoldenState(t, "state.json")))
+	if err == nil {
+		err = imported.ImportJSON(bytes.NewReader(state.Bytes()))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = imported.CheckLedger()
+	if err != nil {
+		t.Errorf("ImportJSON(): CheckLedger() error = %v", err)
+	}
+	balance, err := imported.LedgerBalance(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != account.Balance {
+		t.Errorf("ImportJSON(): ledger balance must be %d, got %d", account.Balance, balance)
+	}
+
+	dir := t.TempDir()
+	err = s.Export(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Deposit(account.ID, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.ImportWithOptions(dir, ImportOptions{Mode: ImportMergeOverwrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.CheckLedger()
+	if err != nil {
+		t.Errorf("ImportWithOptions(): CheckLedger() error = %v", err)
+	}
+}
+
+func TestService_Ledger_persisted(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := newTestServiceWith(storage).mustAddAccount(t, defaultTestAccount)
+	err = storage.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err = OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	s := NewService(storage)
+	err = s.CheckLedger()
+	if err != nil {
+		t.Errorf("CheckLedger(): error = %v after reopening", err)
+	}
+	balance, err := s.LedgerBalance(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != account.Balance {
+		t.Errorf("LedgerBalance(): must be %d after reopening, got %d", account.Balance, balance)
+	}
+}
@@ -0,0 +1,193 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/darkside1809/wallet/pkg/types"
+)
+
+var ErrIllegalTransition = errors.New("illegal payment transition")
+
+// TransitionError reports a transition the payment lifecycle doesn't allow.
+// It matches ErrIllegalTransition with errors.Is.
+type TransitionError struct {
+	PaymentID string
+	From      types.PaymentStatus
+	To        types.PaymentStatus
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("payment %s: can't move from %s to %s", e.PaymentID, e.From, e.To)
+}
+
+func (e *TransitionError) Is(target error) bool {
+	return target == ErrIllegalTransition
+}
+
+// paymentTransitions holds the statuses every status can move to. A payment
+// is made in progress and then settles exactly once: it is confirmed,
+// rejected, or expires. Settled statuses are final.
+var paymentTransitions = map[types.PaymentStatus][]types.PaymentStatus{
+	types.PaymentStatusInProgress: {
+		types.PaymentStatusOK,
+		types.PaymentStatusFail,
+		types.PaymentStatusExpired,
+	},
+	types.PaymentStatusOK:      nil,
+	types.PaymentStatusFail:    nil,
+	types.PaymentStatusExpired: nil,
+}
+
+// validPaymentStatus tells if the status is known to the lifecycle.
+func validPaymentStatus(status types.PaymentStatus) bool {
+	_, ok := paymentTransitions[status]
+	return ok
+}
+
+// canTransition tells if a payment may move from one status to another.
+func canTransition(from types.PaymentStatus, to types.PaymentStatus) bool {
+	for _, allowed := range paymentTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Confirm settles an in-progress payment as successful. The account was
+// already debited when the payment was made.
+func (s *Service) Confirm(paymentID string) error {
+	return s.update("Confirm", []interface{}{paymentID}, nil, func(tx Tx) error {
+		_, err := s.settle(tx, paymentID, types.PaymentStatusOK)
+		return err
+	})
+}
+
+// Reject settles an in-progress payment as failed and refunds its amount to
+// the account.
+func (s *Service) Reject(paymentID string) error {
+	return s.update("Reject", []interface{}{paymentID}, nil, func(tx Tx) error {
+		payment, err := s.settle(tx, paymentID, types.PaymentStatusFail)
+		if err != nil {
+			return err
+		}
+
+		return s.refundAll(tx, payment, RefundReasonRejected)
+	})
+}
+
+// Expire settles an in-progress payment that was never confirmed and refunds
+// its amount to the account.
+func (s *Service) Expire(paymentID string) error {
+	return s.update("Expire", []interface{}{paymentID}, nil, func(tx Tx) error {
+		payment, err := s.settle(tx, paymentID, types.PaymentStatusExpired)
+		if err != nil {
+			return err
+		}
+
+		return s.refundAll(tx, payment, RefundReasonExpired)
+	})
+}
+
+// Transitions returns the status transitions of a payment in order, starting
+// with it being made.
+func (s *Service) Transitions(paymentID string) ([]types.PaymentTransition, error) {
+	var transitions []types.PaymentTransition
+
+	err := s.store().View(func(tx Tx) error {
+		_, err := tx.Payments().ByID(paymentID)
+		if err != nil {
+			return err
+		}
+
+		for _, transition := range tx.Transitions().ByPayment(paymentID) {
+			transitions = append(transitions, *transition)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return transitions, nil
+}
+
+// settle moves a payment to the status, along with the other payment of its
+// transfer if it has one, and returns the saved payment that took the money
+// out.
+func (s *Service) settle(tx Tx, paymentID string, to types.PaymentStatus) (*types.Payment, error) {
+	at := s.now()
+	payment, err := s.transition(tx, paymentID, to, at)
+	if err != nil || payment.LinkedID == "" {
+		return payment, err
+	}
+
+	linked, err := s.transition(tx, payment.LinkedID, to, at)
+	if err != nil {
+		return nil, err
+	}
+	if payment.Direction == types.PaymentDirectionIn {
+		return linked, nil
+	}
+	return payment, nil
+}
+
+// transition moves a payment to the status at the time if the lifecycle
+// allows it, records the transition and returns the saved payment.
+func (s *Service) transition(tx Tx, paymentID string, to types.PaymentStatus, at time.Time) (*types.Payment, error) {
+	payment, err := tx.Payments().ByID(paymentID)
+	if err != nil {
+		return nil, err
+	}
+	if !canTransition(payment.Status, to) {
+		return nil, &TransitionError{PaymentID: paymentID, From: payment.Status, To: to}
+	}
+
+	from := payment.Status
+	payment.Status = to
+	payment.UpdatedAt = at
+	if len(paymentTransitions[to]) == 0 {
+		payment.SettledAt = payment.UpdatedAt
+	}
+
+	err = tx.Payments().Save(payment)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.recordTransition(tx, payment, from)
+	if err != nil {
+		return nil, err
+	}
+
+	return payment, nil
+}
+
+// recordTransition records the move of a saved payment to its status.
+func (s *Service) recordTransition(tx Tx, payment *types.Payment, from types.PaymentStatus) error {
+	return tx.Transitions().Add(&types.PaymentTransition{
+		PaymentID: payment.ID,
+		From:      from,
+		To:        payment.Status,
+		At:        payment.UpdatedAt,
+	})
+}
+
+// refundAll returns what is left of a payment to its account, reversing it
+// in the ledger.
+func (s *Service) refundAll(tx Tx, payment *types.Payment, reason string) error {
+	if payment.LinkedID != "" {
+		return s.reverseTransfer(tx, payment, reason)
+	}
+
+	left := payment.Amount - payment.Refunded
+	if left == 0 {
+		return nil
+	}
+
+	_, err := s.refund(tx, payment, left, reason, types.LedgerKindReversal)
+	return err
+}
@@ -0,0 +1,148 @@
+package wallet
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/darkside1809/wallet/pkg/types"
+	"github.com/darkside1809/wallet/pkg/wallet/wallettest"
+)
+
+// lifecycleActions moves a payment to the status each of them is named after.
+var lifecycleActions = map[types.PaymentStatus]func(s *Service, paymentID string) error{
+	types.PaymentStatusOK:      (*Service).Confirm,
+	types.PaymentStatusFail:    (*Service).Reject,
+	types.PaymentStatusExpired: (*Service).Expire,
+}
+
+// lifecycleTestAccount makes a payment of 30 out of 100.
+var lifecycleTestAccount = testAccount{
+	phone:   "+992000000001",
+	balance: 100,
+	payments: []struct {
+		amount   types.Money
+		category types.PaymentCategory
+	}{{amount: 30, category: "auto"}},
+}
+
+func TestService_lifecycle(t *testing.T) {
+	for from := range paymentTransitions {
+		for to, action := range lifecycleActions {
+			s := newTestService()
+			_, payments, err := s.addAccount(lifecycleTestAccount)
+			if err == nil && from != types.PaymentStatusInProgress {
+				err = lifecycleActions[from](s.Service, payments[0].ID)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			payment := payments[0]
+			before, _ := s.FindAccountByID(payment.AccountID)
+			transitions, _ := s.Transitions(payment.ID)
+
+			err = action(s.Service, payment.ID)
+
+			after, _ := s.FindAccountByID(payment.AccountID)
+			saved, _ := s.FindPaymentByID(payment.ID)
+			recorded, _ := s.Transitions(payment.ID)
+
+			if !canTransition(from, to) {
+				transitionErr := &TransitionError{}
+				if !errors.As(err, &transitionErr) || !errors.Is(err, ErrIllegalTransition) {
+					t.Errorf("%s to %s: must return TransitionError, returned %v", from, to, err)
+					continue
+				}
+				if *transitionErr != (TransitionError{PaymentID: payment.ID, From: from, To: to}) {
+					t.Errorf("%s to %s: wrong error %+v", from, to, transitionErr)
+				}
+				if saved.Status != from || after.Balance != before.Balance || len(recorded) != len(transitions) {
+					t.Errorf("%s to %s: must change nothing, got %+v, %+v", from, to, saved, after)
+				}
+				continue
+			}
+
+			if err != nil {
+				t.Errorf("%s to %s: error = %v", from, to, err)
+				continue
+			}
+			if saved.Status != to || saved.SettledAt.IsZero() {
+				t.Errorf("%s to %s: wrong payment %+v", from, to, saved)
+			}
+			refund := types.Money(0)
+			if to != types.PaymentStatusOK {
+				refund = payment.Amount
+			}
+			if after.Balance != before.Balance+refund {
+				t.Errorf("%s to %s: balance must be %d, got %d", from, to, before.Balance+refund, after.Balance)
+			}
+			if len(recorded) != len(transitions)+1 || recorded[len(recorded)-1].From != from || recorded[len(recorded)-1].To != to {
+				t.Errorf("%s to %s: transition not recorded, got %+v", from, to, recorded)
+			}
+		}
+	}
+}
+
+func TestService_lifecycle_unknownPayment(t *testing.T) {
+	s := newTestService()
+
+	for to, action := range lifecycleActions {
+		err := action(s.Service, "unknown")
+		if err != ErrPaymentNotFound {
+			t.Errorf("to %s: must return ErrPaymentNotFound, returned %v", to, err)
+		}
+	}
+
+	_, err := s.Transitions("unknown")
+	if err != ErrPaymentNotFound {
+		t.Errorf("Transitions(): must return ErrPaymentNotFound, returned %v", err)
+	}
+}
+
+func TestService_Transitions(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewService(storage, WithClock(wallettest.NewClock(testStart, time.Minute)))
+	account, err := s.RegisterAccount("+992000000001")
+	if err == nil {
+		err = s.Deposit(account.ID, 100)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment, err := s.Pay(account.ID, 30, "auto")
+	if err == nil {
+		err = s.Confirm(payment.ID)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err = OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	got, err := NewService(storage).Transitions(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The deposit was made at testStart.
+	want := []types.PaymentTransition{
+		{PaymentID: payment.ID, From: "", To: types.PaymentStatusInProgress, At: testStart.Add(time.Minute)},
+		{PaymentID: payment.ID, From: types.PaymentStatusInProgress, To: types.PaymentStatusOK, At: testStart.Add(2 * time.Minute)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Transitions(): got %+v, want %+v", got, want)
+	}
+}
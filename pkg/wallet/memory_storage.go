@@ -0,0 +1,936 @@
+package wallet
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/darkside1809/wallet/pkg/types"
+)
+
+// MemoryStorage is a Storage that keeps the state in process memory.
+//
+// The slices keep insertion order for exports and parallel sums, while the
+// maps index positions in them for constant time lookups. Stored records are
+// never modified in place: Save puts a fresh copy into the slice, so records
+// handed out by All stay consistent for as long as the caller holds them.
+type MemoryStorage struct {
+	mu    sync.RWMutex
+	state *memoryState
+}
+
+type memoryState struct {
+	lastAccountID   int64
+	accounts        []*types.Account
+	payments        []*types.Payment
+	favorites       []*types.Favorite
+	transitions     []*types.PaymentTransition
+	refunds         []*types.Refund
+	ledger          []*types.LedgerTransaction
+	holds           []*types.Hold
+	idempotency     []*IdempotencyRecord
+	accountsByID    map[int64]int
+	accountsByPhone map[accountKey]int
+	paymentsByID    map[string]int
+	favoritesByID   map[string]int
+	holdsByID       map[string]int
+	idempotencyKeys map[string]int
+	// transitionsByPayment holds the positions of the transitions of every
+	// payment in order.
+	transitionsByPayment map[string][]int
+	refundsByPayment     map[string][]int
+	ledgerBalances       map[string]types.Money
+	holdsByAccount       map[int64][]int
+	// paymentsByAccount holds the payments of every account, sorted by
+	// ByAccount under historyMu, which lets concurrent readers sort.
+	paymentsByAccount map[int64]accountHistory
+	historyMu         *sync.Mutex
+}
+
+// accountHistory holds the payments of an account. Payments stored out of
+// history order are appended, which is cheap, and the history is sorted
+// when it is next read.
+type accountHistory struct {
+	payments []*types.Payment
+	unsorted bool
+}
+
+// accountKey identifies the account of a phone in a currency.
+type accountKey struct {
+	phone    types.Phone
+	currency types.Currency
+}
+
+func keyOf(account *types.Account) accountKey {
+	return accountKey{phone: account.Phone, currency: account.Currency}
+}
+
+// storageState is a point in time copy of the storage, used to persist and
+// load it as a whole. Seq is the sequence number of the last operation log
+// record it includes.
+type storageState struct {
+	Seq           uint64
+	LastAccountID int64
+	Accounts      []*types.Account
+	Payments      []*types.Payment
+	Favorites     []*types.Favorite
+	Transitions   []*types.PaymentTransition `json:",omitempty"`
+	Refunds       []*types.Refund            `json:",omitempty"`
+	Ledger        []*types.LedgerTransaction `json:",omitempty"`
+	Holds         []*types.Hold              `json:",omitempty"`
+	Idempotency   []*IdempotencyRecord       `json:",omitempty"`
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{state: newMemoryState()}
+}
+
+func newMemoryState() *memoryState {
+	return &memoryState{
+		accountsByID:    make(map[int64]int),
+		accountsByPhone: make(map[accountKey]int),
+		paymentsByID:    make(map[string]int),
+		favoritesByID:   make(map[string]int),
+		holdsByID:       make(map[string]int),
+		idempotencyKeys: make(map[string]int),
+
+		transitionsByPayment: make(map[string][]int),
+		refundsByPayment:     make(map[string][]int),
+		ledgerBalances:       make(map[string]types.Money),
+		holdsByAccount:       make(map[int64][]int),
+		paymentsByAccount:    make(map[int64]accountHistory),
+		historyMu:            &sync.Mutex{},
+	}
+}
+
+func (s *MemoryStorage) View(fn func(tx Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return fn(&memoryTx{state: s.state})
+}
+
+func (s *MemoryStorage) Update(fn func(tx Tx) error) error {
+	return s.update(fn, nil)
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
+
+// update runs fn in a read-write transaction and then calls commit, if any,
+// before the lock is released. An error from either of them, or a panic in
+// fn, rolls every write of the transaction back.
+func (s *MemoryStorage) update(fn func(tx Tx) error, commit func(tx *memoryTx) error) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := &memoryTx{state: s.state, writable: true}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.rollback()
+			panic(p)
+		}
+	}()
+
+	err = fn(tx)
+	if err == nil && tx.cleared {
+		tx.undo = append(tx.undo, tx.state.dropOrphans())
+	}
+	if err == nil && commit != nil {
+		err = commit(tx)
+	}
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+
+	return nil
+}
+
+// snapshot must be called with the lock held. It only copies the slices, as
+// stored records are never modified, so the result stays consistent after
+// the lock is released.
+func (s *MemoryStorage) snapshot() *storageState {
+	return &storageState{
+		LastAccountID: s.state.lastAccountID,
+		Accounts:      append([]*types.Account(nil), s.state.accounts...),
+		Payments:      append([]*types.Payment(nil), s.state.payments...),
+		Favorites:     append([]*types.Favorite(nil), s.state.favorites...),
+		Transitions:   append([]*types.PaymentTransition(nil), s.state.transitions...),
+		Refunds:       append([]*types.Refund(nil), s.state.refunds...),
+		Ledger:        append([]*types.LedgerTransaction(nil), s.state.ledger...),
+		Holds:         append([]*types.Hold(nil), s.state.holds...),
+		Idempotency:   append([]*IdempotencyRecord(nil), s.state.idempotency...),
+	}
+}
+
+// load replaces the whole state. It must be called before the storage is
+// shared.
+func (s *MemoryStorage) load(state *storageState) error {
+	loaded := newMemoryState()
+	for _, account := range state.Accounts {
+		_, err := loaded.putAccount(account)
+		if err != nil {
+			return err
+		}
+	}
+	for _, payment := range state.Payments {
+		loaded.putPayment(payment)
+	}
+	for _, favorite := range state.Favorites {
+		loaded.putFavorite(favorite)
+	}
+	for _, transition := range state.Transitions {
+		loaded.addTransition(transition)
+	}
+	for _, refund := range state.Refunds {
+		loaded.addRefund(refund)
+	}
+	for _, transaction := range state.Ledger {
+		loaded.postLedger(transaction)
+	}
+	for _, hold := range state.Holds {
+		loaded.putHold(hold)
+	}
+	for _, record := range state.Idempotency {
+		loaded.putIdempotency(record)
+	}
+	if state.LastAccountID > loaded.lastAccountID {
+		loaded.lastAccountID = state.LastAccountID
+	}
+
+	s.state = loaded
+	return nil
+}
+
+// putAccount stores a copy of the account and returns a function that undoes
+// the change. Like the other records, accounts stored before they had a
+// currency are in the default one.
+func (st *memoryState) putAccount(account *types.Account) (func(), error) {
+	stored := *account
+	stored.Currency = currencyOrDefault(stored.Currency)
+
+	i, exists := st.accountsByID[stored.ID]
+	if j, ok := st.accountsByPhone[keyOf(&stored)]; ok && (!exists || i != j) {
+		return nil, ErrPhoneRegistered
+	}
+
+	lastAccountID := st.lastAccountID
+	if stored.ID > st.lastAccountID {
+		st.lastAccountID = stored.ID
+	}
+
+	if exists {
+		old := st.accounts[i]
+		if old.Currency != stored.Currency {
+			return nil, ErrCurrencyMismatch
+		}
+		st.accounts[i] = &stored
+		delete(st.accountsByPhone, keyOf(old))
+		st.accountsByPhone[keyOf(&stored)] = i
+
+		return func() {
+			delete(st.accountsByPhone, keyOf(&stored))
+			st.accountsByPhone[keyOf(old)] = i
+			st.accounts[i] = old
+			st.lastAccountID = lastAccountID
+		}, nil
+	}
+
+	i = len(st.accounts)
+	st.accounts = append(st.accounts, &stored)
+	st.accountsByID[stored.ID] = i
+	st.accountsByPhone[keyOf(&stored)] = i
+
+	return func() {
+		delete(st.accountsByPhone, keyOf(&stored))
+		delete(st.accountsByID, stored.ID)
+		st.accounts = st.accounts[:i]
+		st.lastAccountID = lastAccountID
+	}, nil
+}
+
+// reserve raises lastAccountID to id and returns a function that undoes it.
+func (st *memoryState) reserve(id int64) func() {
+	lastAccountID := st.lastAccountID
+	if id > st.lastAccountID {
+		st.lastAccountID = id
+	}
+
+	return func() {
+		st.lastAccountID = lastAccountID
+	}
+}
+
+// clear empties the state as Tx.Clear describes and returns a function that
+// restores it. Transitions, refunds and holds stay until dropOrphans.
+func (st *memoryState) clear() func() {
+	old := *st
+	*st = *newMemoryState()
+	st.lastAccountID = old.lastAccountID
+	st.transitions, st.transitionsByPayment = old.transitions, old.transitionsByPayment
+	st.refunds, st.refundsByPayment = old.refunds, old.refundsByPayment
+	st.holds, st.holdsByID, st.holdsByAccount = old.holds, old.holdsByID, old.holdsByAccount
+
+	return func() {
+		*st = old
+	}
+}
+
+// dropOrphans removes the holds, refunds and transitions whose account or
+// payment isn't stored, and returns a function that restores them.
+func (st *memoryState) dropOrphans() func() {
+	old := *st
+
+	st.holds, st.holdsByID, st.holdsByAccount = nil, make(map[string]int), make(map[int64][]int)
+	for _, hold := range old.holds {
+		_, ok := st.accountsByID[hold.AccountID]
+		if ok && hold.PaymentID != "" {
+			_, ok = st.paymentsByID[hold.PaymentID]
+		}
+		if ok {
+			st.holdsByID[hold.ID] = len(st.holds)
+			st.holdsByAccount[hold.AccountID] = append(st.holdsByAccount[hold.AccountID], len(st.holds))
+			st.holds = append(st.holds, hold)
+		}
+	}
+
+	st.refunds, st.refundsByPayment = nil, make(map[string][]int)
+	for _, refund := range old.refunds {
+		if _, ok := st.paymentsByID[refund.PaymentID]; ok {
+			st.refundsByPayment[refund.PaymentID] = append(st.refundsByPayment[refund.PaymentID], len(st.refunds))
+			st.refunds = append(st.refunds, refund)
+		}
+	}
+
+	st.transitions, st.transitionsByPayment = nil, make(map[string][]int)
+	for _, transition := range old.transitions {
+		if _, ok := st.paymentsByID[transition.PaymentID]; ok {
+			st.transitionsByPayment[transition.PaymentID] = append(st.transitionsByPayment[transition.PaymentID], len(st.transitions))
+			st.transitions = append(st.transitions, transition)
+		}
+	}
+
+	return func() {
+		*st = old
+	}
+}
+
+func (st *memoryState) putPayment(payment *types.Payment) func() {
+	stored := *payment
+	stored.Currency = currencyOrDefault(stored.Currency)
+
+	if i, ok := st.paymentsByID[stored.ID]; ok {
+		old := st.payments[i]
+		st.payments[i] = &stored
+		unindex := st.indexPayment(&stored, old)
+		return func() {
+			unindex()
+			st.payments[i] = old
+		}
+	}
+
+	i := len(st.payments)
+	st.payments = append(st.payments, &stored)
+	st.paymentsByID[stored.ID] = i
+	unindex := st.indexPayment(&stored, nil)
+
+	return func() {
+		unindex()
+		delete(st.paymentsByID, stored.ID)
+		st.payments = st.payments[:i]
+	}
+}
+
+// indexPayment puts a stored payment into the history of its account in
+// place of old, the payment it replaces, if any.
+func (st *memoryState) indexPayment(stored *types.Payment, old *types.Payment) func() {
+	if old != nil && old.AccountID == stored.AccountID && old.CreatedAt.Equal(stored.CreatedAt) {
+		history := st.paymentsByAccount[stored.AccountID]
+		i := history.index(old)
+		history.payments[i] = stored
+		return func() {
+			history.payments[i] = old
+			st.paymentsByAccount[stored.AccountID] = history
+		}
+	}
+
+	undoRemove := func() {}
+	if old != nil {
+		undoRemove = st.unindexPayment(old)
+	}
+
+	history := st.paymentsByAccount[stored.AccountID]
+	last := len(history.payments) - 1
+	st.paymentsByAccount[stored.AccountID] = accountHistory{
+		payments: append(history.payments, stored),
+		unsorted: history.unsorted || last >= 0 && historyPositionOf(stored).before(history.payments[last]),
+	}
+
+	return func() {
+		st.setAccountHistory(stored.AccountID, history)
+		undoRemove()
+	}
+}
+
+// unindexPayment takes a payment out of the history of its account.
+func (st *memoryState) unindexPayment(payment *types.Payment) func() {
+	history := st.paymentsByAccount[payment.AccountID]
+	i := history.index(payment)
+	removed := make([]*types.Payment, 0, len(history.payments)-1)
+	removed = append(append(removed, history.payments[:i]...), history.payments[i+1:]...)
+	st.setAccountHistory(payment.AccountID, accountHistory{payments: removed, unsorted: history.unsorted})
+
+	return func() {
+		st.setAccountHistory(payment.AccountID, history)
+	}
+}
+
+func (st *memoryState) setAccountHistory(accountID int64, history accountHistory) {
+	if len(history.payments) == 0 {
+		delete(st.paymentsByAccount, accountID)
+	} else {
+		st.paymentsByAccount[accountID] = history
+	}
+}
+
+// index returns the position of a stored payment in the history.
+func (h accountHistory) index(payment *types.Payment) int {
+	if h.unsorted {
+		for i, stored := range h.payments {
+			if stored == payment {
+				return i
+			}
+		}
+	}
+
+	return sort.Search(len(h.payments), func(i int) bool {
+		return !historyPositionOf(h.payments[i]).before(payment)
+	})
+}
+
+// accountHistory returns the payments of an account in history order,
+// sorting them first if needed.
+func (st *memoryState) accountHistory(accountID int64) []*types.Payment {
+	st.historyMu.Lock()
+	defer st.historyMu.Unlock()
+
+	history := st.paymentsByAccount[accountID]
+	if history.unsorted {
+		sorted := append([]*types.Payment(nil), history.payments...)
+		sort.Slice(sorted, func(i, j int) bool {
+			return historyPositionOf(sorted[i]).before(sorted[j])
+		})
+		history = accountHistory{payments: sorted}
+		st.paymentsByAccount[accountID] = history
+	}
+
+	return history.payments
+}
+
+func (st *memoryState) putFavorite(favorite *types.Favorite) func() {
+	stored := *favorite
+	stored.Currency = currencyOrDefault(stored.Currency)
+
+	if i, ok := st.favoritesByID[stored.ID]; ok {
+		old := st.favorites[i]
+		st.favorites[i] = &stored
+		return func() {
+			st.favorites[i] = old
+		}
+	}
+
+	i := len(st.favorites)
+	st.favorites = append(st.favorites, &stored)
+	st.favoritesByID[stored.ID] = i
+
+	return func() {
+		delete(st.favoritesByID, stored.ID)
+		st.favorites = st.favorites[:i]
+	}
+}
+
+func (st *memoryState) addTransition(transition *types.PaymentTransition) func() {
+	stored := *transition
+
+	i := len(st.transitions)
+	st.transitions = append(st.transitions, &stored)
+	positions := st.transitionsByPayment[stored.PaymentID]
+	st.transitionsByPayment[stored.PaymentID] = append(positions, i)
+
+	return func() {
+		if len(positions) == 0 {
+			delete(st.transitionsByPayment, stored.PaymentID)
+		} else {
+			st.transitionsByPayment[stored.PaymentID] = positions
+		}
+		st.transitions = st.transitions[:i]
+	}
+}
+
+func (st *memoryState) addRefund(refund *types.Refund) func() {
+	stored := *refund
+
+	i := len(st.refunds)
+	st.refunds = append(st.refunds, &stored)
+	positions := st.refundsByPayment[stored.PaymentID]
+	st.refundsByPayment[stored.PaymentID] = append(positions, i)
+
+	return func() {
+		if len(positions) == 0 {
+			delete(st.refundsByPayment, stored.PaymentID)
+		} else {
+			st.refundsByPayment[stored.PaymentID] = positions
+		}
+		st.refunds = st.refunds[:i]
+	}
+}
+
+func (st *memoryState) postLedger(transaction *types.LedgerTransaction) func() {
+	stored := *transaction
+	stored.Currency = currencyOrDefault(stored.Currency)
+	stored.Entries = append([]types.LedgerEntry(nil), transaction.Entries...)
+
+	i := len(st.ledger)
+	st.ledger = append(st.ledger, &stored)
+	for _, entry := range stored.Entries {
+		st.ledgerBalances[entry.Account] += entry.Credit - entry.Debit
+	}
+
+	return func() {
+		for _, entry := range stored.Entries {
+			st.ledgerBalances[entry.Account] -= entry.Credit - entry.Debit
+		}
+		st.ledger = st.ledger[:i]
+	}
+}
+
+func (st *memoryState) putHold(hold *types.Hold) func() {
+	stored := *hold
+
+	if i, ok := st.holdsByID[stored.ID]; ok {
+		old := st.holds[i]
+		st.holds[i] = &stored
+		return func() {
+			st.holds[i] = old
+		}
+	}
+
+	i := len(st.holds)
+	st.holds = append(st.holds, &stored)
+	st.holdsByID[stored.ID] = i
+	positions := st.holdsByAccount[stored.AccountID]
+	st.holdsByAccount[stored.AccountID] = append(positions, i)
+
+	return func() {
+		if len(positions) == 0 {
+			delete(st.holdsByAccount, stored.AccountID)
+		} else {
+			st.holdsByAccount[stored.AccountID] = positions
+		}
+		delete(st.holdsByID, stored.ID)
+		st.holds = st.holds[:i]
+	}
+}
+
+func (st *memoryState) putIdempotency(record *IdempotencyRecord) func() {
+	stored := *record
+
+	if i, ok := st.idempotencyKeys[stored.Key]; ok {
+		old := st.idempotency[i]
+		st.idempotency[i] = &stored
+		return func() {
+			st.idempotency[i] = old
+		}
+	}
+
+	i := len(st.idempotency)
+	st.idempotency = append(st.idempotency, &stored)
+	st.idempotencyKeys[stored.Key] = i
+
+	return func() {
+		delete(st.idempotencyKeys, stored.Key)
+		st.idempotency = st.idempotency[:i]
+	}
+}
+
+// deleteIdempotency removes the records of the keys. The records after them
+// move up, so the slice and index are rebuilt once rather than changed in
+// place.
+func (st *memoryState) deleteIdempotency(keys []string) func() {
+	deleted := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if _, ok := st.idempotencyKeys[key]; ok {
+			deleted[key] = true
+		}
+	}
+	if len(deleted) == 0 {
+		return func() {}
+	}
+
+	oldRecords, oldKeys := st.idempotency, st.idempotencyKeys
+	st.idempotency = make([]*IdempotencyRecord, 0, len(oldRecords)-len(deleted))
+	st.idempotencyKeys = make(map[string]int, len(oldRecords)-len(deleted))
+	for _, record := range oldRecords {
+		if !deleted[record.Key] {
+			st.idempotencyKeys[record.Key] = len(st.idempotency)
+			st.idempotency = append(st.idempotency, record)
+		}
+	}
+
+	return func() {
+		st.idempotency, st.idempotencyKeys = oldRecords, oldKeys
+	}
+}
+
+type memoryTx struct {
+	state    *memoryState
+	writable bool
+	undo     []func()
+	// changes lists the records saved by the transaction in order, along
+	// with clearState, reservedID and deletedIdempotencyKeys markers, for
+	// storages that persist them on commit.
+	changes []interface{}
+	// cleared is set by Clear; the records that the Clear left without their
+	// account or payment are dropped once fn returns.
+	cleared bool
+}
+
+// clearState marks a Clear in memoryTx.changes.
+type clearState struct{}
+
+// reservedID marks a Reserve in memoryTx.changes.
+type reservedID int64
+
+// deletedIdempotencyKeys marks the Delete of idempotency records in
+// memoryTx.changes.
+type deletedIdempotencyKeys []string
+
+func (tx *memoryTx) Accounts() AccountRepository {
+	return memoryAccounts{tx}
+}
+
+func (tx *memoryTx) Payments() PaymentRepository {
+	return memoryPayments{tx}
+}
+
+func (tx *memoryTx) Favorites() FavoriteRepository {
+	return memoryFavorites{tx}
+}
+
+func (tx *memoryTx) Transitions() TransitionRepository {
+	return memoryTransitions{tx}
+}
+
+func (tx *memoryTx) Refunds() RefundRepository {
+	return memoryRefunds{tx}
+}
+
+func (tx *memoryTx) Ledger() LedgerRepository {
+	return memoryLedger{tx}
+}
+
+func (tx *memoryTx) Holds() HoldRepository {
+	return memoryHolds{tx}
+}
+
+func (tx *memoryTx) Idempotency() IdempotencyRepository {
+	return memoryIdempotency{tx}
+}
+
+func (tx *memoryTx) Clear() error {
+	if !tx.writable {
+		return ErrReadOnlyTx
+	}
+
+	tx.undo = append(tx.undo, tx.state.clear())
+	tx.changes = append(tx.changes, clearState{})
+	tx.cleared = true
+	return nil
+}
+
+func (tx *memoryTx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	tx.undo = nil
+	tx.changes = nil
+}
+
+type memoryAccounts struct {
+	tx *memoryTx
+}
+
+func (r memoryAccounts) ByID(id int64) (*types.Account, error) {
+	i, ok := r.tx.state.accountsByID[id]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+
+	account := *r.tx.state.accounts[i]
+	return &account, nil
+}
+
+func (r memoryAccounts) ByPhone(phone types.Phone, currency types.Currency) (*types.Account, error) {
+	i, ok := r.tx.state.accountsByPhone[accountKey{phone: phone, currency: currency}]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+
+	account := *r.tx.state.accounts[i]
+	return &account, nil
+}
+
+func (r memoryAccounts) All() []*types.Account {
+	return r.tx.state.accounts
+}
+
+func (r memoryAccounts) Save(account *types.Account) error {
+	if !r.tx.writable {
+		return ErrReadOnlyTx
+	}
+
+	undo, err := r.tx.state.putAccount(account)
+	if err != nil {
+		return err
+	}
+
+	r.tx.undo = append(r.tx.undo, undo)
+	r.tx.changes = append(r.tx.changes, r.tx.state.accounts[r.tx.state.accountsByID[account.ID]])
+	return nil
+}
+
+func (r memoryAccounts) LastID() int64 {
+	return r.tx.state.lastAccountID
+}
+
+func (r memoryAccounts) Reserve(id int64) error {
+	if !r.tx.writable {
+		return ErrReadOnlyTx
+	}
+	if id <= r.tx.state.lastAccountID {
+		return nil
+	}
+
+	r.tx.undo = append(r.tx.undo, r.tx.state.reserve(id))
+	r.tx.changes = append(r.tx.changes, reservedID(id))
+	return nil
+}
+
+type memoryPayments struct {
+	tx *memoryTx
+}
+
+func (r memoryPayments) ByID(id string) (*types.Payment, error) {
+	i, ok := r.tx.state.paymentsByID[id]
+	if !ok {
+		return nil, ErrPaymentNotFound
+	}
+
+	payment := *r.tx.state.payments[i]
+	return &payment, nil
+}
+
+func (r memoryPayments) ByAccount(accountID int64) []*types.Payment {
+	return r.tx.state.accountHistory(accountID)
+}
+
+func (r memoryPayments) All() []*types.Payment {
+	return r.tx.state.payments
+}
+
+func (r memoryPayments) Save(payment *types.Payment) error {
+	if !r.tx.writable {
+		return ErrReadOnlyTx
+	}
+
+	r.tx.undo = append(r.tx.undo, r.tx.state.putPayment(payment))
+	r.tx.changes = append(r.tx.changes, r.tx.state.payments[r.tx.state.paymentsByID[payment.ID]])
+	return nil
+}
+
+type memoryFavorites struct {
+	tx *memoryTx
+}
+
+func (r memoryFavorites) ByID(id string) (*types.Favorite, error) {
+	i, ok := r.tx.state.favoritesByID[id]
+	if !ok {
+		return nil, ErrFavoriteNotFound
+	}
+
+	favorite := *r.tx.state.favorites[i]
+	return &favorite, nil
+}
+
+func (r memoryFavorites) All() []*types.Favorite {
+	return r.tx.state.favorites
+}
+
+func (r memoryFavorites) Save(favorite *types.Favorite) error {
+	if !r.tx.writable {
+		return ErrReadOnlyTx
+	}
+
+	r.tx.undo = append(r.tx.undo, r.tx.state.putFavorite(favorite))
+	r.tx.changes = append(r.tx.changes, r.tx.state.favorites[r.tx.state.favoritesByID[favorite.ID]])
+	return nil
+}
+
+type memoryTransitions struct {
+	tx *memoryTx
+}
+
+func (r memoryTransitions) ByPayment(paymentID string) []*types.PaymentTransition {
+	positions := r.tx.state.transitionsByPayment[paymentID]
+	transitions := make([]*types.PaymentTransition, len(positions))
+	for i, position := range positions {
+		transitions[i] = r.tx.state.transitions[position]
+	}
+
+	return transitions
+}
+
+func (r memoryTransitions) All() []*types.PaymentTransition {
+	return r.tx.state.transitions
+}
+
+func (r memoryTransitions) Add(transition *types.PaymentTransition) error {
+	if !r.tx.writable {
+		return ErrReadOnlyTx
+	}
+
+	r.tx.undo = append(r.tx.undo, r.tx.state.addTransition(transition))
+	r.tx.changes = append(r.tx.changes, r.tx.state.transitions[len(r.tx.state.transitions)-1])
+	return nil
+}
+
+type memoryRefunds struct {
+	tx *memoryTx
+}
+
+func (r memoryRefunds) ByPayment(paymentID string) []*types.Refund {
+	positions := r.tx.state.refundsByPayment[paymentID]
+	refunds := make([]*types.Refund, len(positions))
+	for i, position := range positions {
+		refunds[i] = r.tx.state.refunds[position]
+	}
+
+	return refunds
+}
+
+func (r memoryRefunds) All() []*types.Refund {
+	return r.tx.state.refunds
+}
+
+func (r memoryRefunds) Add(refund *types.Refund) error {
+	if !r.tx.writable {
+		return ErrReadOnlyTx
+	}
+
+	r.tx.undo = append(r.tx.undo, r.tx.state.addRefund(refund))
+	r.tx.changes = append(r.tx.changes, r.tx.state.refunds[len(r.tx.state.refunds)-1])
+	return nil
+}
+
+type memoryLedger struct {
+	tx *memoryTx
+}
+
+func (r memoryLedger) All() []*types.LedgerTransaction {
+	return r.tx.state.ledger
+}
+
+func (r memoryLedger) Post(transaction *types.LedgerTransaction) error {
+	if !r.tx.writable {
+		return ErrReadOnlyTx
+	}
+
+	transaction.ID = int64(len(r.tx.state.ledger)) + 1
+	r.tx.undo = append(r.tx.undo, r.tx.state.postLedger(transaction))
+	r.tx.changes = append(r.tx.changes, r.tx.state.ledger[len(r.tx.state.ledger)-1])
+	return nil
+}
+
+func (r memoryLedger) Balance(account string) types.Money {
+	return r.tx.state.ledgerBalances[account]
+}
+
+type memoryHolds struct {
+	tx *memoryTx
+}
+
+func (r memoryHolds) ByID(id string) (*types.Hold, error) {
+	i, ok := r.tx.state.holdsByID[id]
+	if !ok {
+		return nil, ErrHoldNotFound
+	}
+
+	hold := *r.tx.state.holds[i]
+	return &hold, nil
+}
+
+func (r memoryHolds) ByAccount(accountID int64) []*types.Hold {
+	positions := r.tx.state.holdsByAccount[accountID]
+	holds := make([]*types.Hold, len(positions))
+	for i, position := range positions {
+		holds[i] = r.tx.state.holds[position]
+	}
+
+	return holds
+}
+
+func (r memoryHolds) All() []*types.Hold {
+	return r.tx.state.holds
+}
+
+func (r memoryHolds) Save(hold *types.Hold) error {
+	if !r.tx.writable {
+		return ErrReadOnlyTx
+	}
+
+	r.tx.undo = append(r.tx.undo, r.tx.state.putHold(hold))
+	r.tx.changes = append(r.tx.changes, r.tx.state.holds[r.tx.state.holdsByID[hold.ID]])
+	return nil
+}
+
+type memoryIdempotency struct {
+	tx *memoryTx
+}
+
+func (r memoryIdempotency) ByKey(key string) (*IdempotencyRecord, error) {
+	i, ok := r.tx.state.idempotencyKeys[key]
+	if !ok {
+		return nil, ErrIdempotencyKeyNotFound
+	}
+
+	record := *r.tx.state.idempotency[i]
+	return &record, nil
+}
+
+func (r memoryIdempotency) All() []*IdempotencyRecord {
+	return r.tx.state.idempotency
+}
+
+func (r memoryIdempotency) Save(record *IdempotencyRecord) error {
+	if !r.tx.writable {
+		return ErrReadOnlyTx
+	}
+
+	r.tx.undo = append(r.tx.undo, r.tx.state.putIdempotency(record))
+	r.tx.changes = append(r.tx.changes, r.tx.state.idempotency[r.tx.state.idempotencyKeys[record.Key]])
+	return nil
+}
+
+func (r memoryIdempotency) Delete(keys ...string) error {
+	if !r.tx.writable {
+		return ErrReadOnlyTx
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	r.tx.undo = append(r.tx.undo, r.tx.state.deleteIdempotency(keys))
+	r.tx.changes = append(r.tx.changes, deletedIdempotencyKeys(keys))
+	return nil
+}
@@ -0,0 +1,275 @@
+package wallet
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/darkside1809/wallet/pkg/types"
+)
+
+func TestMemoryStorage_Update_rollback(t *testing.T) {
+	storage := NewMemoryStorage()
+
+	err := storage.Update(func(tx Tx) error {
+		return tx.Accounts().Save(&types.Account{ID: 1, Phone: "+992000000001", Balance: 100})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errFailed := errors.New("failed")
+	err = storage.Update(func(tx Tx) error {
+		err := tx.Accounts().Save(&types.Account{ID: 1, Phone: "+992000000002", Balance: 50})
+		if err != nil {
+			return err
+		}
+		err = tx.Accounts().Save(&types.Account{ID: 2, Phone: "+992000000003"})
+		if err != nil {
+			return err
+		}
+		err = tx.Payments().Save(&types.Payment{ID: "payment", AccountID: 1, Amount: 50})
+		if err != nil {
+			return err
+		}
+		err = tx.Transitions().Add(&types.PaymentTransition{PaymentID: "payment", To: types.PaymentStatusInProgress})
+		if err != nil {
+			return err
+		}
+		err = tx.Refunds().Add(&types.Refund{ID: "refund", PaymentID: "payment", AccountID: 1, Amount: 10})
+		if err != nil {
+			return err
+		}
+		err = postTransfer(tx, types.LedgerKindDeposit, "", time.Time{}, LedgerCash, AccountLedger(1), types.Amount{Value: 10, Currency: types.DefaultCurrency})
+		if err != nil {
+			return err
+		}
+		err = tx.Holds().Save(&types.Hold{ID: "hold", AccountID: 1, Amount: 10, Status: types.HoldStatusActive})
+		if err != nil {
+			return err
+		}
+		err = tx.Idempotency().Save(&IdempotencyRecord{Key: "key", Operation: "Pay"})
+		if err != nil {
+			return err
+		}
+		return errFailed
+	})
+	if err != errFailed {
+		t.Fatalf("Update(): must return fn error, returned %v", err)
+	}
+
+	err = storage.View(func(tx Tx) error {
+		account, err := tx.Accounts().ByPhone("+992000000001", types.DefaultCurrency)
+		if err != nil {
+			return err
+		}
+		if account.Balance != 100 {
+			t.Errorf("Update(): balance must be rolled back, got %v", account.Balance)
+		}
+		if _, err := tx.Accounts().ByPhone("+992000000002", types.DefaultCurrency); err != ErrAccountNotFound {
+			t.Errorf("Update(): phone index must be rolled back, got %v", err)
+		}
+		if _, err := tx.Accounts().ByID(2); err != ErrAccountNotFound {
+			t.Errorf("Update(): new account must be rolled back, got %v", err)
+		}
+		if tx.Accounts().LastID() != 1 {
+			t.Errorf("Update(): last id must be rolled back, got %v", tx.Accounts().LastID())
+		}
+		if len(tx.Payments().All()) != 0 {
+			t.Errorf("Update(): payments must be rolled back, got %v", tx.Payments().All())
+		}
+		if len(tx.Transitions().All()) != 0 || len(tx.Transitions().ByPayment("payment")) != 0 {
+			t.Errorf("Update(): transitions must be rolled back, got %v", tx.Transitions().All())
+		}
+		if len(tx.Refunds().All()) != 0 || len(tx.Refunds().ByPayment("payment")) != 0 {
+			t.Errorf("Update(): refunds must be rolled back, got %v", tx.Refunds().All())
+		}
+		if len(tx.Ledger().All()) != 0 || tx.Ledger().Balance(AccountLedger(1)) != 0 || tx.Ledger().Balance(LedgerCash) != 0 {
+			t.Errorf("Update(): ledger must be rolled back, got %v", tx.Ledger().All())
+		}
+		if _, err := tx.Holds().ByID("hold"); err != ErrHoldNotFound || len(tx.Holds().ByAccount(1)) != 0 {
+			t.Errorf("Update(): holds must be rolled back, got %v", tx.Holds().All())
+		}
+		if _, err := tx.Idempotency().ByKey("key"); err != ErrIdempotencyKeyNotFound {
+			t.Errorf("Update(): idempotency keys must be rolled back, got %v", tx.Idempotency().All())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryStorage_Save_phoneRegistered(t *testing.T) {
+	storage := NewMemoryStorage()
+
+	err := storage.Update(func(tx Tx) error {
+		err := tx.Accounts().Save(&types.Account{ID: 1, Phone: "+992000000001"})
+		if err != nil {
+			return err
+		}
+		return tx.Accounts().Save(&types.Account{ID: 2, Phone: "+992000000001"})
+	})
+	if err != ErrPhoneRegistered {
+		t.Errorf("Save(): must return ErrPhoneRegistered, returned %v", err)
+	}
+}
+
+func TestMemoryStorage_View_readOnly(t *testing.T) {
+	storage := NewMemoryStorage()
+
+	err := storage.View(func(tx Tx) error {
+		return tx.Payments().Save(&types.Payment{ID: "payment"})
+	})
+	if err != ErrReadOnlyTx {
+		t.Errorf("View(): must return ErrReadOnlyTx, returned %v", err)
+	}
+}
+
+func TestMemoryStorage_ByID_copy(t *testing.T) {
+	storage := NewMemoryStorage()
+
+	err := storage.Update(func(tx Tx) error {
+		err := tx.Accounts().Save(&types.Account{ID: 1, Phone: "+992000000001", Balance: 100})
+		if err != nil {
+			return err
+		}
+
+		account, err := tx.Accounts().ByID(1)
+		if err != nil {
+			return err
+		}
+		account.Balance = 0
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.View(func(tx Tx) error {
+		account, err := tx.Accounts().ByID(1)
+		if err != nil {
+			return err
+		}
+		if account.Balance != 100 {
+			t.Errorf("ByID(): must return a copy, stored balance changed to %v", account.Balance)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryStorage_Clear_rollback(t *testing.T) {
+	storage := NewMemoryStorage()
+
+	err := storage.Update(func(tx Tx) error {
+		return tx.Accounts().Save(&types.Account{ID: 5, Phone: "+992000000001", Balance: 100})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errFailed := errors.New("failed")
+	err = storage.Update(func(tx Tx) error {
+		err := tx.Clear()
+		if err != nil {
+			return err
+		}
+		if len(tx.Accounts().All()) != 0 || tx.Accounts().LastID() != 5 {
+			t.Errorf("Clear(): must drop every account and keep the last ID")
+		}
+		err = tx.Accounts().Save(&types.Account{ID: 1, Phone: "+992000000001"})
+		if err != nil {
+			return err
+		}
+		return errFailed
+	})
+	if err != errFailed {
+		t.Fatalf("Update(): must return fn error, returned %v", err)
+	}
+
+	err = storage.View(func(tx Tx) error {
+		account, err := tx.Accounts().ByPhone("+992000000001", types.DefaultCurrency)
+		if err != nil {
+			return err
+		}
+		if account.ID != 5 || account.Balance != 100 || tx.Accounts().LastID() != 5 {
+			t.Errorf("Clear(): must be rolled back, got %+v, last id %v", account, tx.Accounts().LastID())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryStorage_ByAccount_order(t *testing.T) {
+	storage := NewMemoryStorage()
+	at := func(minutes int) time.Time {
+		return testStart.Add(time.Duration(minutes) * time.Minute)
+	}
+	historyIn := func(tx Tx) []string {
+		var ids []string
+		for _, payment := range tx.Payments().ByAccount(1) {
+			ids = append(ids, payment.ID)
+		}
+		return ids
+	}
+	history := func() []string {
+		var ids []string
+		storage.View(func(tx Tx) error {
+			ids = historyIn(tx)
+			return nil
+		})
+		return ids
+	}
+
+	err := storage.Update(func(tx Tx) error {
+		for _, payment := range []*types.Payment{
+			{ID: "c", AccountID: 1, CreatedAt: at(2)},
+			{ID: "a", AccountID: 1, CreatedAt: at(1)},
+			{ID: "b", AccountID: 1, CreatedAt: at(1)},
+			{ID: "x", AccountID: 2, CreatedAt: at(0)},
+			{ID: "d", AccountID: 1, CreatedAt: at(3)},
+		} {
+			err := tx.Payments().Save(payment)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := history(); !reflect.DeepEqual(got, []string{"a", "b", "c", "d"}) {
+		t.Fatalf("ByAccount(): wrong order %v", got)
+	}
+
+	errFailed := errors.New("failed")
+	err = storage.Update(func(tx Tx) error {
+		err := tx.Payments().Save(&types.Payment{ID: "d", AccountID: 1, CreatedAt: at(0)})
+		if err == nil {
+			err = tx.Payments().Save(&types.Payment{ID: "b", AccountID: 2, CreatedAt: at(1)})
+		}
+		if err == nil {
+			err = tx.Payments().Save(&types.Payment{ID: "c", AccountID: 1, CreatedAt: at(2), Amount: 5})
+		}
+		if err != nil {
+			return err
+		}
+		if got := historyIn(tx); !reflect.DeepEqual(got, []string{"d", "a", "c"}) {
+			t.Errorf("ByAccount(): wrong order after moves %v", got)
+		}
+		return errFailed
+	})
+	if err != errFailed {
+		t.Fatalf("Update(): must return fn error, returned %v", err)
+	}
+	if got := history(); !reflect.DeepEqual(got, []string{"a", "b", "c", "d"}) {
+		t.Errorf("ByAccount(): moves must be rolled back, got %v", got)
+	}
+}
@@ -0,0 +1,116 @@
+package wallet
+
+import (
+	"fmt"
+
+	"github.com/darkside1809/wallet/pkg/types"
+)
+
+// dumpMigration upgrades the files of a dump from the format version it is
+// registered under to the next one.
+type dumpMigration struct {
+	// columns returns the columns of a file after the upgrade, given its name
+	// and its columns before it.
+	columns func(name string, columns []string) []string
+	// row upgrades one row of the file to the new columns; nil leaves rows
+	// as they are.
+	row func(name string, row *dumpRow)
+}
+
+// dumpMigrations holds the migration from every format version before
+// dumpFormat. A change to the layout of the dump files bumps dumpFormat and
+// registers the migration from the previous version here, next to golden
+// files of that version in testdata/dumps.
+var dumpMigrations = map[int]dumpMigration{
+	// Version 1 files have no header row: their columns are positional.
+	1: {
+		columns: func(name string, _ []string) []string {
+			return v1DumpColumns[name]
+		},
+	},
+	// Version 2 payments have no times, which stay unknown.
+	2: {
+		columns: func(name string, columns []string) []string {
+			if name != paymentsDumpName {
+				return columns
+			}
+			return append(append([]string(nil), columns...), "created_at", "updated_at", "settled_at")
+		},
+		row: func(name string, row *dumpRow) {
+			if name != paymentsDumpName {
+				return
+			}
+			last := row.columns[len(row.columns)-1] + len(row.fields[len(row.fields)-1]) + 1
+			row.fields = append(row.fields, "", "", "")
+			row.columns = append(row.columns, last, last, last)
+		},
+	},
+	// Version 3 payments have nothing refunded: rejecting one zeroed its
+	// amount instead.
+	3: {
+		columns: func(name string, columns []string) []string {
+			if name != paymentsDumpName {
+				return columns
+			}
+			return append(append([]string(nil), columns...), "refunded")
+		},
+		row: func(name string, row *dumpRow) {
+			if name != paymentsDumpName {
+				return
+			}
+			last := row.columns[len(row.columns)-1] + len(row.fields[len(row.fields)-1]) + 1
+			row.fields = append(row.fields, "0")
+			row.columns = append(row.columns, last)
+		},
+	},
+	// Version 4 payments all took money out of their account.
+	4: {
+		columns: func(name string, columns []string) []string {
+			if name != paymentsDumpName {
+				return columns
+			}
+			return append(append([]string(nil), columns...), "direction", "linked_id")
+		},
+		row: func(name string, row *dumpRow) {
+			if name != paymentsDumpName {
+				return
+			}
+			last := row.columns[len(row.columns)-1] + len(row.fields[len(row.fields)-1]) + 1
+			row.fields = append(row.fields, string(types.PaymentDirectionOut), "")
+			row.columns = append(row.columns, last, last+len(types.PaymentDirectionOut)+1)
+		},
+	},
+	// Version 5 records are all in the default currency.
+	5: {
+		columns: func(_ string, columns []string) []string {
+			return append(append([]string(nil), columns...), "currency")
+		},
+		row: func(_ string, row *dumpRow) {
+			last := row.columns[len(row.columns)-1] + len(row.fields[len(row.fields)-1]) + 1
+			row.fields = append(row.fields, string(types.DefaultCurrency))
+			row.columns = append(row.columns, last)
+		},
+	},
+}
+
+// v1DumpColumns holds the positional columns of every version 1 dump file.
+var v1DumpColumns = map[string][]string{
+	accountsDumpName:  {"id", "phone", "balance"},
+	paymentsDumpName:  {"id", "account_id", "amount", "category", "status"},
+	favoritesDumpName: {"id", "account_id", "name", "amount", "category"},
+}
+
+// checkDumpFormat makes sure a dump of the format can be upgraded to the
+// current one.
+func checkDumpFormat(format int) error {
+	if format < 1 || format > dumpFormat {
+		return fmt.Errorf("%w: version %d, want at most %d", ErrUnsupportedFormat, format, dumpFormat)
+	}
+	for version := format; version < dumpFormat; version++ {
+		if _, ok := dumpMigrations[version]; !ok {
+			return fmt.Errorf("%w: no migration from version %d", ErrUnsupportedFormat, version)
+		}
+	}
+
+	return nil
+}
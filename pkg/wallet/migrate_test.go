@@ -0,0 +1,145 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of the current dump format")
+
+// goldenDumps holds a dump in every format version: v1 without a manifest,
+// as written before generations existed, v1 with a manifest, and one
+// directory for every later version. Each is a dump of the state in
+// testdata/dumps named next to it, which leaves out what its format can't
+// hold; state.json is the state of the current format.
+var goldenDumps = []struct {
+	version string
+	state   string
+}{
+	{"v1", "state-v2.json"},
+	{"v1-manifest", "state-v2.json"},
+	{"v2", "state-v2.json"},
+	{"v3", "state-v3.json"},
+	{"v4", "state-v4.json"},
+	{"v5", "state-v5.json"},
+	{"v6", "state.json"},
+}
+
+func readGoldenState(t *testing.T, name string) []byte {
+	t.Helper()
+
+	content, err := os.ReadFile(filepath.Join("testdata", "dumps", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestService_Import_goldenDumps(t *testing.T) {
+	for _, golden := range goldenDumps {
+		version := golden.version
+		want := readGoldenState(t, golden.state)
+		s := newTestService()
+		err := s.Import(filepath.Join("testdata", "dumps", version))
+		if err != nil {
+			t.Errorf("Import(%s): error = %v", version, err)
+			continue
+		}
+
+		got := &bytes.Buffer{}
+		err = s.ExportJSON(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != string(want) {
+			t.Errorf("Import(%s): wrong state:\n got %s\nwant %s", version, got, want)
+		}
+	}
+}
+
+func TestService_Export_golden(t *testing.T) {
+	s := newTestService()
+	err := s.ImportJSON(bytes.NewReader(readGoldenState(t, "state.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	err = s.Export(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	golden := filepath.Join("testdata", "dumps", fmt.Sprintf("v%d", dumpFormat))
+	if goldenDumps[len(goldenDumps)-1].version != filepath.Base(golden) {
+		t.Fatalf("goldenDumps must end with the current format %s", filepath.Base(golden))
+	}
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		if *update {
+			err := os.MkdirAll(filepath.Dir(filepath.Join(golden, name)), 0o755)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(filepath.Join(golden, name), got, 0o644)
+		}
+
+		want, err := os.ReadFile(filepath.Join(golden, name))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Export(): %s doesn't match the golden file:\n got %q\nwant %q", name, got, want)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestService_Import_unsupportedFormat(t *testing.T) {
+	dir := t.TempDir()
+	s := newExportedService(t)
+	err := s.Export(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.Format = dumpFormat + 1
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, manifestName), content, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = newTestService().Import(dir)
+	if !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Import(): must return ErrUnsupportedFormat, returned %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package wallet
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darkside1809/wallet/pkg/types"
+)
+
+var ErrInvalidCursor = errors.New("invalid history cursor")
+
+// DefaultHistoryLimit is the size of history pages when the query sets none.
+const DefaultHistoryLimit = 100
+
+// HistoryQuery selects the payments of an account by the time they were
+// made.
+type HistoryQuery struct {
+	AccountID int64
+	// From and To bound the creation time to [From, To); a zero time leaves
+	// its end of the range open.
+	From time.Time
+	To   time.Time
+	// Limit is the most payments a page holds; zero means
+	// DefaultHistoryLimit.
+	Limit int
+	// Cursor continues after the page that returned it; empty starts from
+	// the beginning of the range.
+	Cursor string
+}
+
+// HistoryPage is one page of the payments selected by a HistoryQuery.
+type HistoryPage struct {
+	Payments []types.Payment
+	// Next is the cursor of the following page, empty on the last one.
+	Next string
+}
+
+// AccountHistory returns a page of the payments of an account made in the
+// range of the query, ordered by creation time and then by ID. A cursor
+// points between two payments rather than at an offset, so payments made
+// while paging don't shift the following pages; those made after the cursor
+// show up on them.
+func (s *Service) AccountHistory(query HistoryQuery) (*HistoryPage, error) {
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultHistoryLimit
+	}
+
+	var after *historyPosition
+	if query.Cursor != "" {
+		position, err := parseHistoryCursor(query.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		after = &position
+	}
+
+	var selected []types.Payment
+	err := s.store().View(func(tx Tx) error {
+		_, err := tx.Accounts().ByID(query.AccountID)
+		if err != nil {
+			return err
+		}
+
+		// The history is in order, so the page starts after both the
+		// cursor and From, and one payment past it tells if there is more.
+		history := tx.Payments().ByAccount(query.AccountID)
+		start := 0
+		if !query.From.IsZero() {
+			start = sort.Search(len(history), func(i int) bool {
+				return !history[i].CreatedAt.Before(query.From)
+			})
+		}
+		if after != nil {
+			next := sort.Search(len(history), func(i int) bool {
+				return after.before(history[i])
+			})
+			if next > start {
+				start = next
+			}
+		}
+
+		for _, payment := range history[start:] {
+			if len(selected) > limit || !query.To.IsZero() && !payment.CreatedAt.Before(query.To) {
+				break
+			}
+			selected = append(selected, *payment)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	page := &HistoryPage{Payments: selected}
+	if len(selected) > limit {
+		page.Payments = selected[:limit:limit]
+		page.Next = historyPositionOf(&selected[limit-1]).cursor()
+	}
+	return page, nil
+}
+
+// historyPosition is the place of a payment in the history order.
+type historyPosition struct {
+	createdAt time.Time
+	id        string
+}
+
+func historyPositionOf(payment *types.Payment) historyPosition {
+	return historyPosition{createdAt: payment.CreatedAt, id: payment.ID}
+}
+
+// before tells if the position comes before the payment.
+func (p historyPosition) before(payment *types.Payment) bool {
+	if !p.createdAt.Equal(payment.CreatedAt) {
+		return p.createdAt.Before(payment.CreatedAt)
+	}
+	return p.id < payment.ID
+}
+
+// cursor encodes the position as the seconds and nanoseconds of its time and
+// the payment ID.
+func (p historyPosition) cursor() string {
+	raw := strconv.FormatInt(p.createdAt.Unix(), 10) + ":" + strconv.Itoa(p.createdAt.Nanosecond()) + ":" + p.id
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseHistoryCursor(cursor string) (historyPosition, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return historyPosition{}, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+
+	parts := strings.SplitN(string(raw), ":", 3)
+	if len(parts) != 3 {
+		return historyPosition{}, fmt.Errorf("%w: %q", ErrInvalidCursor, cursor)
+	}
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return historyPosition{}, fmt.Errorf("%w: %q", ErrInvalidCursor, cursor)
+	}
+	nsec, err := strconv.Atoi(parts[1])
+	if err != nil || nsec < 0 || nsec >= int(time.Second) {
+		return historyPosition{}, fmt.Errorf("%w: %q", ErrInvalidCursor, cursor)
+	}
+
+	return historyPosition{createdAt: time.Unix(sec, int64(nsec)).UTC(), id: parts[2]}, nil
+}
@@ -0,0 +1,173 @@
+package wallet
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/darkside1809/wallet/pkg/types"
+	"github.com/darkside1809/wallet/pkg/wallet/wallettest"
+)
+
+func TestService_Pay_times(t *testing.T) {
+	s := NewService(nil, WithClock(wallettest.NewClock(testStart, time.Minute)))
+	account, err := s.RegisterAccount("+992000000001")
+	if err == nil {
+		err = s.Deposit(account.ID, 100)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The deposit was made at testStart.
+	made := testStart.Add(time.Minute)
+	payment, err := s.Pay(account.ID, 10, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !payment.CreatedAt.Equal(made) || !payment.UpdatedAt.Equal(made) || !payment.SettledAt.IsZero() {
+		t.Errorf("Pay(): wrong times %v, %v, %v", payment.CreatedAt, payment.UpdatedAt, payment.SettledAt)
+	}
+
+	err = s.Reject(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected, err := s.FindPaymentByID(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settled := made.Add(time.Minute)
+	if !rejected.CreatedAt.Equal(made) || !rejected.UpdatedAt.Equal(settled) || !rejected.SettledAt.Equal(settled) {
+		t.Errorf("Reject(): wrong times %v, %v, %v", rejected.CreatedAt, rejected.UpdatedAt, rejected.SettledAt)
+	}
+}
+
+// newHistoryQueryService returns a service with two accounts, the first of
+// which made the given number of payments a minute apart, after both were
+// deposited into at testStart and a minute later.
+func newHistoryQueryService(t *testing.T, payments int) (*Service, *types.Account) {
+	t.Helper()
+
+	s := NewService(nil, WithClock(wallettest.NewClock(testStart, time.Minute)))
+	account, err := s.RegisterAccount("+992000000001")
+	if err == nil {
+		err = s.Deposit(account.ID, 1_000)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := s.RegisterAccount("+992000000002")
+	if err == nil {
+		err = s.Deposit(other.ID, 1_000)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < payments; i++ {
+		_, err := s.Pay(account.ID, 1, "auto")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = s.Pay(other.ID, 1, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, account
+}
+
+func TestService_AccountHistory_pages(t *testing.T) {
+	s, account := newHistoryQueryService(t, 10)
+
+	// Payments made at 9:02 up to 9:08, seven of them, in pages of three.
+	query := HistoryQuery{
+		AccountID: account.ID,
+		From:      testStart.Add(2 * time.Minute),
+		To:        testStart.Add(9 * time.Minute),
+		Limit:     3,
+	}
+	var got []types.Payment
+	pages := 0
+	for {
+		page, err := s.AccountHistory(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		got = append(got, page.Payments...)
+		if page.Next == "" {
+			break
+		}
+		query.Cursor = page.Next
+
+		if pages > 3 {
+			t.Fatal("AccountHistory(): too many pages")
+		}
+	}
+
+	if pages != 3 || len(got) != 7 {
+		t.Fatalf("AccountHistory(): got %d payments in %d pages, want 7 in 3", len(got), pages)
+	}
+	for i, payment := range got {
+		want := testStart.Add(time.Duration(i+2) * time.Minute)
+		if payment.AccountID != account.ID || !payment.CreatedAt.Equal(want) {
+			t.Errorf("AccountHistory(): payment %d made at %v by %d, want at %v by %d", i, payment.CreatedAt, payment.AccountID, want, account.ID)
+		}
+	}
+}
+
+func TestService_AccountHistory_sameTime(t *testing.T) {
+	s := newTestService()
+	err := s.store().Update(func(tx Tx) error {
+		err := tx.Accounts().Save(&types.Account{ID: 1, Phone: "+992000000001"})
+		if err != nil {
+			return err
+		}
+		for _, id := range []string{"c", "a", "b"} {
+			err := tx.Payments().Save(&types.Payment{ID: id, AccountID: 1, Amount: 1, Status: types.PaymentStatusOK, CreatedAt: testStart})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := s.AccountHistory(HistoryQuery{AccountID: 1, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, err := s.AccountHistory(HistoryQuery{AccountID: 1, Limit: 2, Cursor: first.Next})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := ""
+	for _, payment := range append(first.Payments, rest.Payments...) {
+		ids += payment.ID
+	}
+	if ids != "abc" || rest.Next != "" {
+		t.Errorf("AccountHistory(): payments made at once must be ordered by ID, got %q, next %q", ids, rest.Next)
+	}
+}
+
+func TestService_AccountHistory_fail(t *testing.T) {
+	s, account := newHistoryQueryService(t, 1)
+
+	_, err := s.AccountHistory(HistoryQuery{AccountID: 100})
+	if err != ErrAccountNotFound {
+		t.Errorf("AccountHistory(): must return ErrAccountNotFound, returned %v", err)
+	}
+
+	for _, cursor := range []string{"%%%", "bm9wZQ", "MTox"} {
+		_, err = s.AccountHistory(HistoryQuery{AccountID: account.ID, Cursor: cursor})
+		if !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("AccountHistory(%q): must return ErrInvalidCursor, returned %v", cursor, err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/darkside1809/wallet/pkg/types"
+)
+
+var ErrNotRefundable = errors.New("payment can't be refunded")
+var ErrRefundTooLarge = errors.New("refund exceeds the payment")
+
+// Reasons of the refunds made when a payment settles without going through.
+const (
+	RefundReasonRejected = "rejected"
+	RefundReasonExpired  = "expired"
+)
+
+// Refund returns part of a confirmed payment to its account. Payments may be
+// refunded several times until all of their amount is returned; the amount
+// of the payment itself never changes, its Refunded total grows instead.
+func (s *Service) Refund(paymentID string, amount types.Money, reason string) (*types.Refund, error) {
+	if amount <= 0 {
+		return nil, ErrAmountMustBePositive
+	}
+
+	var refund *types.Refund
+	err := s.update("Refund", []interface{}{paymentID, amount, reason}, &refund, func(tx Tx) error {
+		payment, err := tx.Payments().ByID(paymentID)
+		if err != nil {
+			return err
+		}
+		if payment.Status != types.PaymentStatusOK {
+			return fmt.Errorf("%w: payment %s is %s", ErrNotRefundable, paymentID, payment.Status)
+		}
+		if payment.LinkedID != "" {
+			return fmt.Errorf("%w: payment %s is a transfer", ErrNotRefundable, paymentID)
+		}
+
+		payment.UpdatedAt = s.now()
+		refund, err = s.refund(tx, payment, amount, reason, types.LedgerKindRefund)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return refund, nil
+}
+
+// Refunds returns the refunds of a payment in the order they were made.
+func (s *Service) Refunds(paymentID string) ([]types.Refund, error) {
+	var refunds []types.Refund
+
+	err := s.store().View(func(tx Tx) error {
+		_, err := tx.Payments().ByID(paymentID)
+		if err != nil {
+			return err
+		}
+
+		for _, refund := range tx.Refunds().ByPayment(paymentID) {
+			refunds = append(refunds, *refund)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return refunds, nil
+}
+
+// refund returns the amount of a payment to its account, recording the
+// refund and posting it to the ledger as the kind at the time the payment
+// was last updated.
+func (s *Service) refund(tx Tx, payment *types.Payment, amount types.Money, reason string, kind types.LedgerKind) (*types.Refund, error) {
+	if amount > payment.Amount-payment.Refunded {
+		return nil, fmt.Errorf("%w: %d left of payment %s", ErrRefundTooLarge, payment.Amount-payment.Refunded, payment.ID)
+	}
+
+	account, err := tx.Accounts().ByID(payment.AccountID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = credit(account, types.Amount{Value: amount, Currency: payment.Currency})
+	if err != nil {
+		return nil, err
+	}
+	payment.Refunded += amount
+	refund := &types.Refund{
+		ID:        s.newID(),
+		PaymentID: payment.ID,
+		AccountID: payment.AccountID,
+		Amount:    amount,
+		Reason:    reason,
+		CreatedAt: payment.UpdatedAt,
+	}
+
+	err = tx.Accounts().Save(account)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Payments().Save(payment)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Refunds().Add(refund)
+	if err != nil {
+		return nil, err
+	}
+	err = postTransfer(tx, kind, payment.ID, refund.CreatedAt, CurrencyLedger(LedgerPayments, payment.Currency), AccountLedger(payment.AccountID), types.Amount{Value: amount, Currency: payment.Currency})
+	if err != nil {
+		return nil, err
+	}
+
+	return refund, nil
+}
@@ -0,0 +1,241 @@
+package wallet
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/darkside1809/wallet/pkg/types"
+	"github.com/darkside1809/wallet/pkg/wallet/wallettest"
+)
+
+func TestService_Refund_partial(t *testing.T) {
+	s := newTestService()
+	_, payments, err := s.addAccount(lifecycleTestAccount)
+	if err == nil {
+		err = s.Confirm(payments[0].ID)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment := payments[0]
+
+	for _, amount := range []types.Money{10, 15, 5} {
+		_, err := s.Refund(payment.ID, amount, "returned")
+		if err != nil {
+			t.Fatalf("Refund(%d): error = %v", amount, err)
+		}
+	}
+	_, err = s.Refund(payment.ID, 1, "returned")
+	if !errors.Is(err, ErrRefundTooLarge) {
+		t.Errorf("Refund(): must return ErrRefundTooLarge once all is refunded, returned %v", err)
+	}
+
+	saved, err := s.FindPaymentByID(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Amount != 30 || saved.Refunded != 30 || saved.Status != types.PaymentStatusOK {
+		t.Errorf("Refund(): must keep the amount and count the refunds, got %+v", saved)
+	}
+	account, err := s.FindAccountByID(payment.AccountID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance != 100 {
+		t.Errorf("Refund(): balance must be 100, got %d", account.Balance)
+	}
+
+	refunds, err := s.Refunds(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refunds) != 3 || refunds[0].Amount != 10 || refunds[1].Amount != 15 || refunds[2].Amount != 5 {
+		t.Errorf("Refunds(): got %+v", refunds)
+	}
+	for _, refund := range refunds {
+		if refund.PaymentID != payment.ID || refund.AccountID != payment.AccountID || refund.Reason != "returned" {
+			t.Errorf("Refunds(): refund not linked to the payment %+v", refund)
+		}
+	}
+}
+
+func TestService_SumPayments_refunded(t *testing.T) {
+	s := newTestServiceWith(nil)
+	account := s.mustAddAccount(t, testAccount{phone: "+992000000001", balance: 100})
+	rejected, err := s.Pay(account.ID, 40, "auto")
+	if err == nil {
+		err = s.Reject(rejected.ID)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	refunded, err := s.Pay(account.ID, 10, "food")
+	if err == nil {
+		err = s.Confirm(refunded.ID)
+	}
+	if err == nil {
+		_, err = s.Refund(refunded.ID, 4, "returned")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[types.Currency]types.Money{types.DefaultCurrency: 6}
+	if got := s.SumPayments(2); !reflect.DeepEqual(got, want) {
+		t.Errorf("SumPayments(): must count what was paid less what was returned, got %v, want %v", got, want)
+	}
+	var got types.Money
+	for progress := range s.SumPaymentsWithProgress() {
+		got += progress.Result
+	}
+	if got != 6 {
+		t.Errorf("SumPaymentsWithProgress(): got %d, want 6", got)
+	}
+}
+
+func TestService_Refund_fail(t *testing.T) {
+	s := newTestService()
+	_, payments, err := s.addAccount(lifecycleTestAccount)
+	if err == nil {
+		err = s.Confirm(payments[0].ID)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment := payments[0]
+
+	_, err = s.Refund(payment.ID, 0, "returned")
+	if err != ErrAmountMustBePositive {
+		t.Errorf("Refund(): must return ErrAmountMustBePositive, returned %v", err)
+	}
+	_, err = s.Refund(payment.ID, 31, "returned")
+	if !errors.Is(err, ErrRefundTooLarge) {
+		t.Errorf("Refund(): must return ErrRefundTooLarge, returned %v", err)
+	}
+	_, err = s.Refund("unknown", 1, "returned")
+	if err != ErrPaymentNotFound {
+		t.Errorf("Refund(): must return ErrPaymentNotFound, returned %v", err)
+	}
+	_, err = s.Refunds("unknown")
+	if err != ErrPaymentNotFound {
+		t.Errorf("Refunds(): must return ErrPaymentNotFound, returned %v", err)
+	}
+
+	for _, status := range []types.PaymentStatus{types.PaymentStatusInProgress, types.PaymentStatusFail, types.PaymentStatusExpired} {
+		s := newTestService()
+		_, payments, err := s.addAccount(lifecycleTestAccount)
+		if err == nil && status != types.PaymentStatusInProgress {
+			err = lifecycleActions[status](s.Service, payments[0].ID)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		payment := payments[0]
+		before, _ := s.FindAccountByID(payment.AccountID)
+
+		_, err = s.Refund(payment.ID, 1, "returned")
+		if !errors.Is(err, ErrNotRefundable) {
+			t.Errorf("Refund(%s): must return ErrNotRefundable, returned %v", status, err)
+		}
+		after, _ := s.FindAccountByID(payment.AccountID)
+		if after.Balance != before.Balance {
+			t.Errorf("Refund(%s): balance must stay %d, got %d", status, before.Balance, after.Balance)
+		}
+	}
+}
+
+func TestService_Reject_refund(t *testing.T) {
+	for status, reason := range map[types.PaymentStatus]string{
+		types.PaymentStatusFail:    RefundReasonRejected,
+		types.PaymentStatusExpired: RefundReasonExpired,
+	} {
+		s := newTestService()
+		_, payments, err := s.addAccount(lifecycleTestAccount)
+		if err == nil {
+			err = lifecycleActions[status](s.Service, payments[0].ID)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		payment := payments[0]
+
+		saved, err := s.FindPaymentByID(payment.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved.Amount != 30 || saved.Refunded != 30 {
+			t.Errorf("%s: must keep the amount and refund it all, got %+v", status, saved)
+		}
+
+		refunds, err := s.Refunds(payment.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(refunds) != 1 || refunds[0].Amount != 30 || refunds[0].Reason != reason || !refunds[0].CreatedAt.Equal(saved.SettledAt) {
+			t.Errorf("%s: wrong refunds %+v", status, refunds)
+		}
+	}
+}
+
+func TestService_Refunds_persisted(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewService(storage, WithClock(wallettest.NewClock(testStart, time.Minute)), WithIDGenerator(&wallettest.IDs{Prefix: "id-"}))
+	account, err := s.RegisterAccount("+992000000001")
+	if err == nil {
+		err = s.Deposit(account.ID, 100)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment, err := s.Pay(account.ID, 30, "auto")
+	if err == nil {
+		err = s.Confirm(payment.ID)
+	}
+	if err == nil {
+		_, err = s.Refund(payment.ID, 10, "damaged")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err = OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	got, err := NewService(storage).Refunds(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []types.Refund{
+		{ID: "id-2", PaymentID: payment.ID, AccountID: account.ID, Amount: 10, Reason: "damaged", CreatedAt: testStart.Add(3 * time.Minute)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Refunds(): got %+v, want %+v", got, want)
+	}
+}
+
+func TestService_ImportJSON_refundedTooMuch(t *testing.T) {
+	s := newTestService()
+	state := `{"nextAccountId":2,
+"accounts":[{"id":1,"phone":"+992000000001","balance":10}],
+"payments":[{"id":"p-1","accountId":1,"amount":10,"refunded":11,"category":"auto","status":"OK"}]}`
+
+	err := s.ImportJSON(strings.NewReader(state))
+	if !errors.Is(err, ErrInvalidField) {
+		t.Errorf("ImportJSON(): must return ErrInvalidField, returned %v", err)
+	}
+}
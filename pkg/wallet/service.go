@@ -2,14 +2,14 @@ package wallet
 
 import (
 	"errors"
+	"fmt"
+	"github.com/darkside1809/wallet/pkg/types"
 	"io"
 	"log"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
-	"github.com/darkside1809/wallet/pkg/types"
-	"github.com/google/uuid"
+	"time"
 )
 
 var ErrPhoneRegistered = errors.New("phone already registered")
@@ -21,75 +21,222 @@ var ErrFavoriteNotFound = errors.New("favorite payment not found")
 var ErrMinRecords = errors.New("write at least 1 record")
 var exErr = errors.New("doesn't match to expected")
 
+// Service is safe for concurrent use: every method runs in a single storage
+// transaction, so checks and the writes depending on them are atomic. Methods
+// return copies of the stored accounts, payments and favorites, so callers
+// never share state with the service and must look records up again to
+// observe later changes.
+//
+// The zero value keeps its state in memory; use NewService for any other
+// storage.
 type Service struct {
-	nextAccountID	int64
-	accounts			[]*types.Account
-	payments			[]*types.Payment
-	favorites		[]*types.Favorite
+	storage Storage
+	once    sync.Once
+	// keys encrypts the files the service writes, if set.
+	keys KeyProvider
+	// plaintext lets the service read files that aren't encrypted even
+	// though it has keys.
+	plaintext bool
+	// compressHistory makes HistoryToFiles gzip its shards.
+	compressHistory bool
+	clock           Clock
+	ids             IDGenerator
+	// holdTTL is how long holds last; zero means DefaultHoldTTL.
+	holdTTL time.Duration
+	// idempotencyWindow is how long idempotency keys are kept; zero means
+	// DefaultIdempotencyWindow.
+	idempotencyWindow time.Duration
+	// idempotencyKey is the key the mutating methods run under, set on the
+	// views returned by Idempotent.
+	idempotencyKey string
 }
 
+// Option configures a Service.
+type Option func(s *Service)
 
-func (s *Service) RegisterAccount(phone types.Phone) (*types.Account, error) {
+// NewService returns a service keeping its state in storage; a nil storage
+// keeps it in memory.
+func NewService(storage Storage, opts ...Option) *Service {
+	s := &Service{storage: storage}
+	for _, opt := range opts {
+		opt(s)
+	}
 
-	for _, account := range s.accounts {
-		if account.Phone == phone {
-			return nil, ErrPhoneRegistered
+	return s
+}
+
+func (s *Service) store() Storage {
+	s.once.Do(func() {
+		if s.storage == nil {
+			s.storage = NewMemoryStorage()
 		}
+	})
+
+	return s.storage
+}
+
+// RegisterAccount registers an account of the phone in DefaultCurrency.
+func (s *Service) RegisterAccount(phone types.Phone) (*types.Account, error) {
+	var account *types.Account
+
+	err := s.update("RegisterAccount", []interface{}{phone}, &account, func(tx Tx) error {
+		var err error
+		account, err = s.registerAccount(tx, phone, types.DefaultCurrency)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return account, nil
+}
+
+// RegisterAccountIn registers an account of the phone in the currency. A
+// phone may have one account in every currency.
+func (s *Service) RegisterAccountIn(phone types.Phone, currency types.Currency) (*types.Account, error) {
+	err := validateCurrency(currency)
+	if err != nil {
+		return nil, err
+	}
+
+	var account *types.Account
+	err = s.update("RegisterAccountIn", []interface{}{phone, currency}, &account, func(tx Tx) error {
+		var err error
+		account, err = s.registerAccount(tx, phone, currency)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return account, nil
+}
+
+func (s *Service) registerAccount(tx Tx, phone types.Phone, currency types.Currency) (*types.Account, error) {
+	_, err := tx.Accounts().ByPhone(phone, currency)
+	if err == nil {
+		return nil, ErrPhoneRegistered
+	}
+	if err != ErrAccountNotFound {
+		return nil, err
 	}
 
-	s.nextAccountID++
 	account := &types.Account{
-		ID: 			s.nextAccountID,
-		Phone: 		phone,
-		Balance: 	0,
+		ID:       tx.Accounts().LastID() + 1,
+		Phone:    phone,
+		Currency: currency,
+		Balance:  0,
 	}
 
-	s.accounts = append(s.accounts, account)
+	err = tx.Accounts().Save(account)
+	if err != nil {
+		return nil, err
+	}
 
 	return account, nil
 }
 
+// Deposit credits the amount to the account in its currency.
 func (s *Service) Deposit(accountID int64, amount types.Money) error {
 	if amount <= 0 {
 		return ErrAmountMustBePositive
 	}
 
-	account, err := s.FindAccountByID(accountID)
-	if err != nil {
+	return s.update("Deposit", []interface{}{accountID, amount}, nil, func(tx Tx) error {
+		account, err := tx.Accounts().ByID(accountID)
+		if err != nil {
+			return err
+		}
+
+		err = credit(account, types.Amount{Value: amount, Currency: account.Currency})
+		if err != nil {
+			return err
+		}
+		err = tx.Accounts().Save(account)
+		if err != nil {
+			return err
+		}
+
+		return postTransfer(tx, types.LedgerKindDeposit, "", s.now(), CurrencyLedger(LedgerCash, account.Currency), AccountLedger(accountID), types.Amount{Value: amount, Currency: account.Currency})
+	})
+}
+
+// Pay checks the balance and debits the account in one transaction, so
+// concurrent payments can never overdraw it. The amount is in the currency
+// of the account.
+func (s *Service) Pay(accountID int64, amount types.Money, category types.PaymentCategory) (*types.Payment, error) {
+	var payment *types.Payment
+
+	err := s.update("Pay", []interface{}{accountID, amount, category}, &payment, func(tx Tx) error {
+		var err error
+		payment, err = s.pay(tx, accountID, amount, "", category, s.now())
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	account.Balance += amount
-	return nil
+	return payment, nil
 }
 
-func (s *Service) Pay(accountID int64, amount types.Money, category types.PaymentCategory) (*types.Payment, error) {
+// pay makes a payment of the amount in the currency at the time, if the
+// available balance of the account covers it. An empty currency is that of
+// the account; any other must match it.
+func (s *Service) pay(tx Tx, accountID int64, amount types.Money, currency types.Currency, category types.PaymentCategory, now time.Time) (*types.Payment, error) {
 	if amount <= 0 {
 		return nil, ErrAmountMustBePositive
 	}
 
-	account, err := s.FindAccountByID(accountID)
+	account, err := tx.Accounts().ByID(accountID)
 	if err != nil {
 		return nil, err
 	}
+	if currency == "" {
+		currency = account.Currency
+	}
 
-	if account.Balance < amount {
+	balance := available(tx, account, now)
+	err = debit(account, types.Amount{Value: amount, Currency: currency})
+	if err != nil {
+		return nil, err
+	}
+	if balance < amount {
 		return nil, ErrNotEnoughBalance
 	}
 
-	account.Balance -= amount
+	err = tx.Accounts().Save(account)
+	if err != nil {
+		return nil, err
+	}
 
-	paymentID := uuid.New().String()
+	paymentID := s.newID()
 
 	payment := &types.Payment{
-		ID:			paymentID,
-		AccountID: 	accountID,
-		Amount: 		amount,
-		Category: 	category,
-		Status: 		types.PaymentStatusInProgress,
+		ID:        paymentID,
+		AccountID: accountID,
+		Amount:    amount,
+		Currency:  currency,
+		Category:  category,
+		Status:    types.PaymentStatusInProgress,
+		Direction: types.PaymentDirectionOut,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	err = tx.Payments().Save(payment)
+	if err != nil {
+		return nil, err
+	}
+
+	err = postTransfer(tx, types.LedgerKindPayment, payment.ID, now, AccountLedger(accountID), CurrencyLedger(LedgerPayments, currency), types.Amount{Value: amount, Currency: currency})
+	if err != nil {
+		return nil, err
 	}
 
-	s.payments = append(s.payments, payment)
+	err = s.recordTransition(tx, payment, "")
+	if err != nil {
+		return nil, err
+	}
 
 	return payment, nil
 }
@@ -97,54 +244,50 @@ func (s *Service) Pay(accountID int64, amount types.Money, category types.Paymen
 func (s *Service) FindAccountByID(accountID int64) (*types.Account, error) {
 	var account *types.Account
 
-	for _, acc := range s.accounts {
-		if acc.ID == accountID {
-			account = acc
-			break
+	err := s.store().View(func(tx Tx) error {
+		var err error
+		account, err = tx.Accounts().ByID(accountID)
+		if err != nil {
+			return err
 		}
-	}
 
-	if account == nil {
-		return nil, ErrAccountNotFound
+		account.Available = available(tx, account, s.now())
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return account, nil
 }
 
 func (s *Service) FindPaymentByID(paymentID string) (*types.Payment, error) {
-	for _, payment := range s.payments {
-		if payment.ID == paymentID {
-			return payment, nil
-		}
-	}
+	var payment *types.Payment
 
-	return nil, ErrPaymentNotFound
-}
-
-func (s *Service) Reject(paymentID string) error {
-	payment, err := s.FindPaymentByID(paymentID)
-	if err != nil {
+	err := s.store().View(func(tx Tx) error {
+		var err error
+		payment, err = tx.Payments().ByID(paymentID)
 		return err
-	}
-
-	account, err := s.FindAccountByID(payment.AccountID)
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	account.Balance += payment.Amount
-	payment.Amount = 0
-	payment.Status = types.PaymentStatusFail
-	return nil
+	return payment, nil
 }
 
 func (s *Service) Repeat(paymentID string) (*types.Payment, error) {
-	payment, err := s.FindPaymentByID(paymentID)
-	if err != nil {
-		return nil, err
-	}
+	var newPayment *types.Payment
+
+	err := s.update("Repeat", []interface{}{paymentID}, &newPayment, func(tx Tx) error {
+		payment, err := repeatablePayment(tx, paymentID)
+		if err != nil {
+			return err
+		}
 
-	newPayment, err := s.Pay(payment.AccountID, payment.Amount, payment.Category)
+		newPayment, err = s.pay(tx, payment.AccountID, payment.Amount, payment.Currency, payment.Category, s.now())
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -153,38 +296,59 @@ func (s *Service) Repeat(paymentID string) (*types.Payment, error) {
 }
 
 func (s *Service) FavoritePayment(paymentID string, name string) (*types.Favorite, error) {
-	payment, err := s.FindPaymentByID(paymentID)
+	var favorite *types.Favorite
+
+	err := s.update("FavoritePayment", []interface{}{paymentID, name}, &favorite, func(tx Tx) error {
+		payment, err := repeatablePayment(tx, paymentID)
+		if err != nil {
+			return err
+		}
+
+		favorite = &types.Favorite{
+			ID:        s.newID(),
+			AccountID: payment.AccountID,
+			Name:      name,
+			Amount:    payment.Amount,
+			Currency:  payment.Currency,
+			Category:  payment.Category,
+		}
+
+		return tx.Favorites().Save(favorite)
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	favorite := &types.Favorite{
-		ID:			uuid.New().String(),
-		AccountID: 	payment.AccountID,
-		Name: 		name,
-		Amount: 		payment.Amount,
-		Category: 	payment.Category,
+	return favorite, nil
+}
+
+// repeatablePayment returns the payment to repeat or keep as a favorite.
+// Either payment of a transfer fails with ErrTransferPayment: paying it
+// again would take the money without moving it to the recipient.
+func repeatablePayment(tx Tx, paymentID string) (*types.Payment, error) {
+	payment, err := tx.Payments().ByID(paymentID)
+	if err != nil {
+		return nil, err
+	}
+	if payment.LinkedID != "" {
+		return nil, fmt.Errorf("%w: payment %s", ErrTransferPayment, paymentID)
 	}
 
-	s.favorites = append(s.favorites, favorite)
-	return favorite, nil
+	return payment, nil
 }
 
 func (s *Service) PayFromFavorite(favoriteID string) (*types.Payment, error) {
-	var targetFavorite *types.Favorite
+	var payment *types.Payment
 
-	for _, favorite := range s.favorites {
-		if favorite.ID == favoriteID {
-			targetFavorite = favorite
-			break
+	err := s.update("PayFromFavorite", []interface{}{favoriteID}, &payment, func(tx Tx) error {
+		targetFavorite, err := tx.Favorites().ByID(favoriteID)
+		if err != nil {
+			return err
 		}
-	}
 
-	if targetFavorite == nil {
-		return nil, ErrFavoriteNotFound
-	}
-
-	payment, err := s.Pay(targetFavorite.AccountID, targetFavorite.Amount, targetFavorite.Category)
+		payment, err = s.pay(tx, targetFavorite.AccountID, targetFavorite.Amount, targetFavorite.Currency, targetFavorite.Category, s.now())
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -194,318 +358,171 @@ func (s *Service) PayFromFavorite(favoriteID string) (*types.Payment, error) {
 
 func (s *Service) ExportToFile(path string) error {
 	content := make([]byte, 0)
-	file, err := os.Create(path)
+	state, err := s.snapshot()
 	if err != nil {
 		return err
 	}
 
-	defer func() {
-		err := file.Close()
-		if err != nil {
-			log.Print(err)
+	for _, account := range state.Accounts {
+		if strings.ContainsAny(string(account.Phone), ";|") {
+			return fmt.Errorf("%w: phone %q of account %d contains a separator", ErrInvalidField, account.Phone, account.ID)
 		}
-	} ()
 
-	for _, account := range s.accounts {
 		content = append(content, []byte(strconv.FormatInt(account.ID, 10))...)
 		content = append(content, []byte(";")...)
 		content = append(content, []byte(account.Phone)...)
 		content = append(content, []byte(";")...)
 		content = append(content, []byte(strconv.FormatInt(int64(account.Balance), 10))...)
+		content = append(content, []byte(";")...)
+		content = append(content, []byte(account.Currency)...)
 		content = append(content, []byte("|")...)
 	}
 
+	file, err := s.create(path)
+	if err != nil {
+		return err
+	}
+
 	_, err = file.Write(content)
 	if err != nil {
 		log.Print(err)
+		file.Close()
 		return err
 	}
-	return nil
-
+	// Closing an encrypted file writes its last chunk.
+	return file.Close()
 }
-func (s *Service) ImportFromFile(path string) error {
-	content := make([]byte, 0)
-	buf := make([]byte, 4)
 
-	file, err := os.Open(path)
+// ImportFromFile loads the accounts written by ExportToFile, with their IDs,
+// balances and currencies, replacing stored accounts with the same IDs.
+// Nothing is stored unless every record is valid.
+func (s *Service) ImportFromFile(path string) error {
+	content, err := readFileContent(path, s.keys, s.plaintext)
 	if err != nil {
 		return err
 	}
 
-	defer func() {
-		err := file.Close()
-		if err != nil {
-			log.Print(err)
+	accounts := []*types.Account{}
+	for i, record := range strings.Split(string(content), "|") {
+		if record == "" {
+			continue
 		}
-	} ()
-	
-	for {
-		read, err := file.Read(buf)
-		if err == io.EOF {
-			content = append(content, buf[:read]...)
-			break
-		}
-
-		content = append(content, buf[:read]...)
-	}
-
-	log.Print(string(content))
 
-	for _, rows := range strings.Split(string(content), "|") {
-		columns := strings.Split(rows, ";")
-		if len(columns) == 3 {
-			s.RegisterAccount(types.Phone(columns[1]))
+		account, err := parseExportedAccount(record)
+		if err != nil {
+			return fmt.Errorf("%s: record %d: %w", path, i+1, err)
 		}
-	}
-	for _, account := range s.accounts {
-		log.Print(account)
+		accounts = append(accounts, account)
 	}
 
-	return nil
-}
-
-func (s *Service) Export(dir string) error {
-	accountFile := ""
-	for _, account := range s.accounts {
-		accounts := strconv.FormatInt(account.ID, 10) + ";" + string(account.Phone) + ";" + strconv.FormatInt(int64(account.Balance), 10) + "\r\n"
-		accountFile += accounts
-	}
-	if len(accountFile) > 0 {
-		accountPath := dir + "/accounts.dump"
-		accounts, err1 := os.Create(accountPath)
-		if err1 != nil {
-			log.Print(err1)
-		return err1
-		}
-		_, accErr := accounts.Write([]byte(accountFile))
-		if accErr != nil {
-			log.Print(accErr)
-		}
-		defer func ()  {
-			err := accounts.Close()
-			if err != nil {
-				log.Print(err)
-				return
+	return s.store().Update(func(tx Tx) error {
+		now := s.now()
+		for _, account := range accounts {
+			err := tx.Accounts().Save(account)
+			if err == nil {
+				err = adjustLedger(tx, account, now)
 			}
-		}()
-	}	
-
-	paymentFile := ""
-	for _, payment := range s.payments {
-		payments := string(payment.ID) + ";" + strconv.FormatInt(payment.AccountID, 10) + ";" + strconv.FormatInt(int64(payment.Amount),10) + ";" +string(payment.Category) + ";" +string(payment.Status) + "\r\n"
-		paymentFile += payments
-	}
-	if len(paymentFile) > 0 {
-		payPath := dir +"/payments.dump"
-		paymentsFile, err2 := os.Create(payPath)
-		if err2 != nil {
-			log.Print(err2)
-		return err2
-		}
-		_, payErr := paymentsFile.Write([]byte(paymentFile))
-		if payErr != nil {
-			log.Print(payErr)
-		}
-		defer func ()  {
-			err := paymentsFile.Close()
 			if err != nil {
-				log.Print(err)
-				return
+				return fmt.Errorf("%s: account %d: %w", path, account.ID, err)
 			}
-		}()
-	}
-
-	favoriteFile := ""
-	for _, favorite := range s.favorites {
-		favorite := string(favorite.ID) + ";" + strconv.FormatInt(favorite.AccountID,10) + ";" + string(favorite.Name) + ";" +strconv.FormatInt(int64(favorite.Amount),10) + ";" + string(favorite.Category) + "\r\n"
-		favoriteFile += favorite
-	}
-	if len(favoriteFile) > 0 {
-		favoritePath := dir + "/favorites.dump"
-		favFile, err3 := os.Create(favoritePath)
-		if err3 != nil {
-			log.Print(err3)
-		return err3
-		}
-		_, favorites_error := favFile.Write([]byte(favoriteFile))
-		if favorites_error != nil {
-			log.Print(favorites_error)
 		}
-		defer func ()  {
-			err := favFile.Close()
-			if err != nil {
-				log.Print(err)
-				return
-			}
-		}()
-	}
-	return nil	
+
+		return nil
+	})
 }
 
-func (s *Service) Import(dir string) error {
-	// edit accounts file
-	accountPath := dir + "/accounts.dump"
-	accFile, err := os.Open(accountPath)
-	if err != nil{
-		log.Print(err)
-		return err
+// parseExportedAccount parses one id;phone;balance;currency record of
+// ExportToFile. Records written before accounts had a currency leave it out
+// and are in DefaultCurrency.
+func parseExportedAccount(record string) (*types.Account, error) {
+	columns := strings.Split(record, ";")
+	if len(columns) != 3 && len(columns) != 4 {
+		return nil, fmt.Errorf("%w: account has %d, want 4", ErrInvalidRow, len(columns))
 	}
 
-	defer func(){
-		err := accFile.Close()
-		if err != nil {
-			log.Print(err)
-			return
-		}
-	} ()
-	accountContent := make([]byte,0)
-	buf := make([]byte,4)
-
-	for {
-		read_accounts, err := accFile.Read(buf)
-		if err == io.EOF {
-			accountContent = append(accountContent, buf[:read_accounts]...)
-			break
-		}
+	id, err := strconv.ParseInt(columns[0], 10, 64)
+	if err != nil || id <= 0 {
+		return nil, fmt.Errorf("%w: id %q", ErrInvalidField, columns[0])
+	}
+	balance, err := strconv.ParseInt(columns[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: balance %q", ErrInvalidField, columns[2])
+	}
+	currency := types.DefaultCurrency
+	if len(columns) == 4 {
+		currency = types.Currency(columns[3])
+		err = validateCurrency(currency)
 		if err != nil {
-			log.Print(err)
-			return err
+			return nil, err
 		}
-		accountContent = append(accountContent, buf[:read_accounts]...)
 	}
 
-	data := strings.Split(string(accountContent), "\r\n")
-	for _, accounts := range data {
-		if len(accounts)>1{
-		account := strings.Split(accounts, ";")
-		id, err := strconv.ParseInt(account[0],10,64)
-		if err != nil {
-			log.Print(err)
-		}
-		balance,err := strconv.ParseInt(account[2],10,64)
-		if err != nil {
-			log.Print(err)
-		}
-		accountt := &types.Account{
-			ID: id,
-			Phone: types.Phone(account[1]),
-			Balance: types.Money(balance),
-		}
-		s.accounts = append(s.accounts, accountt)
-		}
+	return &types.Account{
+		ID:       id,
+		Phone:    types.Phone(columns[1]),
+		Currency: currency,
+		Balance:  types.Money(balance),
+	}, nil
+}
+
+// Export writes accounts.dump, payments.dump and favorites.dump of one
+// snapshot as a new generation in dir. The files are staged and synced
+// first, and the generation is published by atomically replacing the
+// manifest, so a crash or an error leaves the previous export intact. It
+// fails with ErrInvalidField, writing nothing, if a field holds a separator
+// of the dump format.
+func (s *Service) Export(dir string) error {
+	state, err := s.snapshot()
+	if err != nil {
+		return err
 	}
 
-	//payments
-	paymentPath := dir + "/payments.dump"
-	payFile, err := os.Open(paymentPath)
-	if err != nil{
-		log.Print(err)
+	err = checkDumpFields(state.Accounts, state.Payments, state.Favorites)
+	if err != nil {
 		return err
 	}
-	defer func(){
-		err := payFile.Close()
-		if err != nil {
-			log.Print(err)
-			return
-		}
-	} ()
 
-	paymentContent := make([]byte,0)
-	buff := make([]byte,4)
+	return exportGeneration(dir, dumpFormat, s.keys, []generationFile{
+		{accountsDumpName, func(w io.Writer) (int, error) { return writeAccounts(w, state.Accounts) }},
+		{paymentsDumpName, func(w io.Writer) (int, error) { return writePayments(w, state.Payments) }},
+		{favoritesDumpName, func(w io.Writer) (int, error) { return writeFavorites(w, state.Favorites) }},
+	})
+}
 
-	for {
-		readPayment, err := payFile.Read(buff)
-		if err == io.EOF {
-			paymentContent = append(paymentContent, buff[:readPayment]...)
-			break
-		}
-		if err != nil {
-			log.Print(err)
-			return err
-		}
-		paymentContent = append(paymentContent, buff[:readPayment]...)
-	}
-	
-	dataa := strings.Split(string(paymentContent), "\r\n")
-	for _, payments := range dataa {
-		if len(payments) > 1{
-		payment := strings.Split(payments, ";")
-		id_account, err := strconv.ParseInt(payment[1],10,64)
-		if err != nil {
-			log.Print(err)
-		}
-		amount,err := strconv.ParseInt(payment[2],10,64)
-		if err != nil {
-			log.Print(err)
-		}
-		paymentt := &types.Payment{
-			ID: 			payment[0],
-			AccountID: 	id_account,
-			Amount: 		types.Money(amount),
-			Category: 	types.PaymentCategory(payment[3]),
-			Status: 		types.PaymentStatus(payment[4]),
-		}
-		s.payments = append(s.payments, paymentt)
-		}
+// snapshot returns the stored records as of one point in time, without
+// blocking writers while the caller works with them.
+func (s *Service) snapshot() (*storageState, error) {
+	state := &storageState{}
+
+	err := s.store().View(func(tx Tx) error {
+		state.LastAccountID = tx.Accounts().LastID()
+		state.Accounts = append(state.Accounts, tx.Accounts().All()...)
+		state.Payments = append(state.Payments, tx.Payments().All()...)
+		state.Favorites = append(state.Favorites, tx.Favorites().All()...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
+	return state, nil
+}
 
-	//favorites
-	favPath := dir + "/favorites.dump"
-	favoriteFile, err := os.Open(favPath)
-	if err == nil{
+func (s *Service) allPayments() []*types.Payment {
+	var payments []*types.Payment
 
-	defer func(){
-		err := favoriteFile.Close()
-		if err != nil {
-			log.Print(err)
-			return
-		}
-	} ()
-	favoriteContent := make([]byte,0)
-	bufff := make([]byte,4)
-	for {
-		read_favorite, err := favoriteFile.Read(bufff)
-		if err == io.EOF {
-			favoriteContent = append(favoriteContent, bufff[:read_favorite]...)
-			break
-		}
-		if err != nil {
-			log.Print(err)
-			return err
-		}
-		favoriteContent = append(favoriteContent, bufff[:read_favorite]...)
-	}
-	dataaa := strings.Split(string(favoriteContent), "\r\n")
-	for _, favorites := range dataaa {
-		if len(favorites)>1{
-		favorite := strings.Split(favorites, ";")
-		id_account, err := strconv.ParseInt(favorite[1],10,64)
-		if err != nil {
-			log.Print(err)
-		}
-		amount,err := strconv.ParseInt(favorite[3],10,64)
-		if err != nil {
-			log.Print(err)
-		}
-		favoritee := &types.Favorite{
-			ID: favorite[0],
-			AccountID: id_account,
-			Name: favorite[2],
-			Amount: types.Money(amount),
-			Category: types.PaymentCategory(favorite[4]),
-		}
-		s.favorites = append(s.favorites,favoritee)
-		}
-	}
-	}
-	return nil
+	s.store().View(func(tx Tx) error {
+		payments = append(payments, tx.Payments().All()...)
+		return nil
+	})
+
+	return payments
 }
 
 func (s *Service) ExportAccountHistory(accountID int64) ([]types.Payment, error) {
 	accPayments := []types.Payment{}
 
-	for _, payments := range s.payments {
+	for _, payments := range s.allPayments() {
 		if accountID == payments.AccountID {
 			accPayments = append(accPayments, *payments)
 		}
@@ -518,89 +535,76 @@ func (s *Service) ExportAccountHistory(accountID int64) ([]types.Payment, error)
 	return accPayments, nil
 }
 
+// HistoryToFiles writes payments into dir, in order, as shards of the given
+// number of records: payments.dump if they all fit in one, and otherwise
+// payments1.dump, payments2.dump and so on. The shards are listed with their
+// checksums in a manifest, written last, which VerifyHistory checks and
+// HistoryFromFiles reads back. Like Export, it refuses fields holding a
+// separator of the dump format.
 func (s *Service) HistoryToFiles(payments []types.Payment, dir string, records int) error {
 	if records <= 0 {
 		return ErrMinRecords
 	}
-	
-	path := dir + "/payments.dump"
-	res := ""
-	if len(payments) > 0 && len(payments) <= records {
-		for _, payment := range s.payments {
-			content := string(payment.ID) + ";" + strconv.FormatInt(payment.AccountID, 10) + ";" +strconv.FormatInt(int64(payment.Amount),10) + ";" +string(payment.Category)+ ";" +string(payment.Status) + "\r\n"
-			res += content
-		}
-		file, err := os.Create(path)
+	for i := range payments {
+		err := checkDumpRow("payment", payments[i].ID, paymentFields(&payments[i]))
 		if err != nil {
-			log.Print(err)
+			return err
 		}
-		defer func() {
-			err := file.Close()
+	}
+
+	history := s.newHistoryWriter(dir)
+	if len(payments) <= records {
+		if len(payments) > 0 {
+			err := history.shard(paymentsDumpName, payments)
 			if err != nil {
-				log.Print(err)
+				return err
 			}
-		}()
-		_, err1 := file.Write([]byte(res))
-		if err1 != nil {
-			log.Print(err)
 		}
-		return nil
-
-	} else {
+		return history.close()
+	}
 
-		var i, j int = 1, 0
-		for _, payment := range payments {
-			content := string(payment.ID) + ";" + strconv.FormatInt(payment.AccountID, 10) + ";" +strconv.FormatInt(int64(payment.Amount),10) + ";" +string(payment.Category) + ";" + string(payment.Status) + "\r\n"
-			res += content
-			if j == 0 {
-				path := dir + "/payments" + strconv.Itoa(i) + ".dump"
-				file, err := os.Create(path)
-				if err != nil {
-					log.Print(err)
-				}
-				_, err2 := file.Write([]byte(res))
-				if err2 != nil {
-					log.Print(err)
-				}
-				file.Close()
-			}
-			j++
+	for n := 1; len(payments) > 0; n++ {
+		shard := payments
+		if len(shard) > records {
+			shard = shard[:records]
+		}
+		payments = payments[len(shard):]
 
-			if j == records {
-				i++
-				j = 0 
-				res = ""
-			}
+		err := history.shard(historyShardName(n), shard)
+		if err != nil {
+			return err
 		}
-		return nil
-	}	
+	}
+	return history.close()
 }
 
-func (s *Service) SumPayments(goroutines int) types.Money {
+// SumPayments adds up the amounts of all payments out of accounts by
+// currency, so a transfer counts once, using the goroutines to sum parts of
+// them.
+func (s *Service) SumPayments(goroutines int) map[types.Currency]types.Money {
+	all := s.allPayments()
 	value := 0
 
 	if goroutines == 0 {
-		value = len(s.payments)
+		value = len(all)
 	} else {
-		value = int(len(s.payments) / goroutines)
+		value = int(len(all) / goroutines)
 	}
 
-	sum := int64(0)
+	sum := map[types.Currency]types.Money{}
 	i := 0
 	wg := sync.WaitGroup{}
 	mu := sync.Mutex{}
 
-	for i = 0; i < goroutines - 1; i++ {
+	for i = 0; i < goroutines-1; i++ {
 		wg.Add(1)
 		go func(index int) {
 			defer wg.Done()
-			val := int64(0)
-			pays := s.payments[index * value : (index + 1) * value]
-			for _, payment := range pays {
-				val += int64(payment.Amount)
-			}
+			val := sumPayments(all[index*value : (index+1)*value])
 			mu.Lock()
-			sum += val
+			for currency, amount := range val {
+				sum[currency] += amount
+			}
 			mu.Unlock()
 
 		}(i)
@@ -609,21 +613,35 @@ func (s *Service) SumPayments(goroutines int) types.Money {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		val := int64(0)
-		pays:= s.payments[i * value:]
-		for _, payment := range pays {
-			val += int64(payment.Amount)
-		}
+		val := sumPayments(all[i*value:])
 		mu.Lock()
-		sum += val
+		for currency, amount := range val {
+			sum[currency] += amount
+		}
 		mu.Unlock()
 
 	}()
 	wg.Wait()
-	return types.Money(sum)
+	return sum
+}
+
+// sumPayments adds up the amounts of the payments out of accounts by
+// currency, less what was refunded or returned by a rejection or expiry,
+// skipping the payments into the recipients of transfers. Amounts in
+// different currencies are never added together.
+func sumPayments(payments []*types.Payment) map[types.Currency]types.Money {
+	sums := map[types.Currency]types.Money{}
+	for _, payment := range payments {
+		if payment.Direction != types.PaymentDirectionIn {
+			sums[currencyOrDefault(payment.Currency)] += payment.Amount - payment.Refunded
+		}
+	}
+
+	return sums
 }
 
 func (s *Service) FilterPayments(accountID int64, goroutines int) ([]types.Payment, error) {
+	all := s.allPayments()
 	payments := []types.Payment{}
 	account, err := s.FindAccountByID(accountID)
 
@@ -636,26 +654,20 @@ func (s *Service) FilterPayments(accountID int64, goroutines int) ([]types.Payme
 	counter := 0
 
 	if goroutines == 0 {
-		counter = len(s.payments)
+		counter = len(all)
 	} else {
-		counter = int(len(s.payments) / goroutines)
+		counter = int(len(all) / goroutines)
 	}
 
-	for i = 0; i < goroutines - 1 ; i++ {
+	for i = 0; i < goroutines-1; i++ {
 		wg.Add(1)
 		go func(index int) {
 			defer wg.Done()
 			pays := []types.Payment{}
-			allPayments := s.payments[index * counter : (index + 1) * counter]
+			allPayments := all[index*counter : (index+1)*counter]
 			for _, p := range allPayments {
 				if p.AccountID == account.ID {
-					pays = append(pays, types.Payment{
-						ID: 		  p.ID,
-						AccountID: p.AccountID,
-						Amount:    p.Amount,
-						Category:  p.Category,
-						Status:    p.Status,
-					})
+					pays = append(pays, *p)
 				}
 			}
 			mutex.Lock()
@@ -667,16 +679,10 @@ func (s *Service) FilterPayments(accountID int64, goroutines int) ([]types.Payme
 	go func() {
 		defer wg.Done()
 		var pays []types.Payment
-		allPayments := s.payments[i * counter:]
+		allPayments := all[i*counter:]
 		for _, p := range allPayments {
 			if p.AccountID == account.ID {
-				pays = append(pays, types.Payment{
-					ID:        p.ID,
-					AccountID: p.AccountID,
-					Amount:    p.Amount,
-					Category:  p.Category,
-					Status:    p.Status,
-				})
+				pays = append(pays, *p)
 			}
 		}
 		mutex.Lock()
@@ -685,7 +691,6 @@ func (s *Service) FilterPayments(accountID int64, goroutines int) ([]types.Payme
 
 	}()
 
-
 	wg.Wait()
 	if len(payments) == 0 {
 		return nil, nil
@@ -693,114 +698,96 @@ func (s *Service) FilterPayments(accountID int64, goroutines int) ([]types.Payme
 	return payments, nil
 }
 
-func (s *Service) FilterPaymentsByFn(filter func(payment types.Payment) bool, goroutines int,) ([]types.Payment, error){
-		count := 0
-		i := 0
+func (s *Service) FilterPaymentsByFn(filter func(payment types.Payment) bool, goroutines int) ([]types.Payment, error) {
+	all := s.allPayments()
+	count := 0
+	i := 0
 
-		if goroutines == 0{
-			count = len(s.payments)
-		} else {
-			count = int(len(s.payments)/goroutines)
-		}
-		wg := sync.WaitGroup{}
-		mu := sync.Mutex{}
-		result := []types.Payment{}
+	if goroutines == 0 {
+		count = len(all)
+	} else {
+		count = int(len(all) / goroutines)
+	}
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	result := []types.Payment{}
 
-		for i = 0; i <= goroutines - 1; i++{
-			wg.Add(1)
-			go func(number int){
-				defer wg.Done()
-				var pay []types.Payment
-				payments:= s.payments[count * number : (count)  *(number + 1)]
-				for _, payment := range payments{
-						pays := types.Payment{
-							ID: 			payment.ID,
-							AccountID: 	payment.AccountID,
-							Amount: 		payment.Amount,
-							Category: 	payment.Category,
-							Status: 		payment.Status,
-						}
-						if filter(pays) {
-							pay = append(pay, pays)
-						}				
-				}
-				mu.Lock()
-				result=append(result, pay...)
-				mu.Unlock()
-			}(i)
-		}
+	for i = 0; i <= goroutines-1; i++ {
 		wg.Add(1)
-		go func(){
+		go func(number int) {
 			defer wg.Done()
 			var pay []types.Payment
-			payments := s.payments[i*count:]
-			for _, payment:= range payments{
-					pays := types.Payment{
-						ID: 			payment.ID,
-						AccountID: 	payment.AccountID,
-						Amount:		payment.Amount,
-						Category: 	payment.Category,
-						Status: 		payment.Status,
-					}
-					if filter(pays) {
-						pay = append(pay, pays)
-					}	
+			payments := all[count*number : (count)*(number+1)]
+			for _, payment := range payments {
+				pays := *payment
+				if filter(pays) {
+					pay = append(pay, pays)
+				}
 			}
 			mu.Lock()
 			result = append(result, pay...)
 			mu.Unlock()
-		}()
-
-		wg.Wait()
-		if len(result) == 0 {
-			return nil, ErrAccountNotFound
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var pay []types.Payment
+		payments := all[i*count:]
+		for _, payment := range payments {
+			pays := *payment
+			if filter(pays) {
+				pay = append(pay, pays)
+			}
 		}
+		mu.Lock()
+		result = append(result, pay...)
+		mu.Unlock()
+	}()
 
-		return result, nil
+	wg.Wait()
+	if len(result) == 0 {
+		return nil, ErrAccountNotFound
+	}
+
+	return result, nil
 }
 
+// SumPaymentsWithProgress sums a snapshot of the payments taken when it is
+// called. Every part sends its sum in each currency it holds, which readers
+// add up by Currency. The channel is buffered for all of them, so an
+// abandoned reader doesn't leak the goroutines.
 func (s *Service) SumPaymentsWithProgress() <-chan types.Progress {
-	channel := make(chan types.Progress)
-	wg := sync.WaitGroup{}
+	all := s.allPayments()
+	currencies := len(sumPayments(all))
+	if currencies == 0 {
+		currencies = 1
+	}
 
 	number := 100_000
 	i := 0
 
-	goroutines := int(len(s.payments) / number)
+	goroutines := int(len(all) / number)
 	if goroutines < 1 {
 		goroutines = 1
-		number = len(s.payments)
+		number = len(all)
 	}
+
+	channel := make(chan types.Progress, (goroutines+1)*currencies)
+	wg := sync.WaitGroup{}
 	if goroutines > 1 {
-		for i = 0; i <= goroutines - 1; i++ {
+		for i = 0; i <= goroutines-1; i++ {
 			wg.Add(1)
-			go func(ch chan <- types.Progress, num int) {
-				sum := types.Money(0)
+			go func(ch chan<- types.Progress, num int) {
 				defer wg.Done()
-				pays := s.payments[number * num : number * (num + 1)]
-				
-				for _, payment := range pays {
-					sum += payment.Amount
-				}
-				ch <- types.Progress{
-					Part: len(s.payments),
-					Result: sum,
-				}
+				sendSums(ch, len(all), all[number*num:number*(num+1)])
 			}(channel, i)
 		}
 	}
 	wg.Add(1)
-	go func (ch chan <- types.Progress) {
-		sum := types.Money(0)
+	go func(ch chan<- types.Progress) {
 		defer wg.Done()
-		payments := s.payments[number * i:]
-		for _, payment := range payments {
-			sum += payment.Amount
-		}
-		ch <- types.Progress{
-			Part: len(s.payments),
-			Result: sum,
-		}
+		sendSums(ch, len(all), all[number*i:])
 
 	}(channel)
 
@@ -808,6 +795,24 @@ func (s *Service) SumPaymentsWithProgress() <-chan types.Progress {
 		defer close(channel)
 		wg.Wait()
 	}()
-	
+
 	return channel
-}
\ No newline at end of file
+}
+
+// sendSums sends the sum of a part of the payments in each currency, or a
+// zero sum for a part without payments.
+func sendSums(ch chan<- types.Progress, part int, payments []*types.Payment) {
+	sums := sumPayments(payments)
+	if len(sums) == 0 {
+		ch <- types.Progress{Part: part, Currency: types.DefaultCurrency}
+		return
+	}
+
+	for currency, sum := range sums {
+		ch <- types.Progress{
+			Part:     part,
+			Result:   sum,
+			Currency: currency,
+		}
+	}
+}
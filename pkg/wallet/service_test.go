@@ -1,12 +1,20 @@
 package wallet
 
 import (
+	"bytes"
 	"fmt"
 	"log"
+	"math/rand"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"testing/quick"
 	"sort"
+	"strconv"
+	"sync"
+	"time"
 	"github.com/darkside1809/wallet/pkg/types"
+	"github.com/darkside1809/wallet/pkg/wallet/wallettest"
 	"github.com/google/uuid"
 )
 
@@ -24,6 +32,7 @@ var defaultTestAccount = testAccount{
 }
 type testAccount struct {
 	phone 	types.Phone
+	currency types.Currency
 	balance 	types.Money
 	payments []struct {
 		amount	types.Money
@@ -38,8 +47,23 @@ func newTestService() *testService {
 	return &testService{Service: &Service{}}
 }
 
+// newTestServiceWith returns a test service over the storage with the
+// options.
+func newTestServiceWith(storage Storage, opts ...Option) *testService {
+	return &testService{Service: NewService(storage, opts...)}
+}
+
+// testStart is the time the clocks of the tests start at.
+var testStart = time.Date(2021, 3, 1, 9, 0, 0, 0, time.UTC)
+
 func (s *testService) addAccount(data testAccount) (*types.Account, []*types.Payment, error) {
-	account, err := s.RegisterAccount(data.phone)
+	var account *types.Account
+	var err error
+	if data.currency == "" {
+		account, err = s.RegisterAccount(data.phone)
+	} else {
+		account, err = s.RegisterAccountIn(data.phone, data.currency)
+	}
 	if err != nil {
 		return nil, nil, fmt.Errorf("can't regist account,  error = %v", err)
 	}
@@ -60,6 +84,48 @@ func (s *testService) addAccount(data testAccount) (*types.Account, []*types.Pay
 	return account, payments, nil
 }
 
+// mustAddAccount adds the account, failing the test if it can't, and returns
+// it as stored after its payments.
+func (s *testService) mustAddAccount(t *testing.T, data testAccount) *types.Account {
+	t.Helper()
+
+	account, _, err := s.addAccount(data)
+	if err == nil {
+		account, err = s.FindAccountByID(account.ID)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return account
+}
+
+// testBalance is the balance an account must hold and the part of it that
+// must be available.
+type testBalance struct {
+	balance   types.Money
+	available types.Money
+}
+
+// checkBalances fails the test unless the accounts hold the balances and the
+// service reconciles with its ledger.
+func checkBalances(t *testing.T, s *Service, name string, balances map[int64]testBalance) {
+	t.Helper()
+
+	for id, want := range balances {
+		account, err := s.FindAccountByID(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if account.Balance != want.balance || account.Available != want.available {
+			t.Errorf("%s: account %d must hold %d with %d available, got %d with %d", name, id, want.balance, want.available, account.Balance, account.Available)
+		}
+	}
+	err := s.CheckLedger()
+	if err != nil {
+		t.Errorf("%s: CheckLedger() error = %v", name, err)
+	}
+}
+
 func TestService_FindAccountByID_success(t *testing.T) {
 	svc := &Service{}
 
@@ -231,6 +297,51 @@ func TestService_FavoritePayment_fail(t *testing.T) {
 	}
 }
 
+func TestService_deterministic(t *testing.T) {
+	s := NewService(nil, WithIDGenerator(&wallettest.IDs{Prefix: "id-"}), WithClock(wallettest.NewClock(testStart, time.Second)))
+	account, err := s.RegisterAccount("+992000000001")
+	if err == nil {
+		err = s.Deposit(account.ID, 100)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payment, err := s.Pay(account.ID, 30, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	favorite, err := s.FavoritePayment(payment.ID, "osh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repeated, err := s.PayFromFavorite(favorite.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.ID != "id-1" || favorite.ID != "id-2" || repeated.ID != "id-3" {
+		t.Errorf("IDs must come from the generator, got %s, %s, %s", payment.ID, favorite.ID, repeated.ID)
+	}
+
+	got := &bytes.Buffer{}
+	err = s.ExportJSON(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"nextAccountId":2,
+"accounts":[
+{"id":1,"phone":"+992000000001","currency":"TJS","balance":40}],
+"payments":[
+{"id":"id-1","accountId":1,"amount":30,"refunded":0,"currency":"TJS","category":"auto","status":"INPROGRESS","direction":"OUT","linkedId":"","createdAt":"2021-03-01T09:00:01Z","updatedAt":"2021-03-01T09:00:01Z","settledAt":"0001-01-01T00:00:00Z"},
+{"id":"id-3","accountId":1,"amount":30,"refunded":0,"currency":"TJS","category":"auto","status":"INPROGRESS","direction":"OUT","linkedId":"","createdAt":"2021-03-01T09:00:02Z","updatedAt":"2021-03-01T09:00:02Z","settledAt":"0001-01-01T00:00:00Z"}],
+"favorites":[
+{"id":"id-2","accountId":1,"name":"osh","amount":30,"currency":"TJS","category":"auto"}]}
+`
+	if got.String() != want {
+		t.Errorf("ExportJSON(): got\n%s\nwant\n%s", got, want)
+	}
+}
+
 func TestService_PayFromFavorite_success(t *testing.T) {
 	s := newTestService()
 
@@ -282,6 +393,76 @@ func TestService_ImportFromFile_success(t *testing.T) {
 
 }
 
+// exportedAccounts is a random set of accounts that ExportToFile can write:
+// unique positive IDs and unique phones without separators.
+type exportedAccounts []*types.Account
+
+func (exportedAccounts) Generate(rand *rand.Rand, size int) reflect.Value {
+	accounts := exportedAccounts{}
+	ids := map[int64]bool{}
+	phones := map[types.Phone]bool{}
+
+	for i := rand.Intn(size + 1); i > 0; i-- {
+		id := rand.Int63n(1_000_000) + 1
+		phone := types.Phone(fmt.Sprintf("+992%09d", rand.Intn(1_000_000_000)))
+		if ids[id] || phones[phone] {
+			continue
+		}
+		ids[id] = true
+		phones[phone] = true
+
+		accounts = append(accounts, &types.Account{
+			ID:      id,
+			Phone:   phone,
+			Balance: types.Money(rand.Int63() - rand.Int63()),
+		})
+	}
+
+	return reflect.ValueOf(accounts)
+}
+
+func TestService_ExportToFile_roundTrip(t *testing.T) {
+	dir := t.TempDir()
+
+	roundTrip := func(accounts exportedAccounts) bool {
+		s := newTestService()
+		err := s.store().Update(func(tx Tx) error {
+			for _, account := range accounts {
+				err := tx.Accounts().Save(account)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		path := filepath.Join(dir, "export.txt")
+		err = s.ExportToFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		imported := newTestService()
+		err = imported.ImportFromFile(path)
+		if err != nil {
+			t.Errorf("ImportFromFile(): error = %v", err)
+			return false
+		}
+
+		want, _ := s.snapshot()
+		got, _ := imported.snapshot()
+		return reflect.DeepEqual(got, want)
+	}
+
+	err := quick.Check(roundTrip, nil)
+	if err != nil {
+		t.Errorf("ImportFromFile(): must restore exported accounts, %v", err)
+	}
+}
+
 func TestService_Import_success(t *testing.T) {
 	s := newTestService()
 	err := s.ImportFromFile("export.txt")
@@ -298,12 +479,13 @@ func TestService_Export_success(t *testing.T) {
 	s.RegisterAccount("+992000000001")
 
 
-	err := s.Export("data")
+	dir := t.TempDir()
+	err := s.Export(dir)
 	if err != nil {
 		t.Errorf("method ExportToFile returned not nil error, err => %v", err)
 	}
 
-	err = s.Import("data")
+	err = s.Import(dir)
 	if err != nil {
 		t.Errorf("method ExportToFile returned not nil error, err => %v", err)
 	}
@@ -334,7 +516,7 @@ func TestService_ExportHistory_success(t *testing.T) {
 	if err != nil {
 		t.Errorf("method ExportAccountHistory returned not nil error, err => %v", err)
 	}
-	err = s.HistoryToFiles(payments, "data", 4)
+	err = s.HistoryToFiles(payments, t.TempDir(), 4)
 
 	if err != nil {
 		t.Errorf("method HistoryToFiles returned not nil error, err => %v", err)
@@ -342,6 +524,129 @@ func TestService_ExportHistory_success(t *testing.T) {
 
 } 
 
+func TestService_Pay_concurrent(t *testing.T) {
+	s := newTestService()
+
+	account, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Deposit(account.ID, 1_000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	paid := 0
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.Pay(account.ID, 20, "auto")
+			if err == ErrNotEnoughBalance {
+				return
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			paid++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if paid != 50 {
+		t.Errorf("Pay(): must succeed 50 times, succeeded %v", paid)
+	}
+
+	got, err := s.FindAccountByID(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Balance != 0 {
+		t.Errorf("Pay(): balance must be 0, got %v", got.Balance)
+	}
+}
+
+func TestService_concurrent(t *testing.T) {
+	s := newTestService()
+
+	account, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			err := s.Deposit(account.ID, 100)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			payment, err := s.Pay(account.ID, 10, "auto")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_, err = s.FavoritePayment(payment.ID, "auto")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			err = s.Reject(payment.ID)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			_, err := s.RegisterAccount(types.Phone(fmt.Sprintf("+99290000%04d", i)))
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			s.SumPayments(3)
+			_, err := s.FilterPayments(account.ID, 3)
+			if err != nil {
+				t.Error(err)
+			}
+			_, err = s.FilterPaymentsByFn(filter, 3)
+			if err != nil && err != ErrAccountNotFound {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range s.SumPaymentsWithProgress() {
+			}
+			_, err := s.FindAccountByID(account.ID)
+			if err != nil {
+				t.Error(err)
+			}
+			s.ExportAccountHistory(account.ID)
+		}()
+	}
+	wg.Wait()
+
+	got, err := s.FindAccountByID(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Balance != 20*100 {
+		t.Errorf("balance must be %v, got %v", 20*100, got.Balance)
+	}
+}
+
 func BenchmarkSumPayments(b *testing.B){
 	svc := Service{}
 	account, err := svc.RegisterAccount("+9921283793")
@@ -363,7 +668,7 @@ func BenchmarkSumPayments(b *testing.B){
 	}
 	want := types.Money(1)
 
-	got := svc.SumPayments(2)
+	got := svc.SumPayments(2)[types.DefaultCurrency]
 	if want != got{
 		b.Errorf("want: %v got: %v", want, got)
 	}
@@ -377,8 +682,17 @@ func BenchmarkFilterPayments(b *testing.B) {
 	if err != nil {
 	  b.Error(err)
 	}
-	for i := 0; i < 103; i++ {
-	  s.payments = append(s.payments, &types.Payment{AccountID: account.ID, Amount: 1})
+	err = s.store().Update(func(tx Tx) error {
+		for i := 0; i < 103; i++ {
+			err := tx.Payments().Save(&types.Payment{ID: strconv.Itoa(i), AccountID: account.ID, Amount: 1})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
 	}
   
 	result := 103
@@ -421,7 +735,7 @@ func BenchmarkService_FilterPaymentsByFn(b *testing.B) {
 
 	want := make([]types.Payment, 0)
 
-	for _, payment := range s.payments {
+	for _, payment := range s.allPayments() {
 		if filter(*payment) {
 			want = append(want, *payment)
 		}
@@ -469,4 +783,81 @@ func BenchmarkSumPaymentsWithProgress(b *testing.B) {
 		b.Errorf("got => %v", got)
 	}
 	log.Println(s)
-}
\ No newline at end of file
+}
+const benchmarkRecords = 1_000_000
+
+func newBenchmarkService(b *testing.B) *Service {
+	b.Helper()
+	storage := NewMemoryStorage()
+
+	for i := 1; i <= benchmarkRecords; i++ {
+		storage.state.putAccount(&types.Account{
+			ID:      int64(i),
+			Phone:   types.Phone(fmt.Sprintf("+992%09d", i)),
+			Balance: 1_000_000_00,
+		})
+		storage.state.putPayment(&types.Payment{
+			ID:        fmt.Sprintf("payment-%d", i),
+			AccountID: int64(i),
+			Amount:    1,
+			Category:  "auto",
+			Status:    types.PaymentStatusInProgress,
+		})
+		storage.state.putFavorite(&types.Favorite{
+			ID:        fmt.Sprintf("favorite-%d", i),
+			AccountID: int64(i),
+			Name:      "auto",
+			Amount:    1,
+			Category:  "auto",
+		})
+	}
+
+	b.ResetTimer()
+	return NewService(storage)
+}
+
+func BenchmarkService_FindAccountByID(b *testing.B) {
+	svc := newBenchmarkService(b)
+
+	for i := 0; i < b.N; i++ {
+		_, err := svc.FindAccountByID(int64(i%benchmarkRecords + 1))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkService_FindPaymentByID(b *testing.B) {
+	svc := newBenchmarkService(b)
+	ids := []string{"payment-1", "payment-500000", "payment-1000000"}
+
+	for i := 0; i < b.N; i++ {
+		_, err := svc.FindPaymentByID(ids[i%len(ids)])
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkService_PayFromFavorite(b *testing.B) {
+	svc := newBenchmarkService(b)
+	ids := []string{"favorite-1", "favorite-500000", "favorite-1000000"}
+
+	for i := 0; i < b.N; i++ {
+		_, err := svc.PayFromFavorite(ids[i%len(ids)])
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkService_RegisterAccount(b *testing.B) {
+	svc := newBenchmarkService(b)
+
+	for i := 0; i < b.N; i++ {
+		_, err := svc.RegisterAccount(types.Phone(fmt.Sprintf("+993%09d", i)))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
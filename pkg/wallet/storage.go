@@ -0,0 +1,134 @@
+package wallet
+
+import (
+	"errors"
+
+	"github.com/darkside1809/wallet/pkg/types"
+)
+
+var ErrReadOnlyTx = errors.New("write in read-only transaction")
+var ErrStorageClosed = errors.New("storage closed")
+
+// Storage keeps the wallet state behind Service. Implementations must be safe
+// for concurrent use and serialize Update calls, so a transaction sees no
+// writes but its own.
+type Storage interface {
+	// View runs fn in a read-only transaction.
+	View(fn func(tx Tx) error) error
+	// Update runs fn in a read-write transaction. Writes made by fn are
+	// committed when it returns nil and rolled back otherwise.
+	Update(fn func(tx Tx) error) error
+	// Close releases the resources held by the storage.
+	Close() error
+}
+
+// Tx gives access to the repositories inside a transaction. Repositories must
+// not be used after the transaction function returns.
+type Tx interface {
+	Accounts() AccountRepository
+	Payments() PaymentRepository
+	Favorites() FavoriteRepository
+	Transitions() TransitionRepository
+	Refunds() RefundRepository
+	Ledger() LedgerRepository
+	Holds() HoldRepository
+	Idempotency() IdempotencyRepository
+	// Clear removes the accounts, payments, favorites, ledger and idempotency
+	// records, leaving the state to be loaded from an export. Transitions,
+	// refunds and holds are kept if the transaction stores their account and
+	// payment again, since exports don't carry them, and dropped otherwise.
+	// Account IDs go on from the last one, so a new account never takes the
+	// ID of an account that was cleared.
+	Clear() error
+}
+
+// AccountRepository stores accounts by ID and by phone and currency.
+//
+// ByID and ByPhone return copies; changes are only stored by Save. The slice
+// returned by All is only valid inside the transaction, but its records are
+// shared with the storage and never modified: Save replaces them instead. A
+// copy of the slice is therefore a consistent snapshot. The same applies to
+// the other repositories.
+type AccountRepository interface {
+	ByID(id int64) (*types.Account, error)
+	ByPhone(phone types.Phone, currency types.Currency) (*types.Account, error)
+	All() []*types.Account
+	// Save inserts the account or replaces the one with the same ID. It
+	// returns ErrPhoneRegistered if another account has the same phone in
+	// the same currency, and ErrCurrencyMismatch if it would change the
+	// currency of the account.
+	Save(account *types.Account) error
+	// LastID returns the highest account ID ever saved or reserved.
+	LastID() int64
+	// Reserve raises LastID to id, so IDs up to it are never handed out by
+	// new registrations. It never lowers LastID.
+	Reserve(id int64) error
+}
+
+// PaymentRepository stores payments by ID in insertion order.
+type PaymentRepository interface {
+	ByID(id string) (*types.Payment, error)
+	// ByAccount returns the payments of an account ordered by creation time
+	// and then by ID. Like All, the slice is only valid inside the
+	// transaction.
+	ByAccount(accountID int64) []*types.Payment
+	All() []*types.Payment
+	Save(payment *types.Payment) error
+}
+
+// FavoriteRepository stores favorites by ID in insertion order.
+type FavoriteRepository interface {
+	ByID(id string) (*types.Favorite, error)
+	All() []*types.Favorite
+	Save(favorite *types.Favorite) error
+}
+
+// TransitionRepository keeps the status transitions of payments in the order
+// they were added. Transitions are never changed once added.
+type TransitionRepository interface {
+	// ByPayment returns the transitions of a payment in order.
+	ByPayment(paymentID string) []*types.PaymentTransition
+	All() []*types.PaymentTransition
+	Add(transition *types.PaymentTransition) error
+}
+
+// RefundRepository keeps refunds in the order they were added. Refunds are
+// never changed once added.
+type RefundRepository interface {
+	// ByPayment returns the refunds of a payment in order.
+	ByPayment(paymentID string) []*types.Refund
+	All() []*types.Refund
+	Add(refund *types.Refund) error
+}
+
+// LedgerRepository keeps ledger transactions in the order they were posted,
+// along with the balance of every ledger account they touch. Transactions
+// are never changed once posted.
+type LedgerRepository interface {
+	All() []*types.LedgerTransaction
+	// Post numbers the transaction after the last one and appends it.
+	Post(transaction *types.LedgerTransaction) error
+	// Balance returns the credits minus the debits posted to the account.
+	Balance(account string) types.Money
+}
+
+// HoldRepository stores holds by ID in insertion order.
+type HoldRepository interface {
+	ByID(id string) (*types.Hold, error)
+	// ByAccount returns the holds of an account in order.
+	ByAccount(accountID int64) []*types.Hold
+	All() []*types.Hold
+	Save(hold *types.Hold) error
+}
+
+// IdempotencyRepository stores idempotency records by key in insertion
+// order.
+type IdempotencyRepository interface {
+	ByKey(key string) (*IdempotencyRecord, error)
+	All() []*IdempotencyRecord
+	// Save inserts the record or replaces the one with the same key.
+	Save(record *IdempotencyRecord) error
+	// Delete removes the records of the keys, skipping unknown ones. Deleting
+	// many keys in one call is much cheaper than one at a time.
+	Delete(keys ...string) error
+}
@@ -0,0 +1,160 @@
+package wallet
+
+import (
+	"errors"
+
+	"github.com/darkside1809/wallet/pkg/types"
+)
+
+var ErrSelfTransfer = errors.New("can't transfer to the same account")
+var ErrTransferPayment = errors.New("payment is part of a transfer")
+
+// TransferCategory is the category of both payments of a transfer.
+const TransferCategory types.PaymentCategory = "transfer"
+
+// Transfer moves the amount from an account to the one registered with the
+// phone in the same currency, in one transaction. It records a payment out
+// of the sender and a payment into the recipient, linked to each other and
+// both in progress: confirming either settles the transfer, and rejecting or
+// expiring either reverses it. It returns the payment out of the sender.
+func (s *Service) Transfer(fromAccountID int64, toPhone types.Phone, amount types.Money) (*types.Payment, error) {
+	if amount <= 0 {
+		return nil, ErrAmountMustBePositive
+	}
+
+	var out *types.Payment
+	err := s.update("Transfer", []interface{}{fromAccountID, toPhone, amount}, &out, func(tx Tx) error {
+		sender, err := tx.Accounts().ByID(fromAccountID)
+		if err != nil {
+			return err
+		}
+		recipient, err := tx.Accounts().ByPhone(toPhone, sender.Currency)
+		if err != nil {
+			return err
+		}
+		if recipient.ID == sender.ID {
+			return ErrSelfTransfer
+		}
+		now := s.now()
+		if available(tx, sender, now) < amount {
+			return ErrNotEnoughBalance
+		}
+
+		moved := types.Amount{Value: amount, Currency: sender.Currency}
+		err = debit(sender, moved)
+		if err == nil {
+			err = credit(recipient, moved)
+		}
+		if err != nil {
+			return err
+		}
+		err = tx.Accounts().Save(sender)
+		if err != nil {
+			return err
+		}
+		err = tx.Accounts().Save(recipient)
+		if err != nil {
+			return err
+		}
+
+		out = &types.Payment{
+			ID:        s.newID(),
+			AccountID: sender.ID,
+			Amount:    amount,
+			Currency:  moved.Currency,
+			Category:  TransferCategory,
+			Status:    types.PaymentStatusInProgress,
+			Direction: types.PaymentDirectionOut,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		in := *out
+		in.ID = s.newID()
+		in.AccountID = recipient.ID
+		in.Direction = types.PaymentDirectionIn
+		out.LinkedID = in.ID
+		in.LinkedID = out.ID
+
+		for _, payment := range []*types.Payment{out, &in} {
+			err = tx.Payments().Save(payment)
+			if err != nil {
+				return err
+			}
+			err = s.recordTransition(tx, payment, "")
+			if err != nil {
+				return err
+			}
+		}
+
+		return postTransfer(tx, types.LedgerKindTransfer, out.ID, now, AccountLedger(sender.ID), AccountLedger(recipient.ID), moved)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// reverseTransfer returns what is left of a transfer from the recipient to
+// the sender, refunding the payment out of the sender. It fails with
+// ErrNotEnoughBalance if the recipient has already spent the money or holds
+// it for an authorization.
+func (s *Service) reverseTransfer(tx Tx, out *types.Payment, reason string) error {
+	left := out.Amount - out.Refunded
+	if left == 0 {
+		return nil
+	}
+
+	in, err := tx.Payments().ByID(out.LinkedID)
+	if err != nil {
+		return err
+	}
+	sender, err := tx.Accounts().ByID(out.AccountID)
+	if err != nil {
+		return err
+	}
+	recipient, err := tx.Accounts().ByID(in.AccountID)
+	if err != nil {
+		return err
+	}
+	if available(tx, recipient, s.now()) < left {
+		return ErrNotEnoughBalance
+	}
+
+	returned := types.Amount{Value: left, Currency: out.Currency}
+	err = debit(recipient, returned)
+	if err == nil {
+		err = credit(sender, returned)
+	}
+	if err != nil {
+		return err
+	}
+	out.Refunded += left
+	in.Refunded += left
+	for _, account := range []*types.Account{sender, recipient} {
+		err = tx.Accounts().Save(account)
+		if err != nil {
+			return err
+		}
+	}
+	for _, payment := range []*types.Payment{out, in} {
+		err = tx.Payments().Save(payment)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Refunds().Add(&types.Refund{
+		ID:        s.newID(),
+		PaymentID: out.ID,
+		AccountID: out.AccountID,
+		Amount:    left,
+		Reason:    reason,
+		CreatedAt: out.UpdatedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	return postTransfer(tx, types.LedgerKindReversal, out.ID, out.UpdatedAt, AccountLedger(recipient.ID), AccountLedger(sender.ID), returned)
+}
@@ -0,0 +1,202 @@
+package wallet
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/darkside1809/wallet/pkg/types"
+)
+
+func TestService_Transfer(t *testing.T) {
+	s := newTestService()
+	sender := s.mustAddAccount(t, testAccount{phone: "+992000000001", balance: 100})
+	recipient := s.mustAddAccount(t, testAccount{phone: "+992000000002", balance: 10})
+	out, err := s.Transfer(sender.ID, recipient.Phone, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBalances(t, s.Service, "Transfer()", map[int64]testBalance{sender.ID: {70, 70}, recipient.ID: {40, 40}})
+
+	in, err := s.FindPaymentByID(out.LinkedID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.AccountID != sender.ID || out.Direction != types.PaymentDirectionOut || out.Status != types.PaymentStatusInProgress || out.Category != TransferCategory {
+		t.Errorf("Transfer(): wrong payment out %+v", out)
+	}
+	if in.AccountID != recipient.ID || in.Direction != types.PaymentDirectionIn || in.LinkedID != out.ID || in.Amount != out.Amount || in.Status != types.PaymentStatusInProgress {
+		t.Errorf("Transfer(): wrong payment in %+v", in)
+	}
+
+	for account, id := range map[int64]string{sender.ID: out.ID, recipient.ID: in.ID} {
+		page, err := s.AccountHistory(HistoryQuery{AccountID: account})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Payments) != 1 || page.Payments[0].ID != id {
+			t.Errorf("AccountHistory(%d): must hold %s, got %+v", account, id, page.Payments)
+		}
+	}
+
+	err = s.Confirm(in.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{out.ID, in.ID} {
+		payment, err := s.FindPaymentByID(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if payment.Status != types.PaymentStatusOK {
+			t.Errorf("Confirm(): payment %s must be OK, got %s", id, payment.Status)
+		}
+	}
+	checkBalances(t, s.Service, "Confirm()", map[int64]testBalance{sender.ID: {70, 70}, recipient.ID: {40, 40}})
+
+	_, err = s.Refund(out.ID, 1, "returned")
+	if !errors.Is(err, ErrNotRefundable) {
+		t.Errorf("Refund(): must return ErrNotRefundable for a transfer, returned %v", err)
+	}
+}
+
+func TestService_Transfer_reject(t *testing.T) {
+	for _, side := range []string{"out", "in"} {
+		s := newTestService()
+		sender := s.mustAddAccount(t, testAccount{phone: "+992000000001", balance: 100})
+		recipient := s.mustAddAccount(t, testAccount{phone: "+992000000002", balance: 10})
+		out, err := s.Transfer(sender.ID, recipient.Phone, 30)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := out.ID
+		if side == "in" {
+			id = out.LinkedID
+		}
+
+		err = s.Reject(id)
+		if err != nil {
+			t.Fatalf("Reject(%s): error = %v", side, err)
+		}
+		checkBalances(t, s.Service, "Reject("+side+")", map[int64]testBalance{sender.ID: {100, 100}, recipient.ID: {10, 10}})
+
+		for _, id := range []string{out.ID, out.LinkedID} {
+			payment, err := s.FindPaymentByID(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if payment.Status != types.PaymentStatusFail || payment.Refunded != 30 || payment.Amount != 30 {
+				t.Errorf("Reject(%s): wrong payment %+v", side, payment)
+			}
+		}
+		refunds, err := s.Refunds(out.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(refunds) != 1 || refunds[0].Amount != 30 || refunds[0].Reason != RefundReasonRejected {
+			t.Errorf("Reject(%s): wrong refunds %+v", side, refunds)
+		}
+	}
+}
+
+func TestService_Transfer_rejectSpent(t *testing.T) {
+	s := newTestService()
+	sender := s.mustAddAccount(t, testAccount{phone: "+992000000001", balance: 100})
+	recipient := s.mustAddAccount(t, testAccount{phone: "+992000000002", balance: 10})
+	out, err := s.Transfer(sender.ID, recipient.Phone, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Pay(recipient.ID, 35, "food")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Reject(out.ID)
+	if err != ErrNotEnoughBalance {
+		t.Errorf("Reject(): must return ErrNotEnoughBalance, returned %v", err)
+	}
+	payment, err := s.FindPaymentByID(out.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.Status != types.PaymentStatusInProgress {
+		t.Errorf("Reject(): transfer must stay in progress, got %s", payment.Status)
+	}
+	checkBalances(t, s.Service, "Reject()", map[int64]testBalance{sender.ID: {70, 70}, recipient.ID: {5, 5}})
+}
+
+func TestService_Transfer_rejectHeld(t *testing.T) {
+	s := newTestService()
+	sender := s.mustAddAccount(t, testAccount{phone: "+992000000001", balance: 100})
+	recipient := s.mustAddAccount(t, testAccount{phone: "+992000000002", balance: 10})
+	out, err := s.Transfer(sender.ID, recipient.Phone, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Authorize(recipient.ID, 35, "food")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Reject(out.ID)
+	if err != ErrNotEnoughBalance {
+		t.Errorf("Reject(): must return ErrNotEnoughBalance, returned %v", err)
+	}
+	checkBalances(t, s.Service, "Reject()", map[int64]testBalance{sender.ID: {70, 70}, recipient.ID: {40, 5}})
+}
+
+func TestService_Transfer_repeat(t *testing.T) {
+	s := newTestService()
+	sender := s.mustAddAccount(t, testAccount{phone: "+992000000001", balance: 100})
+	recipient := s.mustAddAccount(t, testAccount{phone: "+992000000002", balance: 10})
+	out, err := s.Transfer(sender.ID, recipient.Phone, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, paymentID := range []string{out.ID, out.LinkedID} {
+		_, err := s.Repeat(paymentID)
+		if !errors.Is(err, ErrTransferPayment) {
+			t.Errorf("Repeat(%s): must return ErrTransferPayment, returned %v", paymentID, err)
+		}
+		_, err = s.FavoritePayment(paymentID, "again")
+		if !errors.Is(err, ErrTransferPayment) {
+			t.Errorf("FavoritePayment(%s): must return ErrTransferPayment, returned %v", paymentID, err)
+		}
+	}
+	if sums := s.SumPayments(2); sums[types.DefaultCurrency] != 30 {
+		t.Errorf("SumPayments(): must count the transfer once, got %v", sums)
+	}
+	checkBalances(t, s.Service, "Repeat()", map[int64]testBalance{sender.ID: {70, 70}, recipient.ID: {40, 40}})
+}
+
+func TestService_Transfer_fail(t *testing.T) {
+	s := newTestService()
+	sender := s.mustAddAccount(t, testAccount{phone: "+992000000001", balance: 100})
+	recipient := s.mustAddAccount(t, testAccount{phone: "+992000000002", balance: 10})
+	_, err := s.Transfer(sender.ID, recipient.Phone, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		from   int64
+		to     types.Phone
+		amount types.Money
+		err    error
+	}{
+		{"zero amount", sender.ID, recipient.Phone, 0, ErrAmountMustBePositive},
+		{"unknown sender", 100, recipient.Phone, 1, ErrAccountNotFound},
+		{"unknown recipient", sender.ID, "+992000000100", 1, ErrAccountNotFound},
+		{"same account", sender.ID, sender.Phone, 1, ErrSelfTransfer},
+		{"not enough balance", sender.ID, recipient.Phone, 71, ErrNotEnoughBalance},
+	}
+	for _, test := range tests {
+		_, err := s.Transfer(test.from, test.to, test.amount)
+		if err != test.err {
+			t.Errorf("Transfer(%s): must return %v, returned %v", test.name, test.err, err)
+		}
+	}
+	checkBalances(t, s.Service, "Transfer()", map[int64]testBalance{sender.ID: {70, 70}, recipient.ID: {40, 40}})
+}
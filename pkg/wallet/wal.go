@@ -0,0 +1,484 @@
+package wallet
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/darkside1809/wallet/pkg/types"
+)
+
+var ErrLogCorrupted = errors.New("operation log corrupted")
+
+// walHeaderSize is the size of the frame header: payload length and CRC-32C
+// of the payload, both little endian uint32.
+const walHeaderSize = 8
+
+// walMoreFrames is set in the length of a frame that is followed by another
+// frame of the same record. A record larger than walMaxRecordSize is split
+// into several frames, which replay joins back before decoding it.
+const walMoreFrames = 1 << 31
+
+// walMaxRecordSize bounds the payload length of a frame, so a garbage length
+// read from a header can't make replay allocate gigabytes. It is a variable
+// for tests.
+var walMaxRecordSize = 64 << 20
+
+var walTable = crc32.MakeTable(crc32.Castagnoli)
+
+// walRecord is one committed transaction. Seq grows by one with every record.
+type walRecord struct {
+	Seq uint64
+	Ops []walOp
+}
+
+// walOp stores one record saved by the transaction, a Clear, a reserved
+// account ID or deleted idempotency keys; exactly one field is set.
+type walOp struct {
+	Clear         bool                     `json:",omitempty"`
+	LastAccountID int64                    `json:",omitempty"`
+	Account       *types.Account           `json:",omitempty"`
+	Payment       *types.Payment           `json:",omitempty"`
+	Favorite      *types.Favorite          `json:",omitempty"`
+	Transition    *types.PaymentTransition `json:",omitempty"`
+	Refund        *types.Refund            `json:",omitempty"`
+	Ledger        *types.LedgerTransaction `json:",omitempty"`
+	Hold          *types.Hold              `json:",omitempty"`
+	Idempotency   *IdempotencyRecord       `json:",omitempty"`
+	// DeletedKeys are idempotency keys that were forgotten.
+	DeletedKeys []string `json:",omitempty"`
+}
+
+// wal is an append-only operation log. Every append is synced to disk before
+// it returns, so a record that was appended survives a crash.
+//
+// The log is split into segments named after the sequence number of their
+// first record. Rotating to a new segment is cheap, which lets a snapshot
+// cut the log at its sequence number and remove the older segments once it
+// is safely written.
+type wal struct {
+	dir  string
+	file *os.File
+	// first is the sequence number of the first record of the current
+	// segment.
+	first uint64
+	size  int64
+	seq   uint64
+	// err is set when a failed append couldn't be undone, after which the
+	// log refuses to grow to avoid writing behind garbage.
+	err error
+}
+
+func walSegmentPath(dir string, first uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("wallet.%020d.log", first))
+}
+
+// walSegments lists the segments in dir by the sequence number of their first
+// record, in order.
+func walSegments(dir string) ([]uint64, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "wallet.*.log"))
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]uint64, 0, len(paths))
+	for _, path := range paths {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "wallet."), ".log")
+		first, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, first)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i] < segments[j]
+	})
+
+	return segments, nil
+}
+
+// openWAL opens the log in dir and passes every record after the sequence
+// number seq, which the caller already has from a snapshot, to apply in
+// order. A torn record at the end of the last segment, left by a crash in the
+// middle of an append, is truncated away; damage anywhere else, or a gap
+// after seq, is reported as ErrLogCorrupted.
+func openWAL(dir string, seq uint64, apply func(record *walRecord) error) (*wal, error) {
+	segments, err := walSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &wal{dir: dir, seq: seq}
+	prev := uint64(0)
+
+	for i, first := range segments {
+		last := i == len(segments)-1
+
+		file, err := os.OpenFile(walSegmentPath(dir, first), os.O_RDWR, 0o644)
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := w.replay(file, last, &prev, apply)
+		if err != nil || !last {
+			file.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if last {
+			w.file = file
+			w.first = first
+			w.size = size
+		}
+	}
+
+	if w.file == nil {
+		err = w.create(w.seq + 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return w, nil
+}
+
+// replay reads a segment, applying records after w.seq, and returns the size
+// of its valid part. Only the last segment may end with a torn record: the
+// others were synced before the log moved past them.
+func (w *wal) replay(file *os.File, last bool, prev *uint64, apply func(record *walRecord) error) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, walHeaderSize)
+	offset := int64(0)
+	// start is the offset of the first frame of the record being read, and
+	// payload the frames of it read so far.
+	start := int64(0)
+	var payload []byte
+
+	for offset < info.Size() {
+		frame, more, err := readWALRecord(reader, header, info.Size()-offset)
+		if err == io.ErrUnexpectedEOF && last {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%w: %s:%d: %v", ErrLogCorrupted, file.Name(), offset, err)
+		}
+		offset += walHeaderSize + int64(len(frame))
+		payload = append(payload, frame...)
+		if more {
+			continue
+		}
+
+		at := start
+		start = offset
+		record := &walRecord{}
+		err = json.Unmarshal(payload, record)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %s:%d: %v", ErrLogCorrupted, file.Name(), at, err)
+		}
+		if *prev != 0 && record.Seq != *prev+1 {
+			return 0, fmt.Errorf("%w: %s:%d: sequence %d after %d", ErrLogCorrupted, file.Name(), at, record.Seq, *prev)
+		}
+		*prev = record.Seq
+		payload = nil
+
+		if record.Seq <= w.seq {
+			continue
+		}
+		if record.Seq != w.seq+1 {
+			return 0, fmt.Errorf("%w: %s:%d: sequence %d after snapshot %d", ErrLogCorrupted, file.Name(), at, record.Seq, w.seq)
+		}
+
+		err = apply(record)
+		if err != nil {
+			return 0, err
+		}
+		w.seq = record.Seq
+	}
+
+	if start < info.Size() && !last {
+		return 0, fmt.Errorf("%w: %s:%d: record cut short", ErrLogCorrupted, file.Name(), start)
+	}
+	if start < info.Size() {
+		log.Printf("operation log: truncating torn record at %s:%d", file.Name(), start)
+		offset = start
+		err = file.Truncate(offset)
+		if err != nil {
+			return 0, err
+		}
+		err = file.Sync()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+
+	return offset, nil
+}
+
+// create starts a new empty segment for records from first on.
+func (w *wal) create(first uint64) error {
+	file, err := os.OpenFile(walSegmentPath(w.dir, first), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+
+	err = syncDir(w.dir)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	w.file = file
+	w.first = first
+	w.size = 0
+	return nil
+}
+
+// rotate moves appends to a new segment, so every record up to the current
+// sequence number is in older segments.
+func (w *wal) rotate() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.first == w.seq+1 {
+		return nil
+	}
+
+	old := w.file
+	err := w.create(w.seq + 1)
+	if err != nil {
+		return err
+	}
+
+	return old.Close()
+}
+
+// removeBefore deletes the segments holding only records up to seq.
+func (w *wal) removeBefore(seq uint64) error {
+	segments, err := walSegments(w.dir)
+	if err != nil {
+		return err
+	}
+
+	for i, first := range segments {
+		if i+1 == len(segments) || segments[i+1] > seq+1 || first == w.first {
+			break
+		}
+
+		err = os.Remove(walSegmentPath(w.dir, first))
+		if err != nil {
+			return err
+		}
+	}
+
+	return syncDir(w.dir)
+}
+
+// readWALRecord reads one frame with at most remaining bytes left in the log
+// and reports whether more frames of the same record follow. It returns
+// io.ErrUnexpectedEOF when the frame is torn: it is cut short, or it runs up
+// to the end of the log and fails its checksum.
+func readWALRecord(reader io.Reader, header []byte, remaining int64) ([]byte, bool, error) {
+	if remaining < walHeaderSize {
+		return nil, false, io.ErrUnexpectedEOF
+	}
+
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, false, err
+	}
+
+	length := binary.LittleEndian.Uint32(header[0:4])
+	more := length&walMoreFrames != 0
+	size := int64(length &^ walMoreFrames)
+	sum := binary.LittleEndian.Uint32(header[4:8])
+	if size > remaining-walHeaderSize {
+		return nil, false, io.ErrUnexpectedEOF
+	}
+	if size > int64(walMaxRecordSize) {
+		return nil, false, fmt.Errorf("frame of %d bytes", size)
+	}
+
+	payload := make([]byte, size)
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if crc32.Checksum(payload, walTable) != sum {
+		if size == remaining-walHeaderSize {
+			return nil, false, io.ErrUnexpectedEOF
+		}
+		return nil, false, errors.New("checksum mismatch")
+	}
+
+	return payload, more, nil
+}
+
+// append writes the operations as the next record and syncs the log. A
+// record larger than walMaxRecordSize is written as several frames, synced
+// together, so replay can always read back what was acknowledged.
+func (w *wal) append(ops []walOp) error {
+	if w.err != nil {
+		return w.err
+	}
+
+	payload, err := json.Marshal(&walRecord{Seq: w.seq + 1, Ops: ops})
+	if err != nil {
+		return err
+	}
+
+	frames := (len(payload) + walMaxRecordSize - 1) / walMaxRecordSize
+	if frames == 0 {
+		frames = 1
+	}
+	buf := make([]byte, 0, frames*walHeaderSize+len(payload))
+	for rest := payload; ; {
+		frame := rest
+		if len(frame) > walMaxRecordSize {
+			frame = rest[:walMaxRecordSize]
+		}
+		rest = rest[len(frame):]
+
+		length := uint32(len(frame))
+		if len(rest) > 0 {
+			length |= walMoreFrames
+		}
+		var header [walHeaderSize]byte
+		binary.LittleEndian.PutUint32(header[0:4], length)
+		binary.LittleEndian.PutUint32(header[4:8], crc32.Checksum(frame, walTable))
+		buf = append(buf, header[:]...)
+		buf = append(buf, frame...)
+		if len(rest) == 0 {
+			break
+		}
+	}
+
+	_, err = w.file.Write(buf)
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		w.undo()
+		return err
+	}
+
+	w.seq++
+	w.size += int64(len(buf))
+	return nil
+}
+
+// undo cuts a failed append off the log.
+func (w *wal) undo() {
+	err := w.file.Truncate(w.size)
+	if err == nil {
+		_, err = w.file.Seek(w.size, io.SeekStart)
+	}
+	if err != nil {
+		w.err = fmt.Errorf("operation log unusable after failed append: %w", err)
+	}
+}
+
+func (w *wal) close() error {
+	return w.file.Close()
+}
+
+// walOps converts the records saved by a transaction to log operations.
+func walOps(changes []interface{}) []walOp {
+	ops := make([]walOp, 0, len(changes))
+
+	for _, change := range changes {
+		switch record := change.(type) {
+		case clearState:
+			ops = append(ops, walOp{Clear: true})
+		case reservedID:
+			ops = append(ops, walOp{LastAccountID: int64(record)})
+		case *types.Account:
+			ops = append(ops, walOp{Account: record})
+		case *types.Payment:
+			ops = append(ops, walOp{Payment: record})
+		case *types.Favorite:
+			ops = append(ops, walOp{Favorite: record})
+		case *types.PaymentTransition:
+			ops = append(ops, walOp{Transition: record})
+		case *types.Refund:
+			ops = append(ops, walOp{Refund: record})
+		case *types.LedgerTransaction:
+			ops = append(ops, walOp{Ledger: record})
+		case *types.Hold:
+			ops = append(ops, walOp{Hold: record})
+		case *IdempotencyRecord:
+			ops = append(ops, walOp{Idempotency: record})
+		case deletedIdempotencyKeys:
+			ops = append(ops, walOp{DeletedKeys: record})
+		default:
+			panic(fmt.Sprintf("operation log: unexpected record %T", change))
+		}
+	}
+
+	return ops
+}
+
+// apply stores the operations of a replayed record.
+func (st *memoryState) apply(record *walRecord) error {
+	cleared := false
+	for _, op := range record.Ops {
+		switch {
+		case op.Clear:
+			st.clear()
+			cleared = true
+		case op.LastAccountID != 0:
+			st.reserve(op.LastAccountID)
+		case op.Account != nil:
+			_, err := st.putAccount(op.Account)
+			if err != nil {
+				return fmt.Errorf("%w: sequence %d: %v", ErrLogCorrupted, record.Seq, err)
+			}
+		case op.Payment != nil:
+			st.putPayment(op.Payment)
+		case op.Favorite != nil:
+			st.putFavorite(op.Favorite)
+		case op.Transition != nil:
+			st.addTransition(op.Transition)
+		case op.Refund != nil:
+			st.addRefund(op.Refund)
+		case op.Ledger != nil:
+			st.postLedger(op.Ledger)
+		case op.Hold != nil:
+			st.putHold(op.Hold)
+		case op.Idempotency != nil:
+			st.putIdempotency(op.Idempotency)
+		case len(op.DeletedKeys) > 0:
+			st.deleteIdempotency(op.DeletedKeys)
+		default:
+			return fmt.Errorf("%w: sequence %d: empty operation", ErrLogCorrupted, record.Seq)
+		}
+	}
+	if cleared {
+		st.dropOrphans()
+	}
+
+	return nil
+}
@@ -0,0 +1,263 @@
+package wallet
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+
+	"github.com/darkside1809/wallet/pkg/types"
+)
+
+// checkStoredBalances reopens the storage in the directory and checks the
+// balances of its accounts with checkBalances.
+func checkStoredBalances(t *testing.T, dir string, name string, balances map[int64]testBalance) {
+	t.Helper()
+
+	storage, err := OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	checkBalances(t, NewService(storage), name, balances)
+}
+
+func logSize(t *testing.T, dir string) int64 {
+	t.Helper()
+
+	info, err := os.Stat(walSegmentPath(dir, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestFileStorage_tornTail(t *testing.T) {
+	dir := t.TempDir()
+
+	storage, err := OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(storage)
+	account, err := svc.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Deposit(account.ID, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastStart := logSize(t, dir)
+	err = svc.Deposit(account.ID, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	content, err := os.ReadFile(walSegmentPath(dir, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for cut := lastStart + 1; cut < int64(len(content)); cut++ {
+		torn := t.TempDir()
+		err = os.WriteFile(walSegmentPath(torn, 1), content[:cut], 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		checkStoredBalances(t, torn, "cut at "+strconv.FormatInt(cut, 10), map[int64]testBalance{account.ID: {100, 100}})
+		if got := logSize(t, torn); got != lastStart {
+			t.Fatalf("cut at %d: log must be truncated to %d, got %d", cut, lastStart, got)
+		}
+
+		storage, err := OpenFileStorage(torn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = NewService(storage).Deposit(account.ID, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		storage.Close()
+
+		checkStoredBalances(t, torn, "cut at "+strconv.FormatInt(cut, 10)+" after append", map[int64]testBalance{account.ID: {101, 101}})
+	}
+}
+
+func TestFileStorage_corruptedLog(t *testing.T) {
+	dir := t.TempDir()
+
+	storage, err := OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(storage)
+	account, err := svc.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Deposit(account.ID, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	path := walSegmentPath(dir, 1)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[walHeaderSize+1] ^= 0xff
+	err = os.WriteFile(path, content, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenFileStorage(dir)
+	if !errors.Is(err, ErrLogCorrupted) {
+		t.Errorf("OpenFileStorage(): must return ErrLogCorrupted, returned %v", err)
+	}
+}
+
+// TestFileStorage_killedWriter kills a process in the middle of a stream of
+// deposits and checks that every acknowledged one survived.
+func TestFileStorage_killedWriter(t *testing.T) {
+	if dir := os.Getenv("WALLET_KILLED_WRITER_DIR"); dir != "" {
+		runKilledWriter(dir)
+		return
+	}
+
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestFileStorage_killedWriter$")
+	cmd.Env = append(os.Environ(), "WALLET_KILLED_WRITER_DIR="+dir)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acknowledged := 0
+	scanner := bufio.NewScanner(stdout)
+	for acknowledged < 200 && scanner.Scan() {
+		acknowledged, err = strconv.Atoi(scanner.Text())
+		if err != nil {
+			cmd.Process.Kill()
+			t.Fatal(err)
+		}
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+
+	if acknowledged < 200 {
+		t.Fatalf("writer stopped after %d deposits", acknowledged)
+	}
+	storage, err := OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	account, err := NewService(storage).FindAccountByID(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance < types.Money(acknowledged) {
+		t.Errorf("balance must be at least %d, got %v", acknowledged, account.Balance)
+	}
+}
+
+func runKilledWriter(dir string) {
+	storage, err := OpenFileStorage(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	svc := NewService(storage)
+	account, err := svc.RegisterAccount("+992000000001")
+	if err != nil {
+		panic(err)
+	}
+
+	for i := 1; ; i++ {
+		err = svc.Deposit(account.ID, 1)
+		if err != nil {
+			panic(err)
+		}
+		os.Stdout.WriteString(strconv.Itoa(i) + "\n")
+	}
+}
+
+// TestFileStorage_largeRecord imports more than fits in one frame and checks
+// that the import survives a reopen, and that a record torn anywhere in its
+// frames is dropped as a whole.
+func TestFileStorage_largeRecord(t *testing.T) {
+	defer func(size int) { walMaxRecordSize = size }(walMaxRecordSize)
+	walMaxRecordSize = 512
+
+	source := NewService(nil)
+	account, err := source.RegisterAccount("+992000000001")
+	if err == nil {
+		err = source.Deposit(account.ID, 1000)
+	}
+	for i := 0; err == nil && i < 50; i++ {
+		_, err = source.Pay(account.ID, 1, "auto")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	err = source.ExportJSON(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	storage, err := OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(storage)
+	_, err = svc.RegisterAccount("+992000000001")
+	if err == nil {
+		err = svc.Deposit(account.ID, 100)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastStart := logSize(t, dir)
+	err = svc.ImportJSON(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	content, err := os.ReadFile(walSegmentPath(dir, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(content))-lastStart < 4*int64(walMaxRecordSize) {
+		t.Fatalf("import must span several frames, took %d bytes", int64(len(content))-lastStart)
+	}
+	checkStoredBalances(t, dir, "OpenFileStorage()", map[int64]testBalance{account.ID: {950, 950}})
+
+	for cut := lastStart + 1; cut < int64(len(content)); cut += 61 {
+		torn := t.TempDir()
+		err = os.WriteFile(walSegmentPath(torn, 1), content[:cut], 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		checkStoredBalances(t, torn, "cut at "+strconv.FormatInt(cut, 10), map[int64]testBalance{account.ID: {100, 100}})
+		if got := logSize(t, torn); got != lastStart {
+			t.Fatalf("cut at %d: log must be truncated to %d, got %d", cut, lastStart, got)
+		}
+	}
+}
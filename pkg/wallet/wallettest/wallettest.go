@@ -0,0 +1,65 @@
+// Package wallettest provides test doubles for the clock and ID generator of
+// wallet.Service, so tests can assert exact IDs and times.
+package wallettest
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// IDs hands out sequential IDs: Prefix followed by 1, 2, 3 and so on.
+// It is safe for concurrent use.
+type IDs struct {
+	Prefix string
+
+	mu   sync.Mutex
+	last int
+}
+
+func (g *IDs) NewID() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.last++
+	return g.Prefix + strconv.Itoa(g.last)
+}
+
+// Clock is a fake clock that only moves when told to: by Set, by Advance, or
+// by its step after every reading. It is safe for concurrent use.
+type Clock struct {
+	mu   sync.Mutex
+	now  time.Time
+	step time.Duration
+}
+
+// NewClock returns a clock reading now, which moves step forward after every
+// reading; a zero step keeps it still.
+func NewClock(now time.Time, step time.Duration) *Clock {
+	return &Clock{now: now, step: step}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now
+	c.now = c.now.Add(c.step)
+	return now
+}
+
+// Set moves the clock to now.
+func (c *Clock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = now
+}
+
+// Advance moves the clock d forward.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
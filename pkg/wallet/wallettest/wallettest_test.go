@@ -0,0 +1,64 @@
+package wallettest
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIDs_NewID(t *testing.T) {
+	ids := &IDs{Prefix: "payment-"}
+
+	for _, want := range []string{"payment-1", "payment-2", "payment-3"} {
+		got := ids.NewID()
+		if got != want {
+			t.Errorf("NewID(): got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestIDs_NewID_concurrent(t *testing.T) {
+	ids := &IDs{}
+	seen := make(chan string, 100)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			seen <- ids.NewID()
+		}()
+	}
+	wg.Wait()
+	close(seen)
+
+	unique := map[string]bool{}
+	for id := range seen {
+		unique[id] = true
+	}
+	if len(unique) != 100 {
+		t.Errorf("NewID(): handed out %d distinct IDs to 100 callers", len(unique))
+	}
+}
+
+func TestClock(t *testing.T) {
+	start := time.Date(2021, 3, 1, 9, 0, 0, 0, time.UTC)
+	clock := NewClock(start, time.Second)
+
+	if got := clock.Now(); !got.Equal(start) {
+		t.Errorf("Now(): got %v, want %v", got, start)
+	}
+	if got := clock.Now(); !got.Equal(start.Add(time.Second)) {
+		t.Errorf("Now(): must step after every reading, got %v", got)
+	}
+
+	clock.Advance(time.Hour)
+	if got := clock.Now(); !got.Equal(start.Add(time.Hour + 2*time.Second)) {
+		t.Errorf("Advance(): got %v", got)
+	}
+
+	clock.Set(start)
+	if got := clock.Now(); !got.Equal(start) {
+		t.Errorf("Set(): got %v, want %v", got, start)
+	}
+}